@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/credentials"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	"gopkg.in/yaml.v2"
+)
+
+// CredentialConfigFile describes the layout of a credential configuration file
+// found in the configuration directory.
+type CredentialConfigFile struct {
+	SSH            []*credentials.SSHHostCertificate `mapstructure:"ssh"`
+	Pki            []*credentials.PKICertificate     `mapstructure:"pki"`
+	Vault          []*credentials.VaultToken         `mapstructure:"vault"`
+	Template       []*credentials.CredentialTemplate `mapstructure:"template"`
+	Wrapped        []*credentials.WrappedSecret      `mapstructure:"wrapped"`
+	AppRole        []*credentials.AppRoleSecretID    `mapstructure:"approle"`
+	NativeTemplate []*credentials.NativeTemplate     `mapstructure:"native_template" yaml:"native_template"`
+}
+
+// each calls fn for every credential in the file, stopping at the first error.
+// name points to the name configured for the credential, which is empty if no
+// name is configured.
+func (c *CredentialConfigFile) each(fn func(credType string, index int, name *string, cred Credential) error) error {
+	for i, item := range c.SSH {
+		if err := fn("ssh", i, &item.Name, item); err != nil {
+			return err
+		}
+	}
+	for i, item := range c.Pki {
+		if err := fn("pki", i, &item.Name, item); err != nil {
+			return err
+		}
+	}
+	for i, item := range c.Vault {
+		if err := fn("vault", i, &item.Name, item); err != nil {
+			return err
+		}
+	}
+	for i, item := range c.Template {
+		if err := fn("template", i, &item.Name, item); err != nil {
+			return err
+		}
+	}
+	for i, item := range c.Wrapped {
+		if err := fn("wrapped", i, &item.Name, item); err != nil {
+			return err
+		}
+	}
+	for i, item := range c.AppRole {
+		if err := fn("approle", i, &item.Name, item); err != nil {
+			return err
+		}
+	}
+	for i, item := range c.NativeTemplate {
+		if err := fn("native_template", i, &item.Name, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateCredentialName checks that a configured credential name can be used
+// to address the credential through the control API.
+func validateCredentialName(name string) error {
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("name '%s' must not contain '/'", name)
+	}
+	return nil
+}
+
+// managedCredential is a credential along with enough information about where
+// it was loaded from to identify it across configuration reloads.
+type managedCredential struct {
+	// Name is the configured name of the credential, or a name derived from
+	// its position in the configuration if no name is configured.
+	Name       string
+	Credential Credential
+	// fingerprint is the serialized configuration of the credential, taken
+	// before it is initialized.
+	fingerprint string
+}
+
+// defaultCredentialName names a credential without a configured name by its
+// position in the configuration.
+func defaultCredentialName(fileName, credType string, index int) string {
+	return fmt.Sprintf("%s:%s[%d]", fileName, credType, index)
+}
+
+func newManagedCredential(fileName, credType string, index int, name string, cred Credential) (*managedCredential, error) {
+	serialized, err := yaml.Marshal(cred)
+	if err != nil {
+		return nil, fmt.Errorf("%s -- unable to serialize %s credential %d: %v", fileName, credType, index, err)
+	}
+
+	if name == "" {
+		name = defaultCredentialName(fileName, credType, index)
+	}
+
+	return &managedCredential{
+		Name:        name,
+		Credential:  cred,
+		fingerprint: fmt.Sprintf("%s\n%s", credType, serialized),
+	}, nil
+}
+
+func (c *managedCredential) logFields() logging.Fields {
+	return logging.Fields{"credential": c.Name, "description": c.Credential.String()}
+}
+
+func (c *managedCredential) String() string {
+	return fmt.Sprintf("%s (%s)", c.Name, c.Credential)
+}
+
+func isCredentialConfigFile(f os.FileInfo) bool {
+	return !f.IsDir() && (filepath.Ext(f.Name()) == ".yml" || filepath.Ext(f.Name()) == ".yaml")
+}
+
+// loads all credential configs found in config dir and merges them into one list
+func loadCredentialConfigs(configDir string) ([]*managedCredential, error) {
+	var creds []*managedCredential
+	names := make(map[string]string)
+	files, err := ioutil.ReadDir(configDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !isCredentialConfigFile(f) {
+			logger.Debug("config_ignored", "Ignoring file in credential config dir", logging.Fields{"file": f.Name()})
+			continue
+		}
+
+		contents, readErr := ioutil.ReadFile(filepath.Join(configDir, f.Name()))
+		if readErr != nil {
+			return nil, readErr
+		}
+
+		config := &CredentialConfigFile{}
+		unmarshalErr := yaml.Unmarshal(contents, config)
+		if unmarshalErr != nil {
+			return nil, fmt.Errorf("%s -- %v", f.Name(), unmarshalErr)
+		}
+
+		err := config.each(func(credType string, index int, name *string, cred Credential) error {
+			if err := validateCredentialName(*name); err != nil {
+				return fmt.Errorf("%s -- %v", f.Name(), err)
+			}
+
+			c, err := newManagedCredential(f.Name(), credType, index, *name, cred)
+			if err != nil {
+				return err
+			}
+			// the credential identifies itself by name in log entries
+			*name = c.Name
+
+			if otherFile, ok := names[c.Name]; ok {
+				return fmt.Errorf("%s -- duplicate credential name '%s', already defined in %s", f.Name(), c.Name, otherFile)
+			}
+			names[c.Name] = f.Name()
+
+			creds = append(creds, c)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return creds, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/control"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	"github.com/spf13/viper"
+)
+
+const defaultControlSocket = "/run/credmanager/control.sock"
+
+// fileModeSetting reads a file mode from the configuration.  Unquoted octal
+// values are parsed by yaml as integers, quoted values are parsed as octal.
+func fileModeSetting(key string) (os.FileMode, error) {
+	switch v := viper.Get(key).(type) {
+	case int:
+		return os.FileMode(v), nil
+	case string:
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid file mode for %s: %v", key, err)
+		}
+		return os.FileMode(mode), nil
+	default:
+		return 0, fmt.Errorf("invalid file mode for %s: %v", key, v)
+	}
+}
+
+// startControlServer starts serving the control API for manager on socketPath
+func startControlServer(socketPath string, manager control.Manager) (*control.Server, error) {
+	mode, err := fileModeSetting("control.mode")
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := control.Listen(socketPath, mode, viper.GetString("control.group"), manager)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := server.Serve(); err != nil {
+			logger.Error("control_server_error", "Control server exited", logging.Fields{"error": err})
+		}
+	}()
+	logger.Info("control_server_started", "Started control server", logging.Fields{"socket": socketPath})
+	return server, nil
+}
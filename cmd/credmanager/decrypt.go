@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/credentials"
+	"github.com/spf13/viper"
+)
+
+// decrypt prints the decrypted contents of an encrypted credential file, or
+// writes them to the output file.  Returns the exit code for the command.
+// The command is run by consumers of the credential, so it only uses the
+// token given to it and never logs in with the daemon's auth method, which
+// may consume the daemon's bootstrap credentials.
+func decrypt(args []string) int {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	configFile := flags.String("config", "", "path to the main configuration file, used for the vault address and TLS settings")
+	address := flags.String("address", "", "vault address (default from config)")
+	tokenFile := flags.String("token-file", "", "file containing the vault token to decrypt with (required)")
+	outFile := flags.String("out", "", "write the decrypted contents to this file instead of stdout")
+	mode := flags.String("mode", "0600", "octal mode of the output file")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s decrypt [options] <file>\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if *tokenFile == "" {
+		fmt.Fprintf(os.Stderr, "A token file is required, decrypt doesn't log in with the daemon's auth method\n")
+		return 2
+	}
+
+	outMode, err := strconv.ParseUint(*mode, 8, 32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid mode '%s': %v\n", *mode, err)
+		return 2
+	}
+
+	contents, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read encrypted file: %v\n", err)
+		return 1
+	}
+	if !credentials.IsEncrypted(string(contents)) {
+		fmt.Fprintf(os.Stderr, "%s is not an encrypted credential file\n", flags.Arg(0))
+		return 1
+	}
+
+	if err := readConfig(*configFile); err != nil && *configFile != "" {
+		fmt.Fprintf(os.Stderr, "Unable to read config file: %v\n", err)
+		return 1
+	}
+	if *address != "" {
+		viper.Set("vault.address", *address)
+	}
+
+	vaultClient, err := newVaultClient(nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create vault client: %v\n", err)
+		return 1
+	}
+
+	token, err := ioutil.ReadFile(*tokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read token file: %v\n", err)
+		return 1
+	}
+	vaultClient.SetToken(strings.TrimSpace(string(token)))
+
+	plaintext, err := credentials.Decrypt(vaultClient, string(contents))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to decrypt %s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+
+	if *outFile == "" {
+		fmt.Print(plaintext)
+		return 0
+	}
+	if err := ioutil.WriteFile(*outFile, []byte(plaintext), os.FileMode(outMode)); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write decrypted file: %v\n", err)
+		return 1
+	}
+	return 0
+}
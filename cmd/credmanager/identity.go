@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/credentials"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	"github.com/spf13/viper"
+)
+
+// clientIdentity presents a certificate managed by credmanager as the client
+// certificate of our own vault client, reloading it whenever the credential is
+// renewed.
+type clientIdentity struct {
+	name      string
+	certFile  string
+	keyFile   string
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	transport *http.Transport
+}
+
+// configuredIdentity returns the identity named by vault.identity_credential,
+// or nil if no identity is configured.
+func configuredIdentity(credList []*managedCredential) (*clientIdentity, error) {
+	name := viper.GetString("vault.identity_credential")
+	if name == "" {
+		return nil, nil
+	}
+
+	for _, c := range credList {
+		if c.Name != name {
+			continue
+		}
+
+		pki, ok := c.Credential.(*credentials.PKICertificate)
+		if !ok {
+			return nil, fmt.Errorf("identity credential '%s' is not a pki certificate", name)
+		}
+		certFile, keyFile := pki.CertificateFile.File(), pki.PrivateKeyFile.File()
+		if certFile == nil || keyFile == nil {
+			return nil, fmt.Errorf("identity credential '%s' must write its certificate and private key to files", name)
+		}
+		return &clientIdentity{name: name, certFile: certFile.Path(), keyFile: keyFile.Path()}, nil
+	}
+	return nil, fmt.Errorf("identity credential '%s' not found", name)
+}
+
+// attach configures transport to present the identity as its client certificate
+func (i *clientIdentity) attach(transport *http.Transport) {
+	i.lock.Lock()
+	i.transport = transport
+	i.lock.Unlock()
+
+	transport.TLSClientConfig.GetClientCertificate = i.getClientCertificate
+
+	// the certificate may not have been issued yet
+	if err := i.load(); err != nil {
+		logger.Warn("identity_unavailable", "Unable to load identity certificate, connecting without a client certificate", logging.Fields{"credential": i.name, "error": err})
+	}
+}
+
+func (i *clientIdentity) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.cert == nil {
+		// no certificate is sent
+		return &tls.Certificate{}, nil
+	}
+	return i.cert, nil
+}
+
+// load reads the identity certificate and closes idle connections so that new
+// connections present it.
+func (i *clientIdentity) load() error {
+	cert, err := tls.LoadX509KeyPair(i.certFile, i.keyFile)
+	if err != nil {
+		return err
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.cert = &cert
+	if i.transport != nil {
+		i.transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// Renewed reloads the identity if the named credential is the identity
+// credential, returning true if the identity was reloaded.  Credentials with
+// their own vault client must then be told to pick up the new certificate.
+func (i *clientIdentity) Renewed(name string) bool {
+	if i == nil || name != i.name {
+		return false
+	}
+
+	if err := i.load(); err != nil {
+		logger.Error("identity_reload_failed", "Unable to reload identity certificate", logging.Fields{"credential": i.name, "error": err})
+		return false
+	}
+	logger.Info("identity_reloaded", "Reloaded identity certificate", logging.Fields{"credential": i.name})
+	return true
+}
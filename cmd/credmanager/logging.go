@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/credentials"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	"github.com/spf13/viper"
+)
+
+var logger = logging.Default()
+
+// setupLogging configures the daemon's logger from the log section of the
+// main configuration.  Output from libraries using the standard library logger
+// is passed through the same logger.
+func setupLogging() error {
+	level, err := logging.ParseLevel(viper.GetString("log.level"))
+	if err != nil {
+		return err
+	}
+
+	l, err := logging.New(os.Stderr, level, viper.GetString("log.format"))
+	if err != nil {
+		return err
+	}
+
+	logger = l
+	credentials.SetLogger(l)
+	log.SetFlags(0)
+	log.SetOutput(l.Writer("library_log"))
+	return nil
+}
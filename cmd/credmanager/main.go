@@ -1,20 +1,19 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"syscall"
 	"time"
 
 	"github.com/PolarGeospatialCenter/credmanager/pkg/credentials"
-	"github.com/PolarGeospatialCenter/vaulthelper/pkg/vaulthelper"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/metrics"
+	"github.com/fsnotify/fsnotify"
 	vault "github.com/hashicorp/vault/api"
 	"github.com/spf13/viper"
-	"gopkg.in/yaml.v2"
 )
 
 // Credential types manage a particular vault secret.  Manage should create/update
@@ -25,171 +24,278 @@ type Credential interface {
 	Initialize(*vault.Client) error
 	Stop()
 	Renewer() credentials.Renewer
+	// Validates the credential configuration without contacting vault
+	Validate() error
+	// Issues the credential a single time without starting a renewer
+	IssueOnce(vaultClient *vault.Client, maxAttempts uint, runAction bool) error
 	fmt.Stringer
 }
 
-// CredentialConfigFile describes the layout of a credential configuration file
-// found in the configuration directory.
-type CredentialConfigFile struct {
-	SSH      []*credentials.SSHHostCertificate `mapstructure:"ssh"`
-	Pki      []*credentials.PKICertificate     `mapstructure:"pki"`
-	Vault    []*credentials.SSHHostCertificate `mapstructure:"vault"`
-	Template []*credentials.CredentialTemplate `mapstructure:"template"`
+// readConfig reads the main configuration file, searching the default
+// locations if configFile is empty.
+func readConfig(configFile string) error {
+	viper.SetDefault("vault.address", "http://127.0.0.1:8200")
+	viper.SetDefault("control.socket", defaultControlSocket)
+	viper.SetDefault("control.mode", 0600)
+	viper.SetDefault("log.level", "info")
+	viper.SetDefault("log.format", logging.FormatText)
+	// match the vault cli's environment variables
+	viper.BindEnv("vault.ca_cert", vault.EnvVaultCACert)
+	viper.BindEnv("vault.ca_path", vault.EnvVaultCAPath)
+	viper.BindEnv("vault.tls_server_name", vault.EnvVaultTLSServerName)
+	if hostname, err := os.Hostname(); err == nil {
+		viper.SetDefault("hostname", hostname)
+	}
+
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath(".")
+		viper.AddConfigPath("/etc/credmanager")
+	}
+	return viper.ReadInConfig()
 }
 
-// loads all credential configs found in config dir and merges them into one list
-func loadCredentialConfigs(configDir string) ([]Credential, error) {
-	var creds []Credential
-	files, err := ioutil.ReadDir(configDir)
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [options]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  run       run the credential manager daemon (default)\n")
+	fmt.Fprintf(os.Stderr, "  once      issue every credential once and exit\n")
+	fmt.Fprintf(os.Stderr, "  status    show the status of credentials managed by the running daemon\n")
+	fmt.Fprintf(os.Stderr, "  renew     force the running daemon to renew credentials\n")
+	fmt.Fprintf(os.Stderr, "  validate  check the configuration for errors\n")
+	fmt.Fprintf(os.Stderr, "  decrypt   decrypt an encrypted credential file\n")
+}
+
+func main() {
+	command := "run"
+	args := []string{}
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+		args = os.Args[2:]
+	}
+
+	switch command {
+	case "run":
+		runDaemon(args)
+	case "once":
+		os.Exit(runOnce(args))
+	case "status":
+		os.Exit(status(args))
+	case "renew":
+		os.Exit(renew(args))
+	case "validate":
+		os.Exit(validate(args))
+	case "decrypt":
+		os.Exit(decrypt(args))
+	case "help", "-h", "-help", "--help":
+		usage()
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func runDaemon(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	configFile := flags.String("config", "", "path to the main configuration file")
+	flags.Parse(args)
+
+	err := readConfig(*configFile)
 	if err != nil {
-		return nil, err
+		logger.Fatal("config_error", "Unable to read config file", logging.Fields{"error": err})
 	}
-	for _, f := range files {
-		if f.IsDir() || (filepath.Ext(f.Name()) != ".yml" && filepath.Ext(f.Name()) != ".yaml") {
-			log.Printf("Ignoring: %s", f.Name())
-			continue
-		}
 
-		contents, readErr := ioutil.ReadFile(filepath.Join(configDir, f.Name()))
-		if readErr != nil {
-			return nil, readErr
-		}
+	err = setupLogging()
+	if err != nil {
+		logger.Fatal("config_error", "Invalid logging configuration", logging.Fields{"error": err})
+	}
 
-		config := &CredentialConfigFile{}
-		unmarshalErr := yaml.Unmarshal(contents, config)
-		if unmarshalErr != nil {
-			return nil, fmt.Errorf("%s -- %v", f.Name(), unmarshalErr)
-		}
+	credentialConfigDir := viper.GetString("credential_config_dir")
+	credList, err := loadCredentialConfigs(credentialConfigDir)
+	if err != nil {
+		logger.Fatal("config_error", "Unable to load credential configurations", logging.Fields{"error": err})
+	}
+	logger.Info("config_loaded", "Loaded credential configurations", logging.Fields{"credentials": len(credList)})
 
-		for _, item := range config.SSH {
-			creds = append(creds, item)
-		}
-		for _, item := range config.Pki {
-			creds = append(creds, item)
-		}
-		for _, item := range config.Vault {
-			creds = append(creds, item)
-		}
-		for _, item := range config.Template {
-			creds = append(creds, item)
-		}
+	identity, err := configuredIdentity(credList)
+	if err != nil {
+		logger.Fatal("config_error", "Invalid identity configuration", logging.Fields{"error": err})
 	}
-	return creds, nil
-}
 
-func main() {
-	viper.SetDefault("vault.address", "http://127.0.0.1:8200")
-	if hostname, err := os.Hostname(); err == nil {
-		viper.SetDefault("hostname", hostname)
+	vaultClient, err := newVaultClient(identity)
+	if err != nil {
+		logger.Fatal("vault_client_error", "Unable to create vault client", logging.Fields{"error": err})
 	}
 
-	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
-	viper.AddConfigPath("/etc/credmanager")
-	err := viper.ReadInConfig()
+	authMethod, err := configuredAuthMethod()
 	if err != nil {
-		log.Fatalf("Unable to read config file: %v", err)
+		logger.Fatal("config_error", "Invalid auth configuration", logging.Fields{"error": err})
 	}
 
-	credList, err := loadCredentialConfigs(viper.GetString("credential_config_dir"))
+	secret, err := authenticate(vaultClient, authMethod)
 	if err != nil {
-		log.Fatalf("Unable to load credential configurations: %v", err)
-	}
-	log.Printf("Loaded credential configurations: %v", credList)
-
-	vaultConfig := vault.DefaultConfig()
-	vaultConfig.Address = viper.GetString("vault.address")
-	vaultConfig.Timeout = time.Second * 2
-	vaultConfig.ConfigureTLS(&vault.TLSConfig{
-		ClientCert: viper.GetString("vault.client_cert"),
-		ClientKey:  viper.GetString("vault.client_key"),
-		Insecure:   false,
-	})
-	vaultClient, err := vault.NewClient(vaultConfig)
+		logger.Fatal("authentication_failed", "Unable to get a valid token, refusing to start", logging.Fields{"error": err})
+	}
+
+	tokenRenewer, err := startTokenRenewer(vaultClient, secret)
 	if err != nil {
-		log.Fatalf("Unable to create vault client %s\n", err)
+		logger.Fatal("token_renewer_error", "Error creating token renewer", logging.Fields{"error": err})
 	}
+	defer func() { tokenRenewer.Stop() }()
+	tokenRenewCh, tokenDoneCh := tokenRenewer.RenewCh(), tokenRenewer.DoneCh()
+	tokenExpiration := time.Now().Add(time.Duration(secret.Auth.LeaseDuration) * time.Second)
+	reauthenticated := make(chan *vault.Secret)
 
-	tokenTimer := credentials.NewRenewTimer(0, 3*time.Hour, 5*time.Second, 10)
+	manager := newCredentialManager(vaultClient, templateVaultConfig(identity))
+	manager.Update(credList)
+	defer manager.StopAll()
+	renewers := manager.Renewers()
 
-	var secret *vault.Secret
-	for attempt := 0; attempt < 7; attempt++ {
-		<-tokenTimer.C
-		token, err := vaulthelper.NewDefaultChainProvider(vaultClient).RetrieveToken()
+	reload := func() {
+		newCredList, err := loadCredentialConfigs(credentialConfigDir)
 		if err != nil {
-			log.Printf("Unable to retrieve token, retrying (attempt %d): %v", attempt, err)
-			tokenTimer.FailReset(3 * time.Hour)
-			continue
+			logger.Error("config_reload_failed", "Unable to reload credential configurations, keeping existing configuration", logging.Fields{"error": err})
+			return
 		}
+		manager.Update(newCredList)
+	}
 
-		vaultClient.SetToken(token)
+	metricsRegistry := metrics.NewRegistry(manager)
+	metricsRegistry.SetTokenTTL(time.Duration(secret.Auth.LeaseDuration) * time.Second)
+	if address := viper.GetString("metrics.listen"); address != "" {
+		startMetricsServer(address, metricsRegistry)
+	}
 
-		// Renew so that we have a populated Auth struct in the secret.
-		secret, err = vaultClient.Auth().Token().RenewSelf(0)
+	if socketPath := viper.GetString("control.socket"); socketPath != "" {
+		controlServer, err := startControlServer(socketPath, manager)
 		if err != nil {
-			log.Printf("Error renewing our own token, retrying (attempt %d): %v", attempt, err)
-			secret = nil
-			tokenTimer.FailReset(3 * time.Hour)
-			continue
+			logger.Error("control_server_error", "Unable to start control server, continuing without it", logging.Fields{"error": err})
+		} else {
+			defer controlServer.Close()
 		}
-		log.Printf("Renewed our vault token.")
-		break
 	}
-	tokenTimer.Stop()
 
-	if secret == nil {
-		log.Fatalf("Unable to get a valid token.  Refusing to start.")
-	}
+	var configChanged <-chan time.Time
+	var watchEvents <-chan fsnotify.Event
+	var watchErrors <-chan error
+	if viper.GetBool("watch_credential_config_dir") {
+		configWatcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			logger.Fatal("config_watch_error", "Unable to watch credential config dir", logging.Fields{"error": err})
+		}
+		defer configWatcher.Close()
 
-	gracePeriod := 24 * time.Hour
-	tokenRenewer, err := vaultClient.NewRenewer(&vault.RenewerInput{Secret: secret, Grace: gracePeriod})
-	if err != nil {
-		log.Fatalf("Error creating token renewer: %v", err)
+		err = configWatcher.Add(credentialConfigDir)
+		if err != nil {
+			logger.Fatal("config_watch_error", "Unable to watch credential config dir", logging.Fields{"error": err})
+		}
+		watchEvents = configWatcher.Events
+		watchErrors = configWatcher.Errors
 	}
 
-	go tokenRenewer.Renew()
-	defer tokenRenewer.Stop()
-	log.Printf("Started token renewer.")
-
-	renewers := &credentials.RenewerMerger{}
+	readyCredentials := viper.GetStringSlice("systemd.ready_credentials")
+	if len(readyCredentials) == 0 {
+		readyCredentials = manager.Configured()
+	}
+	notifier := newReadinessNotifier(manager, readyCredentials)
+	notifier.Update()
+	defer notifier.Stopping()
 
-	for _, credential := range credList {
-		credErr := credential.Initialize(vaultClient)
-		if credErr != nil {
-			log.Printf("Unable to initialize credential %s: %v", credential, credErr)
-		}
-		renewers.AddRenewer(credential.Renewer())
-		defer credential.Stop()
+	var watchdog <-chan time.Time
+	if interval := watchdogInterval(); interval > 0 {
+		watchdogTicker := time.NewTicker(interval)
+		defer watchdogTicker.Stop()
+		watchdog = watchdogTicker.C
 	}
 
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	for {
 		select {
 		case signal := <-signalChan:
 			switch signal {
 			case syscall.SIGTERM:
-				log.Printf("Got SIGTERM, exiting.")
+				logger.Info("shutdown", "Got SIGTERM, exiting", logging.Fields{"signal": signal})
 				return
 			case syscall.SIGINT:
-				log.Printf("Got SIGINT, exiting.")
+				logger.Info("shutdown", "Got SIGINT, exiting", logging.Fields{"signal": signal})
 				return
+			case syscall.SIGHUP:
+				logger.Info("config_reload", "Got SIGHUP, reloading credential configurations")
+				reload()
+				notifier.Update()
 			}
+		case event := <-watchEvents:
+			logger.Debug("config_changed", "Credential config dir changed", logging.Fields{"path": event.Name, "op": event.Op})
+			// wait for changes to settle before reloading
+			configChanged = time.After(2 * time.Second)
+		case err := <-watchErrors:
+			logger.Error("config_watch_error", "Error watching credential config dir", logging.Fields{"error": err})
+		case <-configChanged:
+			configChanged = nil
+			logger.Info("config_reload", "Credential config dir changed, reloading credential configurations")
+			reload()
+			notifier.Update()
 		case renewal := <-renewers.RenewCh():
-			log.Printf("Renewal: %s", renewal)
+			if renewal.ActionFailed {
+				// not a successful renewal, the failure is recorded from DoneCh
+				continue
+			}
+			name := manager.NameOf(renewal.Source)
+			metricsRegistry.RecordRenewal(name)
+			notifier.Renewed(name)
+			if identity.Renewed(name) {
+				manager.ClientCertificateChanged()
+			}
 		case err := <-renewers.DoneCh():
-			switch err.(type) {
+			switch e := err.(type) {
 			case credentials.ErrMaxRetriesExceeded:
-				log.Fatalf("Exiting: %v", err)
+				logger.Fatal("max_retries_exceeded", "Exiting", logging.Fields{"error": err})
+			case credentials.ErrRenewalFailed:
+				metricsRegistry.RecordFailure(manager.NameOf(e.Source))
+			case credentials.ErrActionFailed:
+				metricsRegistry.RecordActionFailure(manager.NameOf(e.Source))
 			default:
-				log.Printf("Got error: %v", err)
+				logger.Error("renewal_failed", "Got error", logging.Fields{"error": err})
+			}
+			notifier.Update()
+		case renewal := <-tokenRenewCh:
+			if renewal.Secret != nil && renewal.Secret.Auth != nil {
+				ttl := time.Duration(renewal.Secret.Auth.LeaseDuration) * time.Second
+				logger.Info("token_renewed", "Renewed credmanager vault token", logging.Fields{"ttl": ttl})
+				metricsRegistry.SetTokenTTL(ttl)
+				tokenExpiration = time.Now().Add(ttl)
+			}
+		case <-watchdog:
+			notifier.Watchdog()
+		case err := <-tokenDoneCh:
+			// The token can't be renewed any further, usually because it reached its
+			// max TTL.  Get a new one without disturbing the credential renewers.
+			delay := reauthenticateDelay(err, tokenExpiration)
+			logger.Warn("token_renewal_failed", "Unable to renew our own token, re-authenticating", logging.Fields{"error": err, "delay": delay})
+			tokenRenewer.Stop()
+			tokenRenewCh, tokenDoneCh = nil, nil
+			go func() {
+				time.Sleep(delay)
+				secret, err := authenticate(vaultClient, authMethod)
+				if err != nil {
+					logger.Fatal("authentication_failed", "Unable to get a new token, exiting", logging.Fields{"error": err})
+				}
+				reauthenticated <- secret
+			}()
+		case secret := <-reauthenticated:
+			tokenRenewer, err = startTokenRenewer(vaultClient, secret)
+			if err != nil {
+				logger.Fatal("token_renewer_error", "Error creating token renewer", logging.Fields{"error": err})
 			}
-		case renewal := <-tokenRenewer.RenewCh():
-			log.Printf("Renewed credmanager vault token: %v", renewal)
-		case err := <-tokenRenewer.DoneCh():
-			log.Printf("Error renewing credmanager vault token: %v", err)
-			log.Fatalf("Unable to renew our own token, exiting.")
+			tokenRenewCh, tokenDoneCh = tokenRenewer.RenewCh(), tokenRenewer.DoneCh()
+			metricsRegistry.SetTokenTTL(time.Duration(secret.Auth.LeaseDuration) * time.Second)
+			tokenExpiration = time.Now().Add(time.Duration(secret.Auth.LeaseDuration) * time.Second)
+			manager.TokenChanged()
+			logger.Info("reauthenticated", "Replaced credmanager vault token")
 		}
 	}
 }
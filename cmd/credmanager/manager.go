@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/control"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/credentials"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// credentialManager keeps track of the running credentials and applies changes
+// to the credential configuration without disturbing unchanged credentials.
+type credentialManager struct {
+	vaultClient *vault.Client
+	vaultConfig credentials.TemplateVaultConfig
+	renewers    *credentials.RenewerMerger
+	lock        sync.Mutex
+	running     map[string]*managedCredential
+	// names of every configured credential, including those that failed to start
+	configured []string
+}
+
+func newCredentialManager(vaultClient *vault.Client, vaultConfig credentials.TemplateVaultConfig) *credentialManager {
+	return &credentialManager{
+		vaultClient: vaultClient,
+		vaultConfig: vaultConfig,
+		renewers:    &credentials.RenewerMerger{},
+		running:     make(map[string]*managedCredential),
+	}
+}
+
+// Renewers returns the merged renewers of all running credentials
+func (m *credentialManager) Renewers() credentials.Renewer {
+	return m.renewers
+}
+
+// Update starts credentials that aren't running yet and stops running
+// credentials that are no longer part of credList.  Credentials whose
+// configuration changed are restarted.  Stopped credentials are revoked unless
+// a configured credential writes to the same output, such as a token entry
+// that was renamed or moved to another file.  New credentials are initialized
+// without holding the lock, Update must not be called concurrently.
+func (m *credentialManager) Update(credList []*managedCredential) {
+	desired := make(map[string]*managedCredential, len(credList))
+	names := make(map[string]bool, len(credList))
+	kept := make(map[string]bool)
+	for _, c := range credList {
+		names[c.Name] = true
+		if revocable, ok := c.Credential.(credentials.RevocableCredential); ok {
+			kept[revocable.RevocationKey()] = true
+		}
+		if existing, ok := desired[c.fingerprint]; ok {
+			logger.Warn("credential_duplicate", "Ignoring credential that duplicates another", logging.Fields{"credential": c.Name, "duplicates": existing.Name})
+			continue
+		}
+		desired[c.fingerprint] = c
+	}
+	configured := make([]string, 0, len(names))
+	for name := range names {
+		configured = append(configured, name)
+	}
+	sort.Strings(configured)
+
+	m.lock.Lock()
+	m.configured = configured
+	var stopped, pending []*managedCredential
+	for fingerprint, c := range m.running {
+		if _, ok := desired[fingerprint]; !ok {
+			logger.Info("credential_stopped", "Stopping credential", c.logFields())
+			m.stop(c)
+			stopped = append(stopped, c)
+		}
+	}
+	for fingerprint, c := range desired {
+		if existing, ok := m.running[fingerprint]; ok {
+			// configuration unchanged, keep the running credential but pick up its new name
+			existing.Name = c.Name
+			continue
+		}
+		pending = append(pending, c)
+	}
+	m.lock.Unlock()
+
+	// revoking and initializing may talk to vault, don't block status requests
+	// while they do
+	for _, c := range stopped {
+		if revocable, ok := c.Credential.(credentials.RevocableCredential); ok && !kept[revocable.RevocationKey()] {
+			m.revoke(c)
+		}
+	}
+
+	var started []*managedCredential
+	for _, c := range pending {
+		logger.Info("credential_started", "Starting credential", c.logFields())
+		if m.initialize(c) {
+			started = append(started, c)
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, c := range started {
+		m.renewers.AddRenewer(c.Credential.Renewer())
+		m.running[c.fingerprint] = c
+	}
+}
+
+// initialize starts renewing a credential, returning false if it couldn't be
+// initialized
+func (m *credentialManager) initialize(c *managedCredential) bool {
+	setVaultConfig(c.Credential, m.vaultConfig)
+	credErr := c.Credential.Initialize(m.vaultClient)
+	if credErr != nil {
+		logger.Error("credential_init_failed", "Unable to initialize credential", c.logFields(), logging.Fields{"error": credErr})
+		return false
+	}
+	return true
+}
+
+func (m *credentialManager) stop(c *managedCredential) {
+	m.renewers.RemoveRenewer(c.Credential.Renewer())
+	c.Credential.Stop()
+	delete(m.running, c.fingerprint)
+}
+
+// revoke revokes a stopped credential that was removed from the configuration
+func (m *credentialManager) revoke(c *managedCredential) {
+	revocable, ok := c.Credential.(credentials.RevocableCredential)
+	if !ok {
+		return
+	}
+	if err := revocable.Revoke(); err != nil {
+		logger.Error("revoke_failed", "Unable to revoke credential", c.logFields(), logging.Fields{"error": err})
+	}
+}
+
+// TokenChanged notifies running credentials that keep their own copy of the
+// vault token that the client's token has been replaced.
+func (m *credentialManager) TokenChanged() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, c := range m.running {
+		consumer, ok := c.Credential.(credentials.TokenConsumer)
+		if !ok {
+			continue
+		}
+		if err := consumer.TokenChanged(); err != nil {
+			logger.Error("token_update_failed", "Unable to update credential with new token", c.logFields(), logging.Fields{"error": err})
+		}
+	}
+}
+
+// ClientCertificateChanged notifies running credentials that connect to vault
+// with their own client that the client certificate has been renewed.
+func (m *credentialManager) ClientCertificateChanged() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, c := range m.running {
+		consumer, ok := c.Credential.(credentials.VaultConfigConsumer)
+		if !ok {
+			continue
+		}
+		if err := consumer.ClientCertificateChanged(); err != nil {
+			logger.Error("client_certificate_update_failed", "Unable to update credential with new client certificate", c.logFields(), logging.Fields{"error": err})
+		}
+	}
+}
+
+// StopAll stops every running credential
+func (m *credentialManager) StopAll() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, c := range m.running {
+		m.stop(c)
+	}
+}
+
+// Configured returns the sorted names of every configured credential, whether
+// or not it's running
+func (m *credentialManager) Configured() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]string(nil), m.configured...)
+}
+
+// Status returns the status of every running credential, sorted by name
+func (m *credentialManager) Status() []control.CredentialStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	result := make([]control.CredentialStatus, 0, len(m.running))
+	for _, c := range m.running {
+		status := control.CredentialStatus{Name: c.Name, Description: c.Credential.String()}
+		if renewer, ok := c.Credential.Renewer().(credentials.StatusRenewer); ok {
+			status.RenewerStatus = renewer.Status()
+		}
+		_, status.Controllable = c.Credential.Renewer().(credentials.ControllableRenewer)
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// NameOf returns the name of the running credential source, or its description
+// if it isn't a running credential
+func (m *credentialManager) NameOf(source fmt.Stringer) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, c := range m.running {
+		if fmt.Stringer(c.Credential) == source {
+			return c.Name
+		}
+	}
+	return source.String()
+}
+
+// Renewer returns the renewer of the named credential, nil if the credential
+// is running but can't be controlled
+func (m *credentialManager) Renewer(name string) (credentials.ControllableRenewer, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, c := range m.running {
+		if c.Name == name {
+			renewer, _ := c.Credential.Renewer().(credentials.ControllableRenewer)
+			return renewer, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/metrics"
+)
+
+// startMetricsServer serves the registry's metrics on address at /metrics
+func startMetricsServer(address string, registry *metrics.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		logger.Error("metrics_server_error", "Metrics server exited", logging.Fields{"error": err})
+	}()
+	logger.Info("metrics_server_started", "Serving metrics", logging.Fields{"address": address})
+}
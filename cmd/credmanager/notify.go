@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/control"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	"github.com/coreos/go-systemd/daemon"
+)
+
+// readinessNotifier reports the daemon's state to systemd when running as a
+// Type=notify service.  READY=1 is sent once every required credential has
+// been renewed at least once.  All notifications are no-ops when systemd isn't
+// listening.
+type readinessNotifier struct {
+	manager control.Manager
+	// required credentials that haven't completed their first renewal yet
+	pending map[string]bool
+	ready   bool
+}
+
+// newReadinessNotifier creates a notifier waiting on the named credentials.
+// Required credentials that aren't running, for example because they failed to
+// initialize, stay pending until a configuration reload starts them.
+func newReadinessNotifier(manager control.Manager, names []string) *readinessNotifier {
+	n := &readinessNotifier{manager: manager, pending: make(map[string]bool)}
+
+	running := make(map[string]control.CredentialStatus)
+	for _, status := range manager.Status() {
+		running[status.Name] = status
+	}
+
+	for _, name := range names {
+		status, ok := running[name]
+		if !ok {
+			logger.Error("readiness_credential_not_running", "Credential required for readiness isn't running, readiness will not be reported until it is issued", logging.Fields{"credential": name})
+			n.pending[name] = true
+			continue
+		}
+		if status.LastRenewal.IsZero() {
+			n.pending[name] = true
+		}
+	}
+	return n
+}
+
+// Renewed records the first renewal of the named credential, notifying systemd
+// if it was the last credential we were waiting on.
+func (n *readinessNotifier) Renewed(name string) {
+	delete(n.pending, name)
+	n.Update()
+}
+
+// Update sends a status summary to systemd, along with READY=1 the first time
+// no required credentials are pending.
+func (n *readinessNotifier) Update() {
+	state := fmt.Sprintf("STATUS=%s", n.summary())
+	if !n.ready && len(n.pending) == 0 {
+		n.ready = true
+		state = "READY=1\n" + state
+		logger.Info("ready", "All required credentials issued")
+	}
+	n.notify(state)
+}
+
+func (n *readinessNotifier) summary() string {
+	if !n.ready && len(n.pending) > 0 {
+		return fmt.Sprintf("Waiting for %d credentials to be issued", len(n.pending))
+	}
+
+	statuses := n.manager.Status()
+	failing := 0
+	for _, status := range statuses {
+		if status.FailureCount > 0 {
+			failing++
+		}
+	}
+	if failing > 0 {
+		return fmt.Sprintf("Managing %d credentials, %d failing", len(statuses), failing)
+	}
+	return fmt.Sprintf("Managing %d credentials", len(statuses))
+}
+
+// Watchdog pings the systemd watchdog
+func (n *readinessNotifier) Watchdog() {
+	n.notify("WATCHDOG=1")
+}
+
+// Stopping tells systemd that the daemon is shutting down
+func (n *readinessNotifier) Stopping() {
+	n.notify("STOPPING=1")
+}
+
+func (n *readinessNotifier) notify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		logger.Warn("notify_failed", "Unable to notify systemd", logging.Fields{"error": err})
+	}
+}
+
+// watchdogInterval returns how often the systemd watchdog should be pinged, or
+// 0 if the watchdog isn't enabled for this process.
+func watchdogInterval() time.Duration {
+	timeout, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		logger.Warn("watchdog_error", "Unable to determine watchdog interval, watchdog disabled", logging.Fields{"error": err})
+		return 0
+	}
+	return timeout / 2
+}
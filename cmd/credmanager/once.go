@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// runOnce issues every configured credential a single time and reports the
+// result for each.  Returns the exit code for the command.
+func runOnce(args []string) int {
+	flags := flag.NewFlagSet("once", flag.ExitOnError)
+	configFile := flags.String("config", "", "path to the main configuration file")
+	maxAttempts := flags.Uint("attempts", 5, "maximum number of attempts to issue each credential")
+	runActions := flags.Bool("run-actions", false, "run post renew actions and health checks after issuing")
+	flags.Parse(args)
+
+	err := readConfig(*configFile)
+	if err != nil {
+		log.Printf("Unable to read config file: %v", err)
+		return 1
+	}
+
+	credList, err := loadCredentialConfigs(viper.GetString("credential_config_dir"))
+	if err != nil {
+		log.Printf("Unable to load credential configurations: %v", err)
+		return 1
+	}
+
+	identity, err := configuredIdentity(credList)
+	if err != nil {
+		log.Printf("Invalid identity configuration: %v", err)
+		return 1
+	}
+
+	vaultClient, err := newVaultClient(identity)
+	if err != nil {
+		log.Printf("Unable to create vault client: %v", err)
+		return 1
+	}
+
+	authMethod, err := configuredAuthMethod()
+	if err != nil {
+		log.Printf("Invalid auth configuration: %v", err)
+		return 1
+	}
+
+	_, err = authenticate(vaultClient, authMethod)
+	if err != nil {
+		log.Printf("Unable to get a valid token: %v", err)
+		return 1
+	}
+
+	vaultConfig := templateVaultConfig(identity)
+	results := make([]error, len(credList))
+	var wg sync.WaitGroup
+	wg.Add(len(credList))
+	for i, c := range credList {
+		go func(i int, c *managedCredential) {
+			defer wg.Done()
+			setVaultConfig(c.Credential, vaultConfig)
+			results[i] = c.Credential.IssueOnce(vaultClient, *maxAttempts, *runActions)
+		}(i, c)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, c := range credList {
+		if results[i] != nil {
+			failed++
+			fmt.Printf("FAILED  %s: %v\n", c.Name, results[i])
+			continue
+		}
+		fmt.Printf("OK      %s\n", c.Name)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d credentials failed\n", failed, len(credList))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/control"
+	"github.com/spf13/viper"
+)
+
+// controlClientFlags adds the flags shared by commands that talk to a running
+// daemon
+func controlClientFlags(flags *flag.FlagSet) (socketPath *string, configFile *string, jsonOutput *bool) {
+	socketPath = flags.String("socket", "", "path to the control socket (default from config)")
+	configFile = flags.String("config", "", "path to the main configuration file")
+	jsonOutput = flags.Bool("json", false, "print output as json")
+	return
+}
+
+// newControlClient connects to the control socket, falling back to the socket
+// configured in the main configuration file.
+func newControlClient(socketPath, configFile string) *control.Client {
+	if socketPath == "" {
+		// a missing config file just means the default socket is used
+		readConfig(configFile)
+		socketPath = viper.GetString("control.socket")
+	}
+	return control.NewClient(socketPath)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func printStatusTable(statuses []control.CredentialStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tEXPIRES\tLAST RENEWAL\tNEXT RENEWAL\tFAILURES\tPAUSED\tLAST ERROR")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%t\t%s\n", s.Name, formatTime(s.Expiration), formatTime(s.LastRenewal), formatTime(s.NextRenewal), s.FailureCount, s.Paused, s.LastError)
+	}
+	w.Flush()
+}
+
+// status prints the status of every credential managed by the running daemon
+func status(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	socketPath, configFile, jsonOutput := controlClientFlags(flags)
+	flags.Parse(args)
+
+	statuses, err := newControlClient(*socketPath, *configFile).List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to get credential status: %v\n", err)
+		return 1
+	}
+
+	if *jsonOutput {
+		printJSON(statuses)
+		return 0
+	}
+	printStatusTable(statuses)
+	return 0
+}
+
+// renew forces the running daemon to renew the named credentials
+func renew(args []string) int {
+	flags := flag.NewFlagSet("renew", flag.ExitOnError)
+	socketPath, configFile, jsonOutput := controlClientFlags(flags)
+	all := flags.Bool("all", false, "renew all credentials")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s renew [options] <name|--all> [name...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	client := newControlClient(*socketPath, *configFile)
+	names := flags.Args()
+	if *all {
+		statuses, err := client.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to list credentials: %v\n", err)
+			return 1
+		}
+		names = names[:0]
+		for _, s := range statuses {
+			if !s.Controllable {
+				// templates are rendered whenever their dependencies change
+				fmt.Fprintf(os.Stderr, "Skipped %s, renewal can't be forced\n", s.Name)
+				continue
+			}
+			names = append(names, s.Name)
+		}
+	}
+
+	if len(names) == 0 && !*all {
+		flags.Usage()
+		return 2
+	}
+
+	exitCode := 0
+	var results []*control.CredentialStatus
+	for _, name := range names {
+		result, err := client.Renew(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to renew %s: %v\n", name, err)
+			exitCode = 1
+			continue
+		}
+		results = append(results, result)
+		if !*jsonOutput {
+			fmt.Printf("Renewal triggered for %s\n", name)
+		}
+	}
+
+	if *jsonOutput {
+		printJSON(results)
+	}
+	return exitCode
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/auth"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// mainConfig lists the keys accepted in the main configuration file.  It is
+// only used to detect unknown keys, values are read through viper.
+type mainConfig struct {
+	Hostname string       `yaml:"hostname"`
+	Auth     *auth.Config `yaml:"auth"`
+	Vault    struct {
+		Address    string `yaml:"address"`
+		ClientCert string `yaml:"client_cert"`
+		ClientKey  string `yaml:"client_key"`
+		CACert     string `yaml:"ca_cert"`
+		CAPath     string `yaml:"ca_path"`
+		// server name used for SNI and certificate verification
+		TLSServerName string `yaml:"tls_server_name"`
+		Namespace     string `yaml:"namespace"`
+		// name of a pki credential used as our client certificate
+		IdentityCredential string `yaml:"identity_credential"`
+	} `yaml:"vault"`
+	CredentialConfigDir      string `yaml:"credential_config_dir"`
+	WatchCredentialConfigDir bool   `yaml:"watch_credential_config_dir"`
+	Metrics                  struct {
+		Listen string `yaml:"listen"`
+	} `yaml:"metrics"`
+	Control struct {
+		Socket string      `yaml:"socket"`
+		Mode   os.FileMode `yaml:"mode"`
+		Group  string      `yaml:"group"`
+	} `yaml:"control"`
+	Log struct {
+		Level  string `yaml:"level"`
+		Format string `yaml:"format"`
+	} `yaml:"log"`
+	Systemd struct {
+		ReadyCredentials []string `yaml:"ready_credentials"`
+	} `yaml:"systemd"`
+}
+
+// validateMainConfig strictly parses the main configuration file if it is yaml
+func validateMainConfig(path string) error {
+	if filepath.Ext(path) != ".yml" && filepath.Ext(path) != ".yaml" {
+		return nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	err = yaml.UnmarshalStrict(contents, &mainConfig{})
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// validateLogConfig checks the log level and format
+func validateLogConfig() error {
+	var result *multierror.Error
+	if _, err := logging.ParseLevel(viper.GetString("log.level")); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if _, err := logging.New(ioutil.Discard, logging.LevelInfo, viper.GetString("log.format")); err != nil {
+		result = multierror.Append(result, err)
+	}
+	return result.ErrorOrNil()
+}
+
+// validateAuthConfig checks the auth method configuration, if there is one
+func validateAuthConfig() error {
+	method, err := configuredAuthMethod()
+	if err != nil || method == nil {
+		return err
+	}
+	return multierror.Prefix(method.Validate(), "auth:")
+}
+
+// validateCredentialConfigFile strictly parses a credential configuration file
+// and validates every credential defined in it.
+func validateCredentialConfigFile(path string, names map[string]string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	var result *multierror.Error
+	config := &CredentialConfigFile{}
+	err = yaml.UnmarshalStrict(contents, config)
+	if _, ok := err.(*yaml.TypeError); ok {
+		// unknown or mistyped fields, the rest of the file was still decoded
+		result = multierror.Append(result, fmt.Errorf("%s: %v", path, err))
+	} else if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	lines := credentialLines(contents)
+	config.each(func(credType string, index int, namePtr *string, cred Credential) error {
+		name := *namePtr
+		prefix := fmt.Sprintf("%s: %s[%d]:", path, credType, index)
+		if line, ok := lines[fmt.Sprintf("%s[%d]", credType, index)]; ok {
+			prefix = fmt.Sprintf("%s:%d: %s[%d]:", path, line, credType, index)
+		}
+		result = multierror.Append(result, multierror.Prefix(cred.Validate(), prefix))
+		if name == "" {
+			name = defaultCredentialName(filepath.Base(path), credType, index)
+		} else {
+			result = multierror.Append(result, multierror.Prefix(validateCredentialName(name), prefix))
+		}
+
+		if otherPath, ok := names[name]; ok {
+			result = multierror.Append(result, fmt.Errorf("%s duplicate credential name '%s', already defined in %s", prefix, name, otherPath))
+		}
+		names[name] = path
+		return nil
+	})
+	return result.ErrorOrNil()
+}
+
+// credentialLines returns the line each credential starts on in a credential
+// configuration file, keyed by type and index such as pki[0].  Lines can't be
+// recovered from the decoded configuration, so the file is parsed again.
+func credentialLines(contents []byte) map[string]int {
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(contents, &doc); err != nil || len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml3.MappingNode {
+		return nil
+	}
+
+	lines := map[string]int{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if value.Kind != yaml3.SequenceNode {
+			continue
+		}
+		for j, item := range value.Content {
+			lines[fmt.Sprintf("%s[%d]", key.Value, j)] = item.Line
+		}
+	}
+	return lines
+}
+
+// validateCredentialConfigDir validates every credential configuration file in
+// configDir, recording the name of every credential found in names.
+func validateCredentialConfigDir(configDir string, names map[string]string) error {
+	if configDir == "" {
+		return fmt.Errorf("credential_config_dir is required")
+	}
+
+	files, err := ioutil.ReadDir(configDir)
+	if err != nil {
+		return err
+	}
+
+	var result *multierror.Error
+	for _, f := range files {
+		if !isCredentialConfigFile(f) {
+			continue
+		}
+		result = multierror.Append(result, validateCredentialConfigFile(filepath.Join(configDir, f.Name()), names))
+	}
+	return result.ErrorOrNil()
+}
+
+// validate checks the main configuration and all credential configurations,
+// printing any errors found.  Returns the exit code for the command.
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := flags.String("config", "", "path to the main configuration file")
+	flags.Parse(args)
+
+	err := readConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read config file: %v\n", err)
+		return 1
+	}
+
+	var result *multierror.Error
+	names := make(map[string]string)
+	result = multierror.Append(result,
+		validateMainConfig(viper.ConfigFileUsed()),
+		validateLogConfig(),
+		validateAuthConfig(),
+		validateCredentialConfigDir(viper.GetString("credential_config_dir"), names),
+	)
+
+	if name := viper.GetString("vault.identity_credential"); name != "" {
+		if _, ok := names[name]; !ok {
+			result = multierror.Append(result, fmt.Errorf("vault.identity_credential: unknown credential '%s'", name))
+		}
+	}
+
+	for _, name := range viper.GetStringSlice("systemd.ready_credentials") {
+		if _, ok := names[name]; !ok {
+			result = multierror.Append(result, fmt.Errorf("systemd.ready_credentials: unknown credential '%s'", name))
+		}
+	}
+
+	if result.ErrorOrNil() != nil {
+		for _, e := range result.Errors {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		fmt.Fprintf(os.Stderr, "%d errors found\n", len(result.Errors))
+		return 1
+	}
+
+	fmt.Println("Configuration OK")
+	return 0
+}
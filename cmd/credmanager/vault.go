@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/auth"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/credentials"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	"github.com/PolarGeospatialCenter/vaulthelper/pkg/vaulthelper"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// vaultTLSConfig returns the TLS settings for connecting to vault from the main
+// configuration.  If identity isn't nil its certificate files are used as the
+// client certificate instead of vault.client_cert and vault.client_key.
+func vaultTLSConfig(identity *clientIdentity) *vault.TLSConfig {
+	tlsConfig := &vault.TLSConfig{
+		CACert:        viper.GetString("vault.ca_cert"),
+		CAPath:        viper.GetString("vault.ca_path"),
+		TLSServerName: viper.GetString("vault.tls_server_name"),
+		ClientCert:    viper.GetString("vault.client_cert"),
+		ClientKey:     viper.GetString("vault.client_key"),
+	}
+	if identity != nil {
+		tlsConfig.ClientCert = identity.certFile
+		tlsConfig.ClientKey = identity.keyFile
+	}
+	return tlsConfig
+}
+
+// vaultTimeout is the timeout for requests to vault
+const vaultTimeout = 2 * time.Second
+
+// newVaultClient creates a vault client from the main configuration.  If
+// identity isn't nil it is used as the client certificate instead of
+// vault.client_cert and vault.client_key.
+func newVaultClient(identity *clientIdentity) (*vault.Client, error) {
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = viper.GetString("vault.address")
+	vaultConfig.Timeout = vaultTimeout
+
+	tlsConfig := vaultTLSConfig(identity)
+	if identity != nil {
+		// the identity certificate is loaded by the transport as it's renewed
+		clientTLS := *tlsConfig
+		clientTLS.ClientCert, clientTLS.ClientKey = "", ""
+		if err := vaultConfig.ConfigureTLS(&clientTLS); err != nil {
+			return nil, err
+		}
+		identity.attach(vaultConfig.HttpClient.Transport.(*http.Transport))
+	} else if err := vaultConfig.ConfigureTLS(tlsConfig); err != nil {
+		return nil, err
+	}
+
+	vaultClient, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if namespace := viper.GetString("vault.namespace"); namespace != "" {
+		vaultClient.SetNamespace(namespace)
+	}
+	return vaultClient, nil
+}
+
+// templateVaultConfig returns the settings for credentials that connect to
+// vault with their own client, matching the client created by newVaultClient.
+func templateVaultConfig(identity *clientIdentity) credentials.TemplateVaultConfig {
+	return credentials.TemplateVaultConfig{TLS: *vaultTLSConfig(identity), Timeout: vaultTimeout}
+}
+
+// setVaultConfig passes config to the credential if it runs its own vault
+// client, such as templates rendered by consul-template
+func setVaultConfig(credential Credential, config credentials.TemplateVaultConfig) {
+	if consumer, ok := credential.(credentials.VaultConfigConsumer); ok {
+		consumer.SetVaultConfig(config)
+	}
+}
+
+// startTokenRenewer starts renewing the token secret returned by authenticate
+func startTokenRenewer(vaultClient *vault.Client, secret *vault.Secret) (*vault.Renewer, error) {
+	gracePeriod := 24 * time.Hour
+	tokenRenewer, err := vaultClient.NewRenewer(&vault.RenewerInput{Secret: secret, Grace: gracePeriod})
+	if err != nil {
+		return nil, err
+	}
+
+	go tokenRenewer.Renew()
+	logger.Info("token_renewer_started", "Started token renewer")
+	return tokenRenewer, nil
+}
+
+// configuredAuthMethod returns the auth method configured in the auth section
+// of the main configuration, or nil if the default token chain should be used.
+func configuredAuthMethod() (auth.Method, error) {
+	if !viper.IsSet("auth") {
+		return nil, nil
+	}
+
+	config := &auth.Config{}
+	if err := unmarshalSetting("auth", config); err != nil {
+		return nil, err
+	}
+	return config.AuthMethod()
+}
+
+// unmarshalSetting decodes the configuration section under key into v using
+// its yaml field tags, matching the way credential configurations are decoded.
+func unmarshalSetting(key string, v interface{}) error {
+	serialized, err := yaml.Marshal(viper.Get(key))
+	if err != nil {
+		return fmt.Errorf("invalid %s configuration: %v", key, err)
+	}
+	if err := yaml.UnmarshalStrict(serialized, v); err != nil {
+		return fmt.Errorf("invalid %s configuration: %v", key, err)
+	}
+	return nil
+}
+
+// login gets a token using method, or the default token chain if method is
+// nil, and sets it on the vault client.
+func login(vaultClient *vault.Client, method auth.Method) (*vault.Secret, error) {
+	if method != nil {
+		secret, err := method.Login(vaultClient)
+		if err != nil {
+			return nil, err
+		}
+		vaultClient.SetToken(secret.Auth.ClientToken)
+		return secret, nil
+	}
+
+	token, err := vaulthelper.NewDefaultChainProvider(vaultClient).RetrieveToken()
+	if err != nil {
+		return nil, err
+	}
+	vaultClient.SetToken(token)
+
+	// Renew so that we have a populated Auth struct in the secret.
+	return vaultClient.Auth().Token().RenewSelf(0)
+}
+
+// authenticate logs in to vault using method, retrying with backoff, and
+// returns the secret for the new token.
+func authenticate(vaultClient *vault.Client, method auth.Method) (*vault.Secret, error) {
+	tokenTimer := credentials.NewRenewTimer(0, 3*time.Hour, 5*time.Second, 10)
+	defer tokenTimer.Stop()
+
+	for attempt := 0; attempt < 7; attempt++ {
+		<-tokenTimer.C
+		secret, err := login(vaultClient, method)
+		if err != nil {
+			logger.Warn("authentication_failed", "Unable to retrieve token, retrying", logging.Fields{"attempt": attempt, "error": err})
+			tokenTimer.FailReset(3 * time.Hour)
+			continue
+		}
+		logger.Info("authenticated", "Retrieved vault token", logging.Fields{"ttl": time.Duration(secret.Auth.LeaseDuration) * time.Second})
+		return secret, nil
+	}
+
+	return nil, fmt.Errorf("unable to get a valid token")
+}
+
+// reauthenticateDelay returns how long to wait before replacing a token that
+// can't be renewed any further.  Tokens that are still valid are used for most
+// of their remaining lifetime, tokens that failed to renew are replaced
+// immediately.
+func reauthenticateDelay(renewErr error, expiration time.Time) time.Duration {
+	if renewErr != nil && renewErr != vault.ErrRenewerNotRenewable {
+		return 0
+	}
+
+	delay := time.Until(expiration) * 2 / 3
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
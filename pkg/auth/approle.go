@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	multierror "github.com/hashicorp/go-multierror"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// AppRole logs in using an AppRole role_id and secret_id.  The secret_id is
+// read from SecretIDFile, or unwrapped from the response wrapping token in
+// SecretIDWrappingTokenFile.  Once read, the secret_id is kept in memory so
+// that it can be used to log in again after the file is removed or the
+// wrapping token is used up.
+type AppRole struct {
+	Mount                     string `yaml:"mount"`
+	RoleIDFile                string `yaml:"role_id_file"`
+	SecretIDFile              string `yaml:"secret_id_file"`
+	SecretIDWrappingTokenFile string `yaml:"secret_id_wrapping_token_file"`
+	// RemoveSecretIDFile removes the secret_id or wrapping token file after
+	// the first successful login
+	RemoveSecretIDFile bool `yaml:"remove_secret_id_file"`
+
+	lock     sync.Mutex
+	secretID string
+	// set when the secret_id file has been read but not yet removed
+	removePending bool
+}
+
+func (a *AppRole) mount() string {
+	if a.Mount == "" {
+		return "approle"
+	}
+	return a.Mount
+}
+
+// Validate checks that a role_id file and exactly one secret_id source are set
+func (a *AppRole) Validate() error {
+	var result *multierror.Error
+	result = multierror.Append(result, requireString("role_id_file", a.RoleIDFile))
+	if (a.SecretIDFile == "") == (a.SecretIDWrappingTokenFile == "") {
+		result = multierror.Append(result, fmt.Errorf("exactly one of secret_id_file or secret_id_wrapping_token_file is required"))
+	}
+	return result.ErrorOrNil()
+}
+
+// Login logs in to the AppRole auth method
+func (a *AppRole) Login(vaultClient *vault.Client) (*vault.Secret, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	roleID, err := readFile(a.RoleIDFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read role_id: %v", err)
+	}
+
+	if a.secretID == "" {
+		a.secretID, err = a.readSecretID(vaultClient)
+		if err != nil {
+			return nil, err
+		}
+		a.removePending = a.RemoveSecretIDFile
+	}
+
+	secret, err := login(vaultClient, a.mount(), map[string]interface{}{
+		"role_id":   roleID,
+		"secret_id": a.secretID,
+	})
+	if err != nil {
+		if a.SecretIDFile != "" {
+			// the file may be replaced with a valid secret_id, read it again next time
+			a.secretID = ""
+		}
+		return nil, err
+	}
+
+	if a.removePending {
+		if err := os.Remove(a.secretIDPath()); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("logged in but unable to remove %s: %v", a.secretIDPath(), err)
+		}
+		a.removePending = false
+	}
+	return secret, nil
+}
+
+func (a *AppRole) secretIDPath() string {
+	if a.SecretIDFile != "" {
+		return a.SecretIDFile
+	}
+	return a.SecretIDWrappingTokenFile
+}
+
+// readSecretID reads the secret_id from its file, unwrapping it if necessary
+func (a *AppRole) readSecretID(vaultClient *vault.Client) (string, error) {
+	if a.SecretIDFile != "" {
+		secretID, err := readFile(a.SecretIDFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret_id: %v", err)
+		}
+		return secretID, nil
+	}
+
+	wrappingToken, err := readFile(a.SecretIDWrappingTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read secret_id wrapping token: %v", err)
+	}
+
+	client, err := unauthenticatedClient(vaultClient)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := client.Logical().Unwrap(wrappingToken)
+	if err != nil {
+		return "", fmt.Errorf("unable to unwrap secret_id: %v", err)
+	}
+	if secret == nil {
+		return "", fmt.Errorf("unable to unwrap secret_id: no data returned")
+	}
+
+	secretID, ok := secret.Data["secret_id"].(string)
+	if !ok || secretID == "" {
+		return "", fmt.Errorf("unable to unwrap secret_id: wrapped response doesn't contain a secret_id")
+	}
+	return secretID, nil
+}
@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// fakeAppRoleServer emulates the AppRole login and response unwrapping
+// endpoints of a vault server.
+func fakeAppRoleServer(t *testing.T, roleID, secretID, wrappingToken string) *httptest.Server {
+	unwrapped := false
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/wrapping/unwrap":
+			if r.Header.Get("X-Vault-Token") != wrappingToken || unwrapped {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors": ["wrapping token is not valid or does not exist"]}`))
+				return
+			}
+			unwrapped = true
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"secret_id": secretID}})
+		case "/v1/auth/approle/login":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			if r.Header.Get("X-Vault-Token") != "" {
+				t.Errorf("Login request sent with token")
+			}
+			if body["role_id"] != roleID || body["secret_id"] != secretID {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors": ["invalid secret id"]}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{"client_token": "approle-token", "lease_duration": 3600}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func testClient(t *testing.T, address string) *vault.Client {
+	config := vault.DefaultConfig()
+	config.Address = address
+	client, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	client.SetToken("expired-token")
+	return client
+}
+
+func writeTestFile(t *testing.T, path, contents string) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Unable to write %s: %v", path, err)
+	}
+}
+
+func TestAppRoleLoginSecretIDFile(t *testing.T) {
+	server := fakeAppRoleServer(t, "role", "secret", "")
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "approletest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	approle := &AppRole{
+		RoleIDFile:         filepath.Join(tempDir, "role_id"),
+		SecretIDFile:       filepath.Join(tempDir, "secret_id"),
+		RemoveSecretIDFile: true,
+	}
+	writeTestFile(t, approle.RoleIDFile, "role\n")
+	writeTestFile(t, approle.SecretIDFile, "secret\n")
+
+	client := testClient(t, server.URL)
+	secret, err := approle.Login(client)
+	if err != nil {
+		t.Fatalf("Unable to login: %v", err)
+	}
+	if secret.Auth.ClientToken != "approle-token" {
+		t.Errorf("Unexpected token returned: %s", secret.Auth.ClientToken)
+	}
+
+	if _, err := os.Stat(approle.SecretIDFile); !os.IsNotExist(err) {
+		t.Errorf("secret_id file wasn't removed after login: %v", err)
+	}
+
+	// the secret_id is remembered so we can log in again
+	_, err = approle.Login(client)
+	if err != nil {
+		t.Errorf("Unable to login again after secret_id file was removed: %v", err)
+	}
+}
+
+func TestAppRoleLoginWrappedSecretID(t *testing.T) {
+	server := fakeAppRoleServer(t, "role", "secret", "wrapping-token")
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "approletest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	approle := &AppRole{
+		RoleIDFile:                filepath.Join(tempDir, "role_id"),
+		SecretIDWrappingTokenFile: filepath.Join(tempDir, "wrapped_secret_id"),
+	}
+	writeTestFile(t, approle.RoleIDFile, "role")
+	writeTestFile(t, approle.SecretIDWrappingTokenFile, "wrapping-token")
+
+	client := testClient(t, server.URL)
+	for attempt := 0; attempt < 2; attempt++ {
+		secret, err := approle.Login(client)
+		if err != nil {
+			t.Fatalf("Unable to login (attempt %d): %v", attempt, err)
+		}
+		if secret.Auth.ClientToken != "approle-token" {
+			t.Errorf("Unexpected token returned: %s", secret.Auth.ClientToken)
+		}
+	}
+
+	if _, err := os.Stat(approle.SecretIDWrappingTokenFile); err != nil {
+		t.Errorf("Wrapping token file should be kept: %v", err)
+	}
+
+	if client.Token() != "expired-token" {
+		t.Errorf("Login modified the token of the vault client")
+	}
+}
+
+func TestAppRoleLoginInvalidSecretID(t *testing.T) {
+	server := fakeAppRoleServer(t, "role", "secret", "")
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "approletest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	approle := &AppRole{
+		RoleIDFile:         filepath.Join(tempDir, "role_id"),
+		SecretIDFile:       filepath.Join(tempDir, "secret_id"),
+		RemoveSecretIDFile: true,
+	}
+	writeTestFile(t, approle.RoleIDFile, "role")
+	writeTestFile(t, approle.SecretIDFile, "wrong")
+
+	client := testClient(t, server.URL)
+	if _, err := approle.Login(client); err == nil {
+		t.Fatalf("Expected error logging in with invalid secret_id")
+	}
+
+	if _, err := os.Stat(approle.SecretIDFile); err != nil {
+		t.Errorf("secret_id file removed after failed login: %v", err)
+	}
+
+	// a corrected secret_id file is picked up on the next attempt
+	writeTestFile(t, approle.SecretIDFile, "secret")
+	if _, err := approle.Login(client); err != nil {
+		t.Errorf("Unable to login with corrected secret_id: %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cases := map[string]*Config{
+		"unknown method":  {Method: "foo"},
+		"missing approle": {Method: "approle"},
+		"no secret_id":    {Method: "approle", AppRole: &AppRole{RoleIDFile: "role_id"}},
+		"both secret_id":  {Method: "approle", AppRole: &AppRole{RoleIDFile: "role_id", SecretIDFile: "a", SecretIDWrappingTokenFile: "b"}},
+		"missing role_id": {Method: "approle", AppRole: &AppRole{SecretIDFile: "a"}},
+	}
+	for name, config := range cases {
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+
+	valid := &Config{Method: "approle", AppRole: &AppRole{RoleIDFile: "role_id", SecretIDFile: "secret_id"}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Unexpected error validating valid config: %v", err)
+	}
+}
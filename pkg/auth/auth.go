@@ -0,0 +1,114 @@
+// Package auth logs in to vault using the auth method configured for the
+// credmanager daemon.
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// Method logs in to vault, returning the secret containing the new token
+type Method interface {
+	Login(vaultClient *vault.Client) (*vault.Secret, error)
+	// Validates the method configuration without contacting vault
+	Validate() error
+}
+
+// Config selects and configures the auth method used by the daemon
+type Config struct {
+	// Method is the name of the auth method to use
+	Method     string      `yaml:"method"`
+	AppRole    *AppRole    `yaml:"approle"`
+	Cert       *Cert       `yaml:"cert"`
+	Kubernetes *Kubernetes `yaml:"kubernetes"`
+	JWT        *JWT        `yaml:"jwt"`
+}
+
+// AuthMethod returns the configured auth method
+func (c *Config) AuthMethod() (Method, error) {
+	var method Method
+	switch c.Method {
+	case "approle":
+		if c.AppRole != nil {
+			method = c.AppRole
+		}
+	case "cert":
+		method = &Cert{}
+		if c.Cert != nil {
+			method = c.Cert
+		}
+	case "kubernetes":
+		if c.Kubernetes != nil {
+			method = c.Kubernetes
+		}
+	case "jwt":
+		if c.JWT != nil {
+			method = c.JWT
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth method: '%s'", c.Method)
+	}
+
+	if method == nil {
+		return nil, fmt.Errorf("no configuration found for auth method '%s'", c.Method)
+	}
+	return method, nil
+}
+
+// Validate checks that the selected auth method is configured correctly
+func (c *Config) Validate() error {
+	method, err := c.AuthMethod()
+	if err != nil {
+		return err
+	}
+	return method.Validate()
+}
+
+// login writes data to the login endpoint of the auth method mounted at mount.
+// The request is made without a token so that an expired token on the client
+// doesn't interfere.
+func login(vaultClient *vault.Client, mount string, data map[string]interface{}) (*vault.Secret, error) {
+	client, err := unauthenticatedClient(vaultClient)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := client.Logical().Write(fmt.Sprintf("auth/%s/login", strings.Trim(mount, "/")), data)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("no token returned by %s login", mount)
+	}
+	return secret, nil
+}
+
+// unauthenticatedClient returns a copy of vaultClient without a token.  Headers,
+// such as the namespace, are kept.
+func unauthenticatedClient(vaultClient *vault.Client) (*vault.Client, error) {
+	client, err := vaultClient.Clone()
+	if err != nil {
+		return nil, err
+	}
+	client.SetHeaders(vaultClient.Headers())
+	return client, nil
+}
+
+// readFile returns the contents of path with surrounding whitespace removed
+func readFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+func requireString(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s is required", name)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	vault "github.com/hashicorp/vault/api"
+)
+
+// Cert logs in with the TLS client certificate configured on the vault
+// client's transport.
+type Cert struct {
+	Mount string `yaml:"mount"`
+	// Role is the name of the certificate role to log in against.  If it isn't
+	// set vault tries all roles matching the client certificate.
+	Role string `yaml:"role"`
+}
+
+func (c *Cert) mount() string {
+	if c.Mount == "" {
+		return "cert"
+	}
+	return c.Mount
+}
+
+// Validate always succeeds, all cert settings are optional
+func (c *Cert) Validate() error {
+	return nil
+}
+
+// Login logs in to the cert auth method
+func (c *Cert) Login(vaultClient *vault.Client) (*vault.Secret, error) {
+	data := map[string]interface{}{}
+	if c.Role != "" {
+		data["name"] = c.Role
+	}
+	return login(vaultClient, c.mount(), data)
+}
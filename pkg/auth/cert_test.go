@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCertLogin(t *testing.T) {
+	var requestPath, namespace string
+	var requestBody map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestPath = r.URL.Path
+		namespace = r.Header.Get("X-Vault-Namespace")
+		requestBody = map[string]string{}
+		json.NewDecoder(r.Body).Decode(&requestBody)
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{"client_token": "cert-token", "lease_duration": 3600}})
+	}))
+	defer server.Close()
+
+	client := testClient(t, server.URL)
+	client.SetNamespace("team")
+	secret, err := (&Cert{Mount: "tls", Role: "host"}).Login(client)
+	if err != nil {
+		t.Fatalf("Unable to login: %v", err)
+	}
+	if secret.Auth.ClientToken != "cert-token" {
+		t.Errorf("Unexpected token returned: %s", secret.Auth.ClientToken)
+	}
+	if requestPath != "/v1/auth/tls/login" {
+		t.Errorf("Login sent to wrong path: %s", requestPath)
+	}
+	if namespace != "team" {
+		t.Errorf("Client namespace not used for login: '%s'", namespace)
+	}
+	if requestBody["name"] != "host" {
+		t.Errorf("Role not sent with login request: %v", requestBody)
+	}
+
+	_, err = (&Cert{}).Login(client)
+	if err != nil {
+		t.Fatalf("Unable to login: %v", err)
+	}
+	if requestPath != "/v1/auth/cert/login" {
+		t.Errorf("Login sent to wrong path: %s", requestPath)
+	}
+	if _, ok := requestBody["name"]; ok {
+		t.Errorf("Role sent with login request when none is configured: %v", requestBody)
+	}
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"fmt"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+const defaultServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// Kubernetes logs in with the pod's service account token
+type Kubernetes struct {
+	Mount string `yaml:"mount"`
+	Role  string `yaml:"role"`
+	// TokenPath defaults to the service account token mounted in every pod
+	TokenPath string `yaml:"token_path"`
+}
+
+// Validate checks that a role is set
+func (k *Kubernetes) Validate() error {
+	return requireString("role", k.Role)
+}
+
+// Login logs in to the kubernetes auth method
+func (k *Kubernetes) Login(vaultClient *vault.Client) (*vault.Secret, error) {
+	mount, tokenPath := k.Mount, k.TokenPath
+	if mount == "" {
+		mount = "kubernetes"
+	}
+	if tokenPath == "" {
+		tokenPath = defaultServiceAccountTokenPath
+	}
+	return jwtLogin(vaultClient, mount, k.Role, tokenPath)
+}
+
+// JWT logs in with a JSON web token read from a file, such as a projected
+// service account token.
+type JWT struct {
+	Mount string `yaml:"mount"`
+	// Role is optional, the default role of the mount is used if it isn't set
+	Role      string `yaml:"role"`
+	TokenPath string `yaml:"token_path"`
+}
+
+// Validate checks that a token path is set
+func (j *JWT) Validate() error {
+	return requireString("token_path", j.TokenPath)
+}
+
+// Login logs in to the jwt auth method
+func (j *JWT) Login(vaultClient *vault.Client) (*vault.Secret, error) {
+	mount := j.Mount
+	if mount == "" {
+		mount = "jwt"
+	}
+	return jwtLogin(vaultClient, mount, j.Role, j.TokenPath)
+}
+
+// jwtLogin logs in with the token in tokenPath.  The file is read on every
+// login since projected tokens are rotated.
+func jwtLogin(vaultClient *vault.Client, mount, role, tokenPath string) (*vault.Secret, error) {
+	jwt, err := readFile(tokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token: %v", err)
+	}
+
+	data := map[string]interface{}{"jwt": jwt}
+	if role != "" {
+		data["role"] = role
+	}
+	return login(vaultClient, mount, data)
+}
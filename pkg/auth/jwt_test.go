@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJWTLoginRereadsToken(t *testing.T) {
+	var requestPath string
+	var requestBody map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestPath = r.URL.Path
+		requestBody = map[string]string{}
+		json.NewDecoder(r.Body).Decode(&requestBody)
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{"client_token": "jwt-token", "lease_duration": 3600}})
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "jwttest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tokenPath := filepath.Join(tempDir, "token")
+	methods := map[string]Method{
+		"/v1/auth/kubernetes/login": &Kubernetes{Role: "credmanager", TokenPath: tokenPath},
+		"/v1/auth/oidc/login":       &JWT{Mount: "oidc", Role: "credmanager", TokenPath: tokenPath},
+	}
+
+	client := testClient(t, server.URL)
+	for expectedPath, method := range methods {
+		for _, jwt := range []string{"first-token", "rotated-token"} {
+			writeTestFile(t, tokenPath, jwt+"\n")
+
+			secret, err := method.Login(client)
+			if err != nil {
+				t.Fatalf("Unable to login: %v", err)
+			}
+			if secret.Auth.ClientToken != "jwt-token" {
+				t.Errorf("Unexpected token returned: %s", secret.Auth.ClientToken)
+			}
+			if requestPath != expectedPath {
+				t.Errorf("Login sent to wrong path: expected %s, got %s", expectedPath, requestPath)
+			}
+			if requestBody["jwt"] != jwt || requestBody["role"] != "credmanager" {
+				t.Errorf("Unexpected login request: %v", requestBody)
+			}
+		}
+	}
+}
+
+func TestJWTValidate(t *testing.T) {
+	if err := (&Kubernetes{}).Validate(); err == nil {
+		t.Errorf("Expected error validating kubernetes auth without a role")
+	}
+	if err := (&JWT{}).Validate(); err == nil {
+		t.Errorf("Expected error validating jwt auth without a token path")
+	}
+}
@@ -0,0 +1,81 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Client talks to the control API of a running credmanager
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient returns a client that connects to the control socket at socketPath
+func NewClient(socketPath string) *Client {
+	return &Client{httpClient: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}}
+}
+
+func (c *Client) do(method, path string, v interface{}) error {
+	request, err := http.NewRequest(method, "http://credmanager"+path, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		apiErr := make(map[string]string)
+		if err := json.NewDecoder(response.Body).Decode(&apiErr); err != nil || apiErr["error"] == "" {
+			return fmt.Errorf("unexpected response: %s", response.Status)
+		}
+		return fmt.Errorf("%s", apiErr["error"])
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// List returns the status of all managed credentials
+func (c *Client) List() ([]CredentialStatus, error) {
+	var result []CredentialStatus
+	err := c.do(http.MethodGet, credentialsPath, &result)
+	return result, err
+}
+
+// Status returns the status of the named credential
+func (c *Client) Status(name string) (*CredentialStatus, error) {
+	result := &CredentialStatus{}
+	err := c.do(http.MethodGet, credentialsPath+"/"+url.PathEscape(name), result)
+	return result, err
+}
+
+func (c *Client) control(name, action string) (*CredentialStatus, error) {
+	result := &CredentialStatus{}
+	err := c.do(http.MethodPost, fmt.Sprintf("%s/%s/%s", credentialsPath, url.PathEscape(name), action), result)
+	return result, err
+}
+
+// Renew forces an immediate renewal of the named credential
+func (c *Client) Renew(name string) (*CredentialStatus, error) {
+	return c.control(name, "renew")
+}
+
+// Pause stops scheduled renewals of the named credential
+func (c *Client) Pause(name string) (*CredentialStatus, error) {
+	return c.control(name, "pause")
+}
+
+// Resume restarts scheduled renewals of the named credential
+func (c *Client) Resume(name string) (*CredentialStatus, error) {
+	return c.control(name, "resume")
+}
@@ -0,0 +1,189 @@
+// Package control implements a local HTTP API, served over a unix socket, for
+// inspecting and controlling the credentials managed by a running credmanager.
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/credentials"
+)
+
+const credentialsPath = "/v1/credentials"
+
+// CredentialStatus is the status of a single managed credential
+type CredentialStatus struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Controllable is true if the credential can be renewed, paused and
+	// resumed on demand
+	Controllable bool `json:"controllable"`
+	credentials.RenewerStatus
+}
+
+// Manager provides the control server with access to managed credentials
+type Manager interface {
+	// Status returns the status of every managed credential
+	Status() []CredentialStatus
+	// Renewer returns the renewer for the named credential and whether the
+	// credential exists.  The renewer is nil if it can't be controlled.
+	Renewer(name string) (credentials.ControllableRenewer, bool)
+}
+
+// Server serves the control API on a unix socket
+type Server struct {
+	manager  Manager
+	listener net.Listener
+	server   *http.Server
+}
+
+// Listen creates the control socket at socketPath, restricting access to the
+// socket with mode and optionally group.
+func Listen(socketPath string, mode os.FileMode, group string, manager Manager) (*Server, error) {
+	err := os.MkdirAll(filepath.Dir(socketPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// remove a socket left behind by a previous instance
+	if info, err := os.Lstat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setSocketPermissions(socketPath, mode, group)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s := &Server{manager: manager, listener: listener}
+	mux := http.NewServeMux()
+	mux.HandleFunc(credentialsPath, s.handleList)
+	mux.HandleFunc(credentialsPath+"/", s.handleCredential)
+	s.server = &http.Server{Handler: mux}
+	return s, nil
+}
+
+func setSocketPermissions(socketPath string, mode os.FileMode, group string) error {
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(socketPath, -1, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(socketPath, mode)
+}
+
+// Serve handles requests until the server is closed
+func (s *Server) Serve() error {
+	err := s.server.Serve(s.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops the server and removes the socket
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.manager.Status())
+}
+
+func (s *Server) handleCredential(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, credentialsPath+"/")
+	action := ""
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name, action = name[:i], name[i+1:]
+	}
+
+	renewer, ok := s.manager.Renewer(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no credential named '%s'", name))
+		return
+	}
+
+	if action == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		s.writeStatus(w, name)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if renewer == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("credential '%s' can't be controlled", name))
+		return
+	}
+
+	var err error
+	switch action {
+	case "renew":
+		err = renewer.ForceRenew()
+	case "pause":
+		err = renewer.Pause()
+	case "resume":
+		err = renewer.Resume()
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown action '%s'", action))
+		return
+	}
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.writeStatus(w, name)
+}
+
+func (s *Server) writeStatus(w http.ResponseWriter, name string) {
+	for _, status := range s.manager.Status() {
+		if status.Name == name {
+			writeJSON(w, http.StatusOK, status)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("no credential named '%s'", name))
+}
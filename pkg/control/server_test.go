@@ -0,0 +1,139 @@
+package control
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/credentials"
+)
+
+type testRenewer struct {
+	status  credentials.RenewerStatus
+	renewed bool
+}
+
+func (r *testRenewer) DoneCh() <-chan error                     { return nil }
+func (r *testRenewer) RenewCh() <-chan *credentials.RenewOutput { return nil }
+func (r *testRenewer) Status() credentials.RenewerStatus        { return r.status }
+func (r *testRenewer) ForceRenew() error {
+	r.renewed = true
+	return nil
+}
+func (r *testRenewer) Pause() error {
+	r.status.Paused = true
+	return nil
+}
+func (r *testRenewer) Resume() error {
+	return fmt.Errorf("not supported")
+}
+
+// testManager manages renewers by name, a nil renewer is a credential that
+// can't be controlled
+type testManager struct {
+	renewers map[string]*testRenewer
+}
+
+func (m *testManager) Status() []CredentialStatus {
+	var result []CredentialStatus
+	for name, r := range m.renewers {
+		status := CredentialStatus{Name: name, Description: "test credential"}
+		if r != nil {
+			status.RenewerStatus, status.Controllable = r.Status(), true
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+func (m *testManager) Renewer(name string) (credentials.ControllableRenewer, bool) {
+	r, ok := m.renewers[name]
+	if r == nil {
+		return nil, ok
+	}
+	return r, ok
+}
+
+func startTestServer(t *testing.T, manager Manager) (*Client, func()) {
+	tempDir, err := ioutil.TempDir("", "controltest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+
+	socketPath := filepath.Join(tempDir, "control.sock")
+	server, err := Listen(socketPath, 0600, "", manager)
+	if err != nil {
+		t.Fatalf("Unable to start control server: %v", err)
+	}
+	go server.Serve()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("Unable to stat control socket: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Wrong mode set on control socket: %s", info.Mode())
+	}
+
+	return NewClient(socketPath), func() {
+		server.Close()
+		os.RemoveAll(tempDir)
+	}
+}
+
+func TestControlServer(t *testing.T) {
+	renewer := &testRenewer{status: credentials.RenewerStatus{FailureCount: 2}}
+	manager := &testManager{renewers: map[string]*testRenewer{"sample.yml:pki[0]": renewer, "sample.yml:template[0]": nil}}
+	client, cleanup := startTestServer(t, manager)
+	defer cleanup()
+
+	list, err := client.List()
+	if err != nil {
+		t.Fatalf("Unable to list credentials: %v", err)
+	}
+	if len(list) != 2 {
+		t.Errorf("Unexpected credential list: %+v", list)
+	}
+	for _, status := range list {
+		if status.Controllable != (status.Name == "sample.yml:pki[0]") || (status.Controllable && status.FailureCount != 2) {
+			t.Errorf("Unexpected credential status: %+v", status)
+		}
+	}
+
+	_, err = client.Renew("sample.yml:pki[0]")
+	if err != nil {
+		t.Fatalf("Unable to renew credential: %v", err)
+	}
+	if !renewer.renewed {
+		t.Errorf("Credential not renewed")
+	}
+
+	status, err := client.Pause("sample.yml:pki[0]")
+	if err != nil {
+		t.Fatalf("Unable to pause credential: %v", err)
+	}
+	if !status.Paused {
+		t.Errorf("Credential not paused: %+v", status)
+	}
+
+	_, err = client.Resume("sample.yml:pki[0]")
+	if err == nil || err.Error() != "not supported" {
+		t.Errorf("Expected error from failed control action, got: %v", err)
+	}
+
+	if status, err := client.Status("sample.yml:template[0]"); err != nil || status.Controllable {
+		t.Errorf("Unable to get status of uncontrollable credential: %+v %v", status, err)
+	}
+	_, err = client.Renew("sample.yml:template[0]")
+	if err == nil || !strings.Contains(err.Error(), "can't be controlled") {
+		t.Errorf("Expected error renewing uncontrollable credential, got: %v", err)
+	}
+
+	_, err = client.Status("missing")
+	if err == nil {
+		t.Errorf("Expected error getting status of unknown credential")
+	}
+}
@@ -0,0 +1,282 @@
+package credentials
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	multierror "github.com/hashicorp/go-multierror"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// AppRoleSecretID issues AppRole credentials for a local service, writing the
+// role's role_id and a new secret_id to its outputs.  The secret_id is
+// rotated before it expires and the previous secret_id is destroyed once the
+// service has been notified of the new one.  The current secret_id is left in
+// place when the credential is stopped so the service can still log in.
+type AppRoleSecretID struct {
+	Name            string `yaml:"name"`
+	SecretIDOptions `yaml:",inline"`
+	RoleIDFile      *Output `yaml:"role_id_file"`
+	SecretIDFile    *Output `yaml:"secret_id_file"`
+	// Namespace overrides the vault namespace of the daemon's client
+	Namespace   string       `yaml:"namespace"`
+	Notifies    string       `yaml:"notifies"`
+	HealthCheck *HealthCheck `yaml:"health_check"`
+	// MaxRenewalInterval is used to schedule rotation if no ttl is set
+	MaxRenewalInterval time.Duration `yaml:"max_renew"`
+	vaultClient        *vault.Client
+	renewer            *CredentialRenewer
+	expiration         expirationTime
+	// accessor of the secret_id currently written to the secret_id file
+	accessor string
+	// accessors of previous secret_ids waiting to be destroyed
+	previousAccessors []string
+}
+
+func (a *AppRoleSecretID) Initialize(vaultClient *vault.Client) error {
+	a.setup(vaultClient)
+	a.renewer.Renew()
+	return nil
+}
+
+// IssueOnce issues a new secret_id, unless the existing one is still valid
+// long enough, without starting a renewal process
+func (a *AppRoleSecretID) IssueOnce(vaultClient *vault.Client, maxAttempts uint, runAction bool) error {
+	a.setup(vaultClient)
+	return a.renewer.RenewOnce(maxAttempts, runAction)
+}
+
+func (a *AppRoleSecretID) setup(vaultClient *vault.Client) {
+	a.vaultClient = vaultClient
+	useVaultClient(vaultClient, a.Files()...)
+	a.renewer = NewCredentialRenewer(a, notifyAction(a.Notifies, a.RoleIDFile, a.SecretIDFile))
+	a.renewer.HealthCheck = a.HealthCheck
+}
+
+// NeedsRenewal returns true if the role_id or secret_id hasn't been written,
+// vault doesn't know the secret_id any more, or a third of the secret_id's
+// lifetime has passed.  Renewals are checked every half lifetime, so a
+// secret_id picked up after a restart is still replaced well before it
+// expires.  Secret_ids without a ttl are rotated every max_renew.
+func (a *AppRoleSecretID) NeedsRenewal() (bool, error) {
+	for _, o := range []*Output{a.RoleIDFile, a.SecretIDFile} {
+		contents, err := o.Read()
+		if os.IsNotExist(err) || (err == nil && contents == "") {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	secretID, _ := a.SecretIDFile.Read()
+
+	client, err := namespacedClient(a.vaultClient, a.Namespace)
+	if err != nil {
+		return false, err
+	}
+
+	secret, err := client.Logical().Write(a.rolePath("secret-id/lookup"), map[string]interface{}{"secret_id": secretID})
+	if respErr, ok := err.(*vault.ResponseError); ok && respErr.StatusCode == http.StatusNotFound {
+		secret, err = nil, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to look up secret_id: %v", err)
+	}
+	if secret == nil || secret.Data == nil {
+		// expired, used up or destroyed secret_ids can't be looked up
+		credentialLogger(a).Debug("secret_id_invalid", "Secret_id has expired or is invalid")
+		return true, nil
+	}
+
+	created, err := time.Parse(time.RFC3339Nano, fmt.Sprint(secret.Data["creation_time"]))
+	if err != nil {
+		return false, fmt.Errorf("unable to parse secret_id creation time: %v", err)
+	}
+	lifetime := a.MaxRenewInterval()
+	if ttl, err := jsonInt(secret.Data["secret_id_ttl"]); err == nil && ttl > 0 {
+		lifetime = time.Duration(ttl) * time.Second
+		a.expiration.set(created.Add(lifetime))
+	}
+	if a.accessor == "" {
+		// destroy the secret_id written before we started once it's replaced
+		a.accessor, _ = secret.Data["secret_id_accessor"].(string)
+	}
+
+	return time.Since(created) > lifetime/3, nil
+}
+
+// Renew writes the role_id and a newly generated secret_id
+func (a *AppRoleSecretID) Renew() error {
+	client, err := namespacedClient(a.vaultClient, a.Namespace)
+	if err != nil {
+		return err
+	}
+
+	roleID, err := a.readRoleID(client)
+	if err != nil {
+		return err
+	}
+
+	if a.accessor == "" {
+		// pick up the secret_id written before we started so it can be destroyed
+		a.accessor = a.existingAccessor(client)
+	}
+
+	secret, err := a.SecretIDOptions.generate(client)
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Data == nil {
+		return fmt.Errorf("no secret_id returned for role '%s'", a.Role)
+	}
+	secretID, _ := secret.Data["secret_id"].(string)
+	accessor, _ := secret.Data["secret_id_accessor"].(string)
+	if secretID == "" {
+		return fmt.Errorf("no secret_id returned for role '%s'", a.Role)
+	}
+
+	err = writeOutputs(
+		outputContent{a.RoleIDFile, roleID},
+		outputContent{a.SecretIDFile, secretID},
+	)
+	if err != nil {
+		return err
+	}
+
+	if a.accessor != "" {
+		a.previousAccessors = append(a.previousAccessors, a.accessor)
+	}
+	a.accessor = accessor
+	if a.TTL > 0 {
+		a.expiration.set(time.Now().Add(a.TTL))
+	}
+	return nil
+}
+
+func (a *AppRoleSecretID) readRoleID(client *vault.Client) (string, error) {
+	secret, err := client.Logical().Read(a.rolePath("role-id"))
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Data == nil {
+		return "", fmt.Errorf("role '%s' not found", a.Role)
+	}
+	roleID, _ := secret.Data["role_id"].(string)
+	if roleID == "" {
+		return "", fmt.Errorf("no role_id returned for role '%s'", a.Role)
+	}
+	return roleID, nil
+}
+
+// existingAccessor looks up the accessor of the secret_id in the secret_id
+// file, returning an empty string if there is no valid secret_id.
+func (a *AppRoleSecretID) existingAccessor(client *vault.Client) string {
+	secretID, err := a.SecretIDFile.Read()
+	if err != nil || secretID == "" {
+		return ""
+	}
+
+	secret, err := client.Logical().Write(a.rolePath("secret-id/lookup"), map[string]interface{}{"secret_id": secretID})
+	if err != nil || secret == nil || secret.Data == nil {
+		credentialLogger(a).Debug("secret_id_lookup_failed", "Unable to look up existing secret_id", logging.Fields{"error": err})
+		return ""
+	}
+	accessor, _ := secret.Data["secret_id_accessor"].(string)
+	return accessor
+}
+
+// Commit destroys the secret_ids replaced by previous renewals
+func (a *AppRoleSecretID) Commit() error {
+	client, err := namespacedClient(a.vaultClient, a.Namespace)
+	if err != nil {
+		return err
+	}
+
+	var result *multierror.Error
+	for _, accessor := range a.previousAccessors {
+		_, err := client.Logical().Write(a.rolePath("secret-id-accessor/destroy"), map[string]interface{}{"secret_id_accessor": accessor})
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("unable to destroy secret_id with accessor %s: %v", accessor, err))
+		}
+	}
+	// secret_ids that couldn't be destroyed expire on their own, retrying is
+	// unlikely to help
+	a.previousAccessors = nil
+	return result.ErrorOrNil()
+}
+
+// Rollback destroys the secret_id rejected by the health check, the previous
+// secret_id has been restored and is in use again
+func (a *AppRoleSecretID) Rollback() error {
+	if len(a.previousAccessors) == 0 {
+		return nil
+	}
+	client, err := namespacedClient(a.vaultClient, a.Namespace)
+	if err != nil {
+		return err
+	}
+
+	rejected := a.accessor
+	last := len(a.previousAccessors) - 1
+	a.accessor, a.previousAccessors = a.previousAccessors[last], a.previousAccessors[:last]
+	if _, err := client.Logical().Write(a.rolePath("secret-id-accessor/destroy"), map[string]interface{}{"secret_id_accessor": rejected}); err != nil {
+		return fmt.Errorf("unable to destroy secret_id with accessor %s: %v", rejected, err)
+	}
+	return nil
+}
+
+// Validate checks that all required fields are set
+func (a *AppRoleSecretID) Validate() error {
+	var result *multierror.Error
+	result = multierror.Append(result,
+		a.SecretIDOptions.validate(),
+		requireOutput("role_id_file", a.RoleIDFile),
+		requireOutput("secret_id_file", a.SecretIDFile),
+		validateOutputs(a.RoleIDFile, a.SecretIDFile),
+	)
+	if a.HealthCheck != nil {
+		result = multierror.Append(result, multierror.Prefix(a.HealthCheck.Validate(), "health_check:"))
+	}
+	return result.ErrorOrNil()
+}
+
+func (a *AppRoleSecretID) Stop() {
+	a.renewer.Stop()
+}
+
+// MaxRenewInterval returns the secret_id ttl, or max_renew if no ttl is set
+func (a *AppRoleSecretID) MaxRenewInterval() time.Duration {
+	switch {
+	case a.TTL > 0:
+		return a.TTL
+	case a.MaxRenewalInterval > 0:
+		return a.MaxRenewalInterval
+	default:
+		return 24 * time.Hour
+	}
+}
+
+// Expiration returns the time the current secret_id expires, or the zero time
+// if it doesn't expire
+func (a *AppRoleSecretID) Expiration() time.Time {
+	return a.expiration.get()
+}
+
+// Files returns the local files of the role_id and secret_id outputs
+func (a *AppRoleSecretID) Files() []*CredentialFile {
+	return outputFiles(a.RoleIDFile, a.SecretIDFile)
+}
+
+func (a *AppRoleSecretID) Renewer() Renewer {
+	return a.renewer
+}
+
+func (a *AppRoleSecretID) logFields() logging.Fields {
+	return credentialFields(a.Name, "approle", a)
+}
+
+func (a *AppRoleSecretID) String() string {
+	return fmt.Sprintf("AppRole secret_id for role '%s' stored at '%s'", a.Role, a.SecretIDFile.Path())
+}
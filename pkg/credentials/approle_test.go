@@ -0,0 +1,224 @@
+package credentials
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	vault "github.com/hashicorp/vault/api"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// fakeAppRoleServer emulates the AppRole role management endpoints of a vault
+// server, recording the accessors of destroyed secret_ids.
+type fakeAppRoleServer struct {
+	*httptest.Server
+	lock      sync.Mutex
+	issued    int
+	destroyed []string
+	// created holds the creation time of every secret_id that can be looked up
+	created map[string]time.Time
+}
+
+func newFakeAppRoleServer(t *testing.T) *fakeAppRoleServer {
+	s := &fakeAppRoleServer{created: make(map[string]time.Time)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		switch r.URL.Path {
+		case "/v1/auth/approle/role/app/role-id":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"role_id": "app-role-id"}})
+		case "/v1/auth/approle/role/app/secret-id":
+			if body["cidr_list"] != "10.0.0.0/24" {
+				t.Errorf("Wrong cidr_list sent: %v", body["cidr_list"])
+			}
+			s.issued++
+			s.created[fmt.Sprintf("secret-%d", s.issued)] = time.Now()
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"secret_id":          fmt.Sprintf("secret-%d", s.issued),
+				"secret_id_accessor": fmt.Sprintf("accessor-%d", s.issued),
+			}})
+		case "/v1/auth/approle/role/app/secret-id/lookup":
+			secretID := fmt.Sprint(body["secret_id"])
+			created, ok := s.created[secretID]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			accessor := strings.Replace(secretID, "secret", "accessor", 1)
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"secret_id_accessor": accessor,
+				"creation_time":      created.Format(time.RFC3339Nano),
+				"secret_id_ttl":      3 * 3600,
+			}})
+		case "/v1/auth/approle/role/app/secret-id-accessor/destroy":
+			s.destroyed = append(s.destroyed, fmt.Sprint(body["secret_id_accessor"]))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return s
+}
+
+// age moves the creation time of a secret_id into the past
+func (s *fakeAppRoleServer) age(secretID string, age time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.created[secretID] = time.Now().Add(-age)
+}
+
+func (s *fakeAppRoleServer) destroyedAccessors() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.destroyed...)
+}
+
+func TestAppRoleSecretIDRotation(t *testing.T) {
+	server := newFakeAppRoleServer(t)
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "approletest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	config := vault.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	vaultClient, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	vaultClient.SetToken("test-token")
+
+	secretIDFile := &CredentialFile{FilePath: filepath.Join(tempDir, "secret_id"), Mode: 0600}
+	roleIDFile := &CredentialFile{FilePath: filepath.Join(tempDir, "role_id"), Mode: 0600}
+	secretIDFile.Write("existing-secret")
+	roleIDFile.Write("app-role-id")
+	server.age("existing-secret", 2*time.Hour)
+
+	approle := &AppRoleSecretID{
+		SecretIDOptions: SecretIDOptions{Role: "app", CIDRList: []string{"10.0.0.0/24"}},
+		RoleIDFile:      FileOutput(roleIDFile),
+		SecretIDFile:    FileOutput(secretIDFile),
+	}
+
+	// the secret_id is issued without notifying the consumer, nothing is destroyed
+	if err := approle.IssueOnce(vaultClient, 1, false); err != nil {
+		t.Fatalf("Unable to issue secret_id: %v", err)
+	}
+	if roleID, _ := roleIDFile.Read(); roleID != "app-role-id" {
+		t.Errorf("Wrong role_id written: '%s'", roleID)
+	}
+	if secretID, _ := secretIDFile.Read(); secretID != "secret-1" {
+		t.Errorf("Wrong secret_id written: '%s'", secretID)
+	}
+	if destroyed := server.destroyedAccessors(); len(destroyed) != 0 {
+		t.Errorf("Secret_ids destroyed before the consumer was notified: %v", destroyed)
+	}
+
+	// a secret_id that has most of its lifetime left isn't replaced
+	if err := approle.renewer.RenewOnce(1, true); err != nil {
+		t.Fatalf("Unable to check secret_id: %v", err)
+	}
+	if secretID, _ := secretIDFile.Read(); secretID != "secret-1" {
+		t.Errorf("Valid secret_id replaced: '%s'", secretID)
+	}
+	if remaining := time.Until(approle.Expiration()); remaining < 2*time.Hour || remaining > 3*time.Hour {
+		t.Errorf("Wrong expiration for secret_id: %s", approle.Expiration())
+	}
+
+	// once the action succeeds every replaced secret_id is destroyed
+	server.age("secret-1", time.Hour+time.Minute)
+	if err := approle.renewer.RenewOnce(1, true); err != nil {
+		t.Fatalf("Unable to rotate secret_id: %v", err)
+	}
+	if secretID, _ := secretIDFile.Read(); secretID != "secret-2" {
+		t.Errorf("Wrong secret_id written: '%s'", secretID)
+	}
+	if diff := deep.Equal(server.destroyedAccessors(), []string{"existing-accessor", "accessor-1"}); diff != nil {
+		t.Errorf("Wrong secret_ids destroyed: %v", diff)
+	}
+
+	// a secret_id rejected by the health check is destroyed, the previous one
+	// is restored and destroyed by the next successful rotation
+	approle.renewer.HealthCheck = &HealthCheck{Type: "exec", Command: []string{"false"}}
+	server.age("secret-2", 2*time.Hour)
+	if err := approle.renewer.RenewOnce(1, true); err == nil {
+		t.Fatalf("Expected rotation to fail health check")
+	}
+	if secretID, _ := secretIDFile.Read(); secretID != "secret-2" {
+		t.Errorf("Previous secret_id not restored: '%s'", secretID)
+	}
+	if diff := deep.Equal(server.destroyedAccessors(), []string{"existing-accessor", "accessor-1", "accessor-3"}); diff != nil {
+		t.Errorf("Wrong secret_ids destroyed: %v", diff)
+	}
+	approle.renewer.HealthCheck = nil
+	if err := approle.renewer.RenewOnce(1, true); err != nil {
+		t.Fatalf("Unable to rotate secret_id: %v", err)
+	}
+	if diff := deep.Equal(server.destroyedAccessors(), []string{"existing-accessor", "accessor-1", "accessor-3", "accessor-2"}); diff != nil {
+		t.Errorf("Wrong secret_ids destroyed: %v", diff)
+	}
+}
+
+func TestAppRoleSecretIDUnmarshalYAML(t *testing.T) {
+	text := `name: app
+role: app
+mount: approle
+role_id_file:
+  path: /test/role_id
+secret_id_file:
+  path: /test/secret_id
+  mode: 0600
+metadata:
+  host: foo
+cidr_list:
+  - 10.0.0.0/24
+ttl: 72h
+notifies: app.service
+`
+	expected := &AppRoleSecretID{
+		Name: "app",
+		SecretIDOptions: SecretIDOptions{
+			Mount:    "approle",
+			Role:     "app",
+			Metadata: map[string]string{"host": "foo"},
+			CIDRList: []string{"10.0.0.0/24"},
+			TTL:      72 * time.Hour,
+		},
+		RoleIDFile:   FileOutput(&CredentialFile{FilePath: "/test/role_id"}),
+		SecretIDFile: FileOutput(&CredentialFile{FilePath: "/test/secret_id", Mode: 0600}),
+		Notifies:     "app.service",
+	}
+
+	dst := &AppRoleSecretID{}
+	if err := yaml.UnmarshalStrict([]byte(text), dst); err != nil {
+		t.Fatalf("Unable to unmarshal: %v", err)
+	}
+	if diff := deep.Equal(dst, expected); diff != nil {
+		t.Errorf("Unmarshaled not equal to expected: %v", diff)
+	}
+
+	if dst.MaxRenewInterval() != 72*time.Hour {
+		t.Errorf("Secret_id ttl not used as renewal interval: %s", dst.MaxRenewInterval())
+	}
+	if err := dst.Validate(); err != nil {
+		t.Errorf("Unexpected validation error: %v", err)
+	}
+}
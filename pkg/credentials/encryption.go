@@ -0,0 +1,203 @@
+package credentials
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// encryptedFileHeader starts the first line of every encrypted credential
+// file, followed by the path of the transit key used to encrypt it.
+const encryptedFileHeader = "credmanager-encrypted:v1:"
+
+// FileEncryption encrypts the contents of a credential file with a vault
+// transit key before it is written.  Encrypted files start with a header
+// naming the key, followed by the transit ciphertext:
+//
+//	credmanager-encrypted:v1:<mount>/<key>
+//	vault:v1:...
+//
+// With data_key set, the contents are encrypted locally using AES-GCM with a
+// data key generated from the transit key, so the contents are never sent to
+// vault.  The data key ciphertext takes the place of the transit ciphertext
+// and the locally encrypted contents follow on a third line.
+type FileEncryption struct {
+	// Mount is the path the transit secrets engine is mounted at, transit by
+	// default
+	Mount   string `yaml:"mount"`
+	Key     string `yaml:"key"`
+	DataKey bool   `yaml:"data_key"`
+}
+
+func (e *FileEncryption) mount() string {
+	if e.Mount == "" {
+		return "transit"
+	}
+	return strings.Trim(e.Mount, "/")
+}
+
+func (e *FileEncryption) validate() error {
+	if err := requireString("key", e.Key); err != nil {
+		return err
+	}
+	if strings.Contains(e.Key, "/") {
+		return fmt.Errorf("key must not contain '/'")
+	}
+	return nil
+}
+
+// encrypt encrypts plaintext, returning the contents of the encrypted file
+func (e *FileEncryption) encrypt(vaultClient *vault.Client, plaintext string) (string, error) {
+	if vaultClient == nil {
+		return "", fmt.Errorf("no vault client available for encryption")
+	}
+	lines := []string{fmt.Sprintf("%s%s/%s", encryptedFileHeader, e.mount(), e.Key)}
+
+	if !e.DataKey {
+		secret, err := vaultClient.Logical().Write(fmt.Sprintf("%s/encrypt/%s", e.mount(), e.Key), map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString([]byte(plaintext)),
+		})
+		if err != nil {
+			return "", err
+		}
+		ciphertext, err := secretString(secret, "ciphertext")
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, ciphertext)
+		return strings.Join(lines, "\n") + "\n", nil
+	}
+
+	secret, err := vaultClient.Logical().Write(fmt.Sprintf("%s/datakey/plaintext/%s", e.mount(), e.Key), map[string]interface{}{"bits": 256})
+	if err != nil {
+		return "", err
+	}
+	keyCiphertext, err := secretString(secret, "ciphertext")
+	if err != nil {
+		return "", err
+	}
+	key, err := secretString(secret, "plaintext")
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := sealWithDataKey(key, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	lines = append(lines, keyCiphertext, sealed)
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// IsEncrypted returns true if contents were written by an encrypted
+// credential file
+func IsEncrypted(contents string) bool {
+	return strings.HasPrefix(contents, encryptedFileHeader)
+}
+
+// Decrypt decrypts the contents of an encrypted credential file using the
+// transit key named in its header.
+func Decrypt(vaultClient *vault.Client, contents string) (string, error) {
+	lines := strings.Split(strings.TrimSpace(contents), "\n")
+	if !IsEncrypted(contents) || len(lines) < 2 || len(lines) > 3 {
+		return "", fmt.Errorf("not an encrypted credential file")
+	}
+
+	keyPath := strings.TrimPrefix(lines[0], encryptedFileHeader)
+	split := strings.LastIndex(keyPath, "/")
+	if split < 0 {
+		return "", fmt.Errorf("invalid transit key path '%s'", keyPath)
+	}
+	secret, err := vaultClient.Logical().Write(fmt.Sprintf("%s/decrypt/%s", keyPath[:split], keyPath[split+1:]), map[string]interface{}{
+		"ciphertext": lines[1],
+	})
+	if err != nil {
+		return "", err
+	}
+	// base64 encoded plaintext, or data key if the contents were encrypted locally
+	decrypted, err := secretString(secret, "plaintext")
+	if err != nil {
+		return "", err
+	}
+
+	if len(lines) == 3 {
+		plaintext, err := openWithDataKey(decrypted, lines[2])
+		return string(plaintext), err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(decrypted)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode plaintext: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// sealWithDataKey encrypts plaintext with a base64 encoded AES-256 key,
+// returning the base64 encoded nonce and ciphertext
+func sealWithDataKey(key string, plaintext []byte) (string, error) {
+	gcm, err := dataKeyCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// openWithDataKey decrypts the output of sealWithDataKey
+func openWithDataKey(key string, sealed string) ([]byte, error) {
+	gcm, err := dataKeyCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode ciphertext: %v", err)
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func dataKeyCipher(key string) (cipher.AEAD, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode data key: %v", err)
+	}
+	block, err := aes.NewCipher(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// secretString returns a string field from the data of a secret
+func secretString(secret *vault.Secret, field string) (string, error) {
+	if secret == nil || secret.Data == nil {
+		return "", fmt.Errorf("no data returned from vault")
+	}
+	value, ok := secret.Data[field].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("no %s returned from vault", field)
+	}
+	return value, nil
+}
+
+// useVaultClient sets the client used to encrypt and decrypt files
+func useVaultClient(vaultClient *vault.Client, files ...*CredentialFile) {
+	for _, f := range files {
+		if f != nil {
+			f.vaultClient = vaultClient
+		}
+	}
+}
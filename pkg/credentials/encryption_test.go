@@ -0,0 +1,101 @@
+package credentials
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// fakeTransitServer emulates the encrypt, decrypt and datakey endpoints of a
+// transit secrets engine mounted at transit, using the key 'test'.  Ciphertext
+// is just the plaintext with a vault prefix.
+func fakeTransitServer(t *testing.T) *httptest.Server {
+	dataKey := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		var data map[string]interface{}
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/test":
+			data = map[string]interface{}{"ciphertext": "vault:v1:" + body["plaintext"].(string)}
+		case "/v1/transit/decrypt/test":
+			data = map[string]interface{}{"plaintext": strings.TrimPrefix(body["ciphertext"].(string), "vault:v1:")}
+		case "/v1/transit/datakey/plaintext/test":
+			data = map[string]interface{}{"plaintext": dataKey, "ciphertext": "vault:v1:" + dataKey}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+}
+
+func TestEncryptedCredentialFile(t *testing.T) {
+	server := fakeTransitServer(t)
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "encryptiontest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	config := vault.DefaultConfig()
+	config.Address = server.URL
+	vaultClient, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	vaultClient.SetToken("test-token")
+
+	for _, dataKey := range []bool{false, true} {
+		f := &CredentialFile{
+			FilePath:   filepath.Join(tempDir, "secret"),
+			Mode:       0600,
+			Encryption: &FileEncryption{Key: "test", DataKey: dataKey},
+		}
+
+		if err := f.Write("secret contents"); err == nil {
+			t.Errorf("Expected error writing encrypted file without a vault client")
+		}
+
+		useVaultClient(vaultClient, f)
+		if err := f.Write("secret contents"); err != nil {
+			t.Fatalf("Unable to write encrypted file (data key %t): %v", dataKey, err)
+		}
+
+		raw, _ := f.readRaw()
+		if !IsEncrypted(raw) {
+			t.Errorf("File not encrypted (data key %t): %s", dataKey, raw)
+		}
+		if dataKey && strings.Contains(raw, base64.StdEncoding.EncodeToString([]byte("secret contents"))) {
+			t.Errorf("Contents not encrypted with the data key: %s", raw)
+		}
+
+		contents, err := f.Read()
+		if err != nil {
+			t.Fatalf("Unable to read encrypted file (data key %t): %v", dataKey, err)
+		}
+		if contents != "secret contents" {
+			t.Errorf("Wrong contents decrypted (data key %t): '%s'", dataKey, contents)
+		}
+	}
+}
+
+func TestDecryptInvalidContents(t *testing.T) {
+	if _, err := Decrypt(nil, "secret contents"); err == nil {
+		t.Errorf("Expected error decrypting unencrypted contents")
+	}
+	if _, err := Decrypt(nil, encryptedFileHeader+"transit\nvault:v1:abc\n"); err == nil {
+		t.Errorf("Expected error decrypting contents without a key name")
+	}
+}
@@ -0,0 +1,114 @@
+package credentials
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envEscaper escapes the characters that are special inside double quotes for
+// both systemd's EnvironmentFile= and POSIX shells
+var envEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`", `$`, `\$`)
+
+// envQuote double quotes value for an environment file.  Newlines are kept
+// as-is, both systemd and shells allow them inside double quotes.
+func envQuote(value string) string {
+	return `"` + envEscaper.Replace(value) + `"`
+}
+
+// envUnquote reverses envQuote
+func envUnquote(quoted string) (string, error) {
+	if len(quoted) < 2 || quoted[0] != '"' || quoted[len(quoted)-1] != '"' {
+		return "", fmt.Errorf("value isn't double quoted")
+	}
+	var value strings.Builder
+	escaped := false
+	for _, c := range quoted[1 : len(quoted)-1] {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		value.WriteRune(c)
+	}
+	return value.String(), nil
+}
+
+// envFile formats name/value pairs as KEY="value" lines
+func envFile(pairs ...string) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", fmt.Errorf("expected name/value pairs, got %d arguments", len(pairs))
+	}
+	var lines strings.Builder
+	for i := 0; i < len(pairs); i += 2 {
+		if !envNamePattern.MatchString(pairs[i]) {
+			return "", fmt.Errorf("invalid environment variable name '%s'", pairs[i])
+		}
+		fmt.Fprintf(&lines, "%s=%s\n", pairs[i], envQuote(pairs[i+1]))
+	}
+	return lines.String(), nil
+}
+
+// EnvFileOutput writes an environment file for use with EnvironmentFile=.  If
+// a variable is set, the output is written as the quoted value of that
+// variable, otherwise the output must already be an environment file, such as
+// a native template using envFile.  Units only read environment files when
+// they start, so notified units are restarted rather than reloaded.
+type EnvFileOutput struct {
+	CredentialFile `yaml:",inline"`
+	Variable       string `yaml:"variable"`
+}
+
+func (f *EnvFileOutput) Write(content string) error {
+	if f.Variable == "" {
+		return f.CredentialFile.Write(content)
+	}
+	formatted, err := envFile(f.Variable, content)
+	if err != nil {
+		return err
+	}
+	return f.CredentialFile.Write(formatted)
+}
+
+// Read returns the value of the variable, or the whole file if no variable is
+// set
+func (f *EnvFileOutput) Read() (string, error) {
+	contents, err := f.CredentialFile.Read()
+	if err != nil || f.Variable == "" || contents == "" {
+		return contents, err
+	}
+	prefix := f.Variable + "="
+	if !strings.HasPrefix(contents, prefix) {
+		return "", fmt.Errorf("%s doesn't set %s", f.Path(), f.Variable)
+	}
+	value, err := envUnquote(strings.TrimSuffix(strings.TrimPrefix(contents, prefix), "\n"))
+	if err != nil {
+		return "", fmt.Errorf("invalid value for %s in %s: %v", f.Variable, f.Path(), err)
+	}
+	return value, nil
+}
+
+// Validate checks the file and variable name
+func (f *EnvFileOutput) Validate() error {
+	var result *multierror.Error
+	result = multierror.Append(result, f.CredentialFile.Validate())
+	if f.Variable != "" && !envNamePattern.MatchString(f.Variable) {
+		result = multierror.Append(result, fmt.Errorf("invalid environment variable name '%s'", f.Variable))
+	}
+	return result.ErrorOrNil()
+}
+
+func (f *EnvFileOutput) readOnStart() bool {
+	return true
+}
+
+func (f *EnvFileOutput) String() string {
+	if f.Variable == "" {
+		return fmt.Sprintf("env file %s", f.Path())
+	}
+	return fmt.Sprintf("env file %s (%s)", f.Path(), f.Variable)
+}
@@ -0,0 +1,87 @@
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvQuote(t *testing.T) {
+	values := []string{"", "plain", `quo"ted`, `back\slash`, "$HOME and `cmd`", "multi\nline"}
+	for _, value := range values {
+		quoted := envQuote(value)
+		unquoted, err := envUnquote(quoted)
+		if err != nil || unquoted != value {
+			t.Errorf("Quoting not reversible for '%s': %s -> '%s' %v", value, quoted, unquoted, err)
+		}
+	}
+
+	if quoted := envQuote("p@ss$word\"`"); quoted != "\"p@ss\\$word\\\"\\`\"" {
+		t.Errorf("Wrong quoting: %s", quoted)
+	}
+}
+
+func TestEnvFile(t *testing.T) {
+	contents, err := envFile("DB_USER", "app", "DB_PASSWORD", "se\"cret")
+	if err != nil {
+		t.Fatalf("Unable to format env file: %v", err)
+	}
+	expected := "DB_USER=\"app\"\nDB_PASSWORD=\"se\\\"cret\"\n"
+	if contents != expected {
+		t.Errorf("Wrong env file, expected '%s' got '%s'", expected, contents)
+	}
+
+	if _, err := envFile("DB_USER"); err == nil {
+		t.Errorf("Expected error for a name without a value")
+	}
+	if _, err := envFile("DB-USER", "app"); err == nil {
+		t.Errorf("Expected error for an invalid variable name")
+	}
+}
+
+func TestEnvFileOutput(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "envfiletest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	f := &EnvFileOutput{CredentialFile: CredentialFile{FilePath: filepath.Join(tempDir, "token.env"), Mode: 0600}, Variable: "VAULT_TOKEN"}
+	if err := f.Validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+	if err := f.Write("s.abc$123"); err != nil {
+		t.Fatalf("Unable to write env file: %v", err)
+	}
+	raw, _ := f.CredentialFile.Read()
+	if raw != "VAULT_TOKEN=\"s.abc\\$123\"\n" {
+		t.Errorf("Wrong env file written: '%s'", raw)
+	}
+	if value, err := f.Read(); err != nil || value != "s.abc$123" {
+		t.Errorf("Wrong value read back: '%s' %v", value, err)
+	}
+
+	f.Variable = "1TOKEN"
+	if err := f.Validate(); err == nil {
+		t.Errorf("Expected error for an invalid variable name")
+	}
+}
+
+func TestNotifyAction(t *testing.T) {
+	file := FileOutput(&CredentialFile{FilePath: "/test/token"})
+	env := &Output{Type: "env_file", OutputSink: &EnvFileOutput{}}
+	systemd := &Output{Type: "systemd_credential", OutputSink: &SystemdCredentialOutput{CredentialName: "token"}}
+
+	if action := notifyAction("", env); action != nil {
+		t.Errorf("Expected no action without a unit: %#v", action)
+	}
+	if _, ok := notifyAction("app.service", file, nil).(*ReloadOrRestartSystemdUnit); !ok {
+		t.Errorf("Expected units reading files to be reloaded")
+	}
+	for _, o := range []*Output{env, systemd} {
+		if _, ok := notifyAction("app.service", file, o).(*RestartSystemdUnit); !ok {
+			t.Errorf("Expected unit reading %s to be restarted", o)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package credentials
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"strconv"
+
+	multierror "github.com/hashicorp/go-multierror"
+	vault "github.com/hashicorp/vault/api"
 )
 
 type CredentialFile struct {
@@ -12,8 +16,11 @@ type CredentialFile struct {
 	Mode     os.FileMode `yaml:"mode"`
 	Owner    string      `yaml:"owner"`
 	Group    string      `yaml:"group"`
-	owner    *user.User
-	group    *user.Group
+	// Encryption encrypts the contents with a vault transit key if set
+	Encryption  *FileEncryption `yaml:"encryption,omitempty"`
+	owner       *user.User
+	group       *user.Group
+	vaultClient *vault.Client
 }
 
 func NewCredentialFile(path string, mode os.FileMode, owner string, group string) (*CredentialFile, error) {
@@ -55,7 +62,33 @@ func (f *CredentialFile) populateUserGroupData() error {
 	return nil
 }
 
+// Validate checks that a path is set and that the owner and group exist
+func (f *CredentialFile) Validate() error {
+	var result *multierror.Error
+	result = multierror.Append(result, requireString("path", f.FilePath))
+	if err := f.populateUserGroupData(); err != nil {
+		result = multierror.Append(result, fmt.Errorf("unable to resolve owner/group: %v", err))
+	}
+	if f.Encryption != nil {
+		result = multierror.Append(result, multierror.Prefix(f.Encryption.validate(), "encryption:"))
+	}
+	return result.ErrorOrNil()
+}
+
+// Write writes content to the file, encrypting it first if encryption is
+// configured
 func (f *CredentialFile) Write(content string) error {
+	if f.Encryption != nil {
+		encrypted, err := f.Encryption.encrypt(f.vaultClient, content)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt %s: %v", f.Path(), err)
+		}
+		content = encrypted
+	}
+	return f.writeRaw(content)
+}
+
+func (f *CredentialFile) writeRaw(content string) error {
 	if err := ioutil.WriteFile(f.FilePath, []byte(content), f.Mode); err != nil {
 		return err
 	}
@@ -83,7 +116,20 @@ func (f *CredentialFile) Write(content string) error {
 	return nil
 }
 
+// Read returns the contents of the file, decrypting them if encryption is
+// configured
 func (f *CredentialFile) Read() (string, error) {
+	contents, err := f.readRaw()
+	if err != nil || f.Encryption == nil {
+		return contents, err
+	}
+	if f.vaultClient == nil {
+		return "", fmt.Errorf("no vault client available to decrypt %s", f.Path())
+	}
+	return Decrypt(f.vaultClient, contents)
+}
+
+func (f *CredentialFile) readRaw() (string, error) {
 	contents, err := ioutil.ReadFile(f.Path())
 	return string(contents), err
 }
@@ -91,3 +137,41 @@ func (f *CredentialFile) Read() (string, error) {
 func (f *CredentialFile) Path() string {
 	return f.FilePath
 }
+
+// Remove deletes the file, it is not an error if the file doesn't exist
+func (f *CredentialFile) Remove() error {
+	if err := os.Remove(f.Path()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *CredentialFile) String() string {
+	return fmt.Sprintf("file %s", f.Path())
+}
+
+// credentialFileBackup holds the contents of a credential file prior to renewal
+// so that it can be restored if the renewed credential is rejected.
+type credentialFileBackup struct {
+	file     *CredentialFile
+	contents string
+	existed  bool
+}
+
+// backup saves the contents of the file as written, without decrypting them
+func (f *CredentialFile) backup() (*credentialFileBackup, error) {
+	contents, err := f.readRaw()
+	if err != nil && os.IsNotExist(err) {
+		return &credentialFileBackup{file: f}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &credentialFileBackup{file: f, contents: contents, existed: true}, nil
+}
+
+func (b *credentialFileBackup) restore() error {
+	if !b.existed {
+		return b.file.Remove()
+	}
+	return b.file.writeRaw(b.contents)
+}
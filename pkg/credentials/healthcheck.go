@@ -0,0 +1,165 @@
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// HealthCheck verifies that the service consuming a credential is healthy after
+// the credential's post renew action has run.  If the check fails the renewer
+// restores the previous credential and re-runs the action.
+type HealthCheck struct {
+	// Type is one of tcp, tls, http or exec
+	Type       string        `yaml:"type"`
+	Address    string        `yaml:"address"`
+	ServerName string        `yaml:"server_name"`
+	URL        string        `yaml:"url"`
+	Command    []string      `yaml:"command"`
+	Timeout    time.Duration `yaml:"timeout"`
+	Retries    int           `yaml:"retries"`
+	Interval   time.Duration `yaml:"interval"`
+
+	// certificate that the tls check expects the service to present
+	expectedCertificate OutputSink
+}
+
+// Validate checks that the fields required by the check type are set
+func (h *HealthCheck) Validate() error {
+	switch h.Type {
+	case "tcp", "tls":
+		return requireString("address", h.Address)
+	case "http":
+		return requireString("url", h.URL)
+	case "exec":
+		if len(h.Command) == 0 {
+			return fmt.Errorf("command is required")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown health check type: '%s'", h.Type)
+	}
+}
+
+func (h *HealthCheck) timeout() time.Duration {
+	if h.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return h.Timeout
+}
+
+func (h *HealthCheck) interval() time.Duration {
+	if h.Interval <= 0 {
+		return 1 * time.Second
+	}
+	return h.Interval
+}
+
+// Check runs the health check, retrying up to Retries times before returning
+// the last error encountered.
+func (h *HealthCheck) Check() error {
+	var err error
+	for attempt := 0; attempt <= h.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(h.interval())
+		}
+		err = h.check()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (h *HealthCheck) check() error {
+	switch h.Type {
+	case "tcp":
+		return h.checkTCP()
+	case "tls":
+		return h.checkTLS()
+	case "http":
+		return h.checkHTTP()
+	case "exec":
+		return h.checkExec()
+	default:
+		return fmt.Errorf("unknown health check type: '%s'", h.Type)
+	}
+}
+
+func (h *HealthCheck) checkTCP() error {
+	conn, err := net.DialTimeout("tcp", h.Address, h.timeout())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (h *HealthCheck) checkTLS() error {
+	dialer := &net.Dialer{Timeout: h.timeout()}
+	// The served certificate is compared directly against the one we wrote, so
+	// chain verification isn't required here.
+	conn, err := tls.DialWithDialer(dialer, "tcp", h.Address, &tls.Config{ServerName: h.ServerName, InsecureSkipVerify: true})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if h.expectedCertificate == nil {
+		return nil
+	}
+
+	peerCerts := conn.ConnectionState().PeerCertificates
+	if len(peerCerts) == 0 {
+		return fmt.Errorf("no certificate presented by %s", h.Address)
+	}
+
+	expected, err := h.expectedCertificate.Read()
+	if err != nil {
+		return fmt.Errorf("unable to read expected certificate: %v", err)
+	}
+
+	block, _ := pem.Decode([]byte(expected))
+	if block == nil {
+		return fmt.Errorf("unable to decode expected certificate %s", h.expectedCertificate.Path())
+	}
+
+	if !bytes.Equal(block.Bytes, peerCerts[0].Raw) {
+		return fmt.Errorf("certificate presented by %s doesn't match %s", h.Address, h.expectedCertificate.Path())
+	}
+	return nil
+}
+
+func (h *HealthCheck) checkHTTP() error {
+	client := &http.Client{Timeout: h.timeout()}
+	response, err := client.Get(h.URL)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 400 {
+		return fmt.Errorf("unexpected response from %s: %s", h.URL, response.Status)
+	}
+	return nil
+}
+
+func (h *HealthCheck) checkExec() error {
+	if len(h.Command) == 0 {
+		return fmt.Errorf("no command specified for exec health check")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("health check command failed: %v -- %s", err, output)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package credentials
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckTCP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	check := &HealthCheck{Type: "tcp", Address: address}
+	if err := check.Check(); err != nil {
+		t.Errorf("Unexpected error checking open port: %v", err)
+	}
+
+	server.Close()
+	if err := check.Check(); err == nil {
+		t.Errorf("Expected error checking closed port")
+	}
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	check := &HealthCheck{Type: "http", URL: server.URL}
+	if err := check.Check(); err != nil {
+		t.Errorf("Unexpected error from healthy server: %v", err)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := check.Check(); err == nil {
+		t.Errorf("Expected error from unhealthy server")
+	}
+}
+
+func TestHealthCheckTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "healthchecktest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	certFile, err := NewCredentialFile(filepath.Join(tempDir, "server.crt"), 0644, "", "")
+	if err != nil {
+		t.Fatalf("Unable to create credential file: %v", err)
+	}
+
+	served := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := certFile.Write(string(served)); err != nil {
+		t.Fatalf("Unable to write certificate: %v", err)
+	}
+
+	check := &HealthCheck{Type: "tls", Address: strings.TrimPrefix(server.URL, "https://"), expectedCertificate: certFile}
+	if err := check.Check(); err != nil {
+		t.Errorf("Unexpected error when served certificate matches: %v", err)
+	}
+
+	other := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("some other certificate")})
+	if err := certFile.Write(string(other)); err != nil {
+		t.Fatalf("Unable to write certificate: %v", err)
+	}
+
+	if err := check.Check(); err == nil {
+		t.Errorf("Expected error when served certificate doesn't match")
+	}
+}
+
+func TestHealthCheckExec(t *testing.T) {
+	check := &HealthCheck{Type: "exec", Command: []string{"true"}}
+	if err := check.Check(); err != nil {
+		t.Errorf("Unexpected error running successful command: %v", err)
+	}
+
+	check = &HealthCheck{Type: "exec", Command: []string{"false"}, Retries: 2, Interval: 10 * time.Millisecond}
+	if err := check.Check(); err == nil {
+		t.Errorf("Expected error running failing command")
+	}
+}
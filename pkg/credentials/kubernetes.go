@@ -0,0 +1,272 @@
+package credentials
+
+import (
+	"fmt"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/kubernetes"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// tlsSecretKeys must be present in kubernetes.io/tls secrets
+var tlsSecretKeys = []string{"tls.crt", "tls.key"}
+
+// newKubernetesClient is replaced in tests to point at a fake API server
+var newKubernetesClient = kubernetes.InClusterClient
+
+// kubernetesSecret writes credential outputs to a Kubernetes Secret using the
+// in-cluster service account.  Existing secrets are changed with a merge
+// patch, preserving other keys, labels, annotations and metadata such as
+// owner references.
+type kubernetesSecret struct {
+	namespace   string
+	name        string
+	secretType  string
+	labels      map[string]string
+	annotations map[string]string
+	client      *kubernetes.Client
+}
+
+// validate checks that a name is set and the type is supported
+func (s *kubernetesSecret) validate() error {
+	var result *multierror.Error
+	result = multierror.Append(result, requireString("name", s.name))
+	switch s.secretType {
+	case "", kubernetes.SecretTypeOpaque, kubernetes.SecretTypeTLS:
+	default:
+		result = multierror.Append(result, fmt.Errorf("unsupported secret type '%s'", s.secretType))
+	}
+	return result.ErrorOrNil()
+}
+
+func (s *kubernetesSecret) typeOrDefault() string {
+	if s.secretType == "" {
+		return kubernetes.SecretTypeOpaque
+	}
+	return s.secretType
+}
+
+func (s *kubernetesSecret) kubernetesClient() (*kubernetes.Client, error) {
+	if s.client == nil {
+		client, err := newKubernetesClient()
+		if err != nil {
+			return nil, err
+		}
+		s.client = client
+	}
+	return s.client, nil
+}
+
+// write stores data in the secret in a single request, creating the secret if
+// it doesn't exist
+func (s *kubernetesSecret) write(data map[string]string) error {
+	client, err := s.kubernetesClient()
+	if err != nil {
+		return fmt.Errorf("unable to configure kubernetes client: %v", err)
+	}
+
+	patch := &kubernetes.SecretPatch{
+		Data:        make(map[string][]byte, len(data)),
+		Labels:      s.labels,
+		Annotations: s.annotations,
+	}
+	for key, value := range data {
+		patch.Data[key] = []byte(value)
+	}
+
+	const maxAttempts = 3
+	for attempt := 1; ; attempt++ {
+		secret, err := client.GetSecret(s.namespace, s.name)
+		if kubernetes.IsNotFound(err) {
+			secret = kubernetes.NewSecret(s.namespace, s.name, s.typeOrDefault())
+			secret.Data = patch.Data
+			secret.Metadata.Labels, secret.Metadata.Annotations = patch.Labels, patch.Annotations
+			_, err = client.CreateSecret(secret)
+			if err == nil {
+				return nil
+			}
+			if !kubernetes.IsConflict(err) || attempt >= maxAttempts {
+				return fmt.Errorf("unable to write %s: %v", s, err)
+			}
+			// created concurrently, patch it instead
+			continue
+		} else if err != nil {
+			return fmt.Errorf("unable to read %s: %v", s, err)
+		} else if secret.Type != s.typeOrDefault() {
+			// the type of a secret is immutable
+			return fmt.Errorf("%s has type %s, expected %s", s, secret.Type, s.typeOrDefault())
+		}
+
+		if _, err := client.PatchSecret(s.namespace, s.name, patch); err != nil {
+			return fmt.Errorf("unable to write %s: %v", s, err)
+		}
+		return nil
+	}
+}
+
+// read returns the value stored under key, or an empty string if the secret or
+// key doesn't exist
+func (s *kubernetesSecret) read(key string) (string, error) {
+	client, err := s.kubernetesClient()
+	if err != nil {
+		return "", fmt.Errorf("unable to configure kubernetes client: %v", err)
+	}
+
+	secret, err := client.GetSecret(s.namespace, s.name)
+	if kubernetes.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("unable to read %s: %v", s, err)
+	}
+	return string(secret.Data[key]), nil
+}
+
+func (s *kubernetesSecret) String() string {
+	if s.namespace == "" {
+		return fmt.Sprintf("kubernetes secret %s", s.name)
+	}
+	return fmt.Sprintf("kubernetes secret %s/%s", s.namespace, s.name)
+}
+
+// KubernetesSecretOutput writes a single output to a key of a Kubernetes
+// Secret.  Outputs of a credential may share a secret by using different keys,
+// they are written to the secret together.
+type KubernetesSecretOutput struct {
+	// Namespace defaults to the namespace of the pod credmanager runs in
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+	Key       string `yaml:"key"`
+	// SecretType is Opaque or kubernetes.io/tls, defaults to Opaque
+	SecretType  string            `yaml:"secret_type"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+	secret      *kubernetesSecret
+}
+
+func (o *KubernetesSecretOutput) kubernetesSecret() *kubernetesSecret {
+	if o.secret == nil {
+		o.secret = &kubernetesSecret{
+			namespace:   o.Namespace,
+			name:        o.Name,
+			secretType:  o.SecretType,
+			labels:      o.Labels,
+			annotations: o.Annotations,
+		}
+	}
+	return o.secret
+}
+
+// Write stores content under the output's key.  Credentials with several
+// outputs use writeOutputs so outputs sharing a secret are written together.
+func (o *KubernetesSecretOutput) Write(content string) error {
+	return o.kubernetesSecret().write(map[string]string{o.Key: content})
+}
+
+func (o *KubernetesSecretOutput) Read() (string, error) {
+	return o.kubernetesSecret().read(o.Key)
+}
+
+func (o *KubernetesSecretOutput) Path() string {
+	if o.Namespace == "" {
+		return fmt.Sprintf("%s/%s", o.Name, o.Key)
+	}
+	return fmt.Sprintf("%s/%s/%s", o.Namespace, o.Name, o.Key)
+}
+
+// Validate checks that the secret and key are set
+func (o *KubernetesSecretOutput) Validate() error {
+	var result *multierror.Error
+	result = multierror.Append(result,
+		o.kubernetesSecret().validate(),
+		requireString("key", o.Key),
+	)
+	return result.ErrorOrNil()
+}
+
+func (o *KubernetesSecretOutput) String() string {
+	return fmt.Sprintf("%s key %s", o.kubernetesSecret(), o.Key)
+}
+
+// secretID identifies the secret written by the output
+func (o *KubernetesSecretOutput) secretID() string {
+	return o.Namespace + "/" + o.Name
+}
+
+// secretOutputs groups the outputs of a credential written to the same secret
+type secretOutputs struct {
+	outputs []*KubernetesSecretOutput
+	data    map[string]string
+}
+
+// groupSecretOutputs returns the kubernetes secret outputs grouped by secret,
+// in the order each secret is first used.  Outputs of other types are ignored.
+func groupSecretOutputs(contents []outputContent) []*secretOutputs {
+	groups := []*secretOutputs{}
+	byID := map[string]*secretOutputs{}
+	for _, c := range contents {
+		o, ok := c.output.OutputSink.(*KubernetesSecretOutput)
+		if !ok {
+			continue
+		}
+		group, ok := byID[o.secretID()]
+		if !ok {
+			group = &secretOutputs{data: map[string]string{}}
+			byID[o.secretID()] = group
+			groups = append(groups, group)
+		}
+		group.outputs = append(group.outputs, o)
+		group.data[o.Key] = c.content
+	}
+	return groups
+}
+
+// validate checks that outputs sharing a secret agree on its type and use
+// different keys, and that tls secrets get both a certificate and a key
+func (g *secretOutputs) validate() error {
+	var result *multierror.Error
+	first := g.outputs[0].kubernetesSecret()
+	keys := map[string]bool{}
+	for _, o := range g.outputs {
+		if o.kubernetesSecret().typeOrDefault() != first.typeOrDefault() {
+			result = multierror.Append(result, fmt.Errorf("%s: outputs disagree on the secret type", first))
+		}
+		if keys[o.Key] {
+			result = multierror.Append(result, fmt.Errorf("%s: key %s is written by more than one output", first, o.Key))
+		}
+		keys[o.Key] = true
+	}
+	if first.typeOrDefault() == kubernetes.SecretTypeTLS {
+		for _, required := range tlsSecretKeys {
+			if !keys[required] {
+				result = multierror.Append(result, fmt.Errorf("%s: no output writes %s, required for %s secrets", first, required, kubernetes.SecretTypeTLS))
+			}
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// write stores the data of every output in one request, with the labels and
+// annotations of all of them
+func (g *secretOutputs) write() error {
+	first := g.outputs[0].kubernetesSecret()
+	secret := &kubernetesSecret{
+		namespace:   first.namespace,
+		name:        first.name,
+		secretType:  first.secretType,
+		labels:      map[string]string{},
+		annotations: map[string]string{},
+	}
+	client, err := first.kubernetesClient()
+	if err != nil {
+		return fmt.Errorf("unable to configure kubernetes client: %v", err)
+	}
+	secret.client = client
+	for _, o := range g.outputs {
+		for k, v := range o.Labels {
+			secret.labels[k] = v
+		}
+		for k, v := range o.Annotations {
+			secret.annotations[k] = v
+		}
+	}
+	return secret.write(g.data)
+}
@@ -0,0 +1,278 @@
+package credentials
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/kubernetes"
+)
+
+// fakeKubernetesServer stores secrets in memory, applying merge patches like
+// the API server does.
+type fakeKubernetesServer struct {
+	*httptest.Server
+	lock    sync.Mutex
+	secrets map[string]*kubernetes.Secret
+	version int
+	// conflicts is the number of creates to reject before accepting one, as
+	// if another writer had created the secret first
+	conflicts int
+}
+
+func newFakeKubernetesServer(t *testing.T) *fakeKubernetesServer {
+	s := &fakeKubernetesServer{secrets: map[string]*kubernetes.Secret{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+		if len(parts) < 2 || parts[1] != "secrets" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		namespace := parts[0]
+
+		var secret *kubernetes.Secret
+		if r.Method == "PATCH" && r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			t.Errorf("Unexpected patch type: %s", r.Header.Get("Content-Type"))
+		}
+		if r.Method != "GET" {
+			secret = &kubernetes.Secret{}
+			if err := json.NewDecoder(r.Body).Decode(secret); err != nil {
+				t.Errorf("Unable to decode secret: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		status := http.StatusOK
+		switch {
+		case r.Method == "GET" && len(parts) == 3:
+			secret = s.secrets[namespace+"/"+parts[2]]
+			if secret == nil {
+				status = http.StatusNotFound
+			}
+		case r.Method == "POST" && len(parts) == 2:
+			if _, ok := s.secrets[namespace+"/"+secret.Metadata.Name]; ok || s.conflicts > 0 {
+				s.conflicts--
+				status = http.StatusConflict
+				break
+			}
+			s.store(namespace, secret)
+			status = http.StatusCreated
+		case r.Method == "PATCH" && len(parts) == 3:
+			existing := s.secrets[namespace+"/"+parts[2]]
+			if existing == nil {
+				status = http.StatusNotFound
+				break
+			}
+			if secret.Type != "" || secret.Metadata.ResourceVersion != "" {
+				t.Errorf("Patch should only contain data, labels and annotations: %v", secret)
+			}
+			existing.Metadata.Labels = mergeStrings(existing.Metadata.Labels, secret.Metadata.Labels)
+			existing.Metadata.Annotations = mergeStrings(existing.Metadata.Annotations, secret.Metadata.Annotations)
+			if existing.Data == nil {
+				existing.Data = map[string][]byte{}
+			}
+			for k, v := range secret.Data {
+				existing.Data[k] = v
+			}
+			s.store(namespace, existing)
+			secret = existing
+		default:
+			status = http.StatusMethodNotAllowed
+		}
+
+		w.WriteHeader(status)
+		if status >= 300 {
+			json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "code": status, "reason": http.StatusText(status)})
+			return
+		}
+		json.NewEncoder(w).Encode(secret)
+	}))
+	return s
+}
+
+func (s *fakeKubernetesServer) store(namespace string, secret *kubernetes.Secret) {
+	s.version++
+	secret.Metadata.Namespace = namespace
+	secret.Metadata.ResourceVersion = strconv.Itoa(s.version)
+	s.secrets[namespace+"/"+secret.Metadata.Name] = secret
+}
+
+func mergeStrings(existing, patch map[string]string) map[string]string {
+	if len(patch) > 0 && existing == nil {
+		existing = map[string]string{}
+	}
+	for k, v := range patch {
+		existing[k] = v
+	}
+	return existing
+}
+
+func (s *fakeKubernetesServer) secret(namespace, name string) *kubernetes.Secret {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.secrets[namespace+"/"+name]
+}
+
+func (s *fakeKubernetesServer) client() *kubernetes.Client {
+	return &kubernetes.Client{Host: s.URL, Namespace: "credmanager"}
+}
+
+// useFakeKubernetesServer points new kubernetes clients at server, returning
+// a function restoring the in-cluster client
+func useFakeKubernetesServer(server *fakeKubernetesServer) func() {
+	newKubernetesClient = func() (*kubernetes.Client, error) { return server.client(), nil }
+	return func() { newKubernetesClient = kubernetes.InClusterClient }
+}
+
+// kubernetesSecretOutput returns an output writing key to the named secret
+func kubernetesSecretOutput(name, key, secretType string) *Output {
+	return &Output{Type: "kubernetes_secret", OutputSink: &KubernetesSecretOutput{Name: name, Key: key, SecretType: secretType}}
+}
+
+func TestKubernetesSecretWrite(t *testing.T) {
+	server := newFakeKubernetesServer(t)
+	defer server.Close()
+	defer useFakeKubernetesServer(server)()
+
+	cert := &PKICertificate{
+		RoleName:                            "web",
+		BackendMountPoint:                   "pki",
+		CommonName:                          "web.local",
+		CertificateFile:                     kubernetesSecretOutput("web-tls", "tls.crt", kubernetes.SecretTypeTLS),
+		PrivateKeyFile:                      kubernetesSecretOutput("web-tls", "tls.key", kubernetes.SecretTypeTLS),
+		CertificateAuthorityCertificateFile: kubernetesSecretOutput("web-tls", "issuing-ca.crt", kubernetes.SecretTypeTLS),
+	}
+	cert.CertificateFile.OutputSink.(*KubernetesSecretOutput).Labels = map[string]string{"app": "web"}
+	cert.PrivateKeyFile.OutputSink.(*KubernetesSecretOutput).Annotations = map[string]string{"example.com/owner": "credmanager"}
+	if err := cert.Validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+
+	if err := cert.write("CA", "CERT", "KEY"); err != nil {
+		t.Fatalf("Unable to create secret: %v", err)
+	}
+	stored := server.secret("credmanager", "web-tls")
+	if stored == nil {
+		t.Fatalf("Secret not created in the client's namespace")
+	}
+	if server.version != 1 {
+		t.Errorf("Outputs sharing a secret should be written together, got %d writes", server.version)
+	}
+	if stored.Type != kubernetes.SecretTypeTLS {
+		t.Errorf("Wrong secret type: %s", stored.Type)
+	}
+	for key, expected := range map[string]string{"tls.crt": "CERT", "tls.key": "KEY", "issuing-ca.crt": "CA"} {
+		if string(stored.Data[key]) != expected {
+			t.Errorf("Wrong value for %s, expected '%s' got '%s'", key, expected, stored.Data[key])
+		}
+	}
+	if stored.Metadata.Labels["app"] != "web" || stored.Metadata.Annotations["example.com/owner"] != "credmanager" {
+		t.Errorf("Labels or annotations not set: %v %v", stored.Metadata.Labels, stored.Metadata.Annotations)
+	}
+
+	// keys and labels added by others are preserved
+	server.lock.Lock()
+	stored.Data["extra"] = []byte("extra")
+	stored.Metadata.Labels["team"] = "ops"
+	server.lock.Unlock()
+
+	if err := cert.write("CA", "NEWCERT", "NEWKEY"); err != nil {
+		t.Fatalf("Unable to update secret: %v", err)
+	}
+	stored = server.secret("credmanager", "web-tls")
+	if server.version != 2 {
+		t.Errorf("Outputs sharing a secret should be updated together, got %d writes", server.version)
+	}
+	if string(stored.Data["tls.crt"]) != "NEWCERT" || string(stored.Data["tls.key"]) != "NEWKEY" || string(stored.Data["extra"]) != "extra" {
+		t.Errorf("Secret not updated correctly: %v", stored.Data)
+	}
+	if stored.Metadata.Labels["team"] != "ops" {
+		t.Errorf("Existing labels not preserved: %v", stored.Metadata.Labels)
+	}
+
+	// a secret created concurrently is patched, repeated conflicts fail
+	secret := &kubernetesSecret{name: "other-tls", secretType: kubernetes.SecretTypeTLS, client: server.client()}
+	data := map[string]string{"tls.crt": "CERT", "tls.key": "KEY"}
+	server.lock.Lock()
+	server.conflicts = 1
+	server.lock.Unlock()
+	if err := secret.write(data); err != nil {
+		t.Fatalf("Unable to create secret after conflict: %v", err)
+	}
+	server.lock.Lock()
+	server.conflicts = 3
+	server.lock.Unlock()
+	secret.name = "third-tls"
+	if err := secret.write(data); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("Expected conflict error after retries: %v", err)
+	}
+}
+
+func TestKubernetesSecretTypeMismatch(t *testing.T) {
+	server := newFakeKubernetesServer(t)
+	defer server.Close()
+	defer useFakeKubernetesServer(server)()
+
+	opaque := kubernetesSecretOutput("host-cert", "certificate", "")
+	if err := opaque.Write("CERT"); err != nil {
+		t.Fatalf("Unable to create secret: %v", err)
+	}
+	if stored := server.secret("credmanager", "host-cert"); stored.Type != kubernetes.SecretTypeOpaque || string(stored.Data["certificate"]) != "CERT" {
+		t.Errorf("Wrong secret created: %v", stored)
+	}
+
+	err := writeOutputs(
+		outputContent{kubernetesSecretOutput("host-cert", "tls.crt", kubernetes.SecretTypeTLS), "CERT"},
+		outputContent{kubernetesSecretOutput("host-cert", "tls.key", kubernetes.SecretTypeTLS), "KEY"},
+	)
+	if err == nil {
+		t.Errorf("Expected error writing to a secret of a different type")
+	}
+}
+
+func TestKubernetesSecretValidate(t *testing.T) {
+	output := &KubernetesSecretOutput{SecretType: "bar"}
+	err := output.Validate()
+	if err == nil {
+		t.Fatalf("Expected validation errors")
+	}
+	for _, expected := range []string{"name is required", "key is required", "unsupported secret type"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s' in validation error: %v", expected, err)
+		}
+	}
+
+	// a tls secret can't hold a certificate without its key
+	ssh := &SSHHostCertificate{
+		PublicKeyFile:     "/test/ssh_host_rsa_key.pub",
+		RoleName:          "host",
+		BackendMountPoint: "ssh",
+		CertificateFile:   kubernetesSecretOutput("host-cert", "tls.crt", kubernetes.SecretTypeTLS),
+	}
+	if err := ssh.Validate(); err == nil || !strings.Contains(err.Error(), "no output writes tls.key") {
+		t.Errorf("Expected missing tls.key error: %v", err)
+	}
+
+	pki := &PKICertificate{
+		RoleName:                            "web",
+		BackendMountPoint:                   "pki",
+		CommonName:                          "web.local",
+		CertificateFile:                     kubernetesSecretOutput("web-tls", "tls.crt", kubernetes.SecretTypeTLS),
+		PrivateKeyFile:                      kubernetesSecretOutput("web-tls", "tls.crt", ""),
+		CertificateAuthorityCertificateFile: FileOutput(&CredentialFile{FilePath: "/test/ca.crt"}),
+	}
+	err = pki.Validate()
+	for _, expected := range []string{"disagree on the secret type", "key tls.crt is written by more than one output", "no output writes tls.key"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s' in validation error: %v", expected, err)
+		}
+	}
+}
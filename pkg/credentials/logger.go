@@ -0,0 +1,37 @@
+package credentials
+
+import (
+	"fmt"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+)
+
+var logger = logging.Default()
+
+// SetLogger sets the logger used for all credentials
+func SetLogger(l *logging.Logger) {
+	logger = l
+}
+
+// loggableCredential is implemented by credentials that can identify
+// themselves in log entries
+type loggableCredential interface {
+	logFields() logging.Fields
+}
+
+// credentialFields returns the fields identifying a credential in log entries,
+// using the configured name if there is one.
+func credentialFields(name, credType string, cred fmt.Stringer) logging.Fields {
+	if name == "" {
+		name = cred.String()
+	}
+	return logging.Fields{"credential": name, "type": credType}
+}
+
+// credentialLogger returns a logger that identifies cred in every entry
+func credentialLogger(cred fmt.Stringer) *logging.Logger {
+	if c, ok := cred.(loggableCredential); ok {
+		return logger.With(c.logFields())
+	}
+	return logger.With(logging.Fields{"credential": cred.String()})
+}
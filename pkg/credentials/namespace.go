@@ -0,0 +1,30 @@
+package credentials
+
+import (
+	vault "github.com/hashicorp/vault/api"
+)
+
+// namespacedClient returns vaultClient, or a copy of it that sends requests to
+// namespace if one is set.  The shared client is never modified, and copies are
+// made for each use so that they pick up changes to the shared client's token.
+func namespacedClient(vaultClient *vault.Client, namespace string) (*vault.Client, error) {
+	if namespace == "" {
+		return vaultClient, nil
+	}
+	return copyClient(vaultClient, namespace)
+}
+
+// copyClient returns a copy of vaultClient with the same token and headers,
+// sending requests to namespace if one is set.
+func copyClient(vaultClient *vault.Client, namespace string) (*vault.Client, error) {
+	client, err := vaultClient.Clone()
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(vaultClient.Token())
+	client.SetHeaders(vaultClient.Headers())
+	if namespace != "" {
+		client.SetNamespace(namespace)
+	}
+	return client, nil
+}
@@ -0,0 +1,52 @@
+package credentials
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+func TestNamespacedClient(t *testing.T) {
+	var namespace, token string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		namespace = r.Header.Get("X-Vault-Namespace")
+		token = r.Header.Get("X-Vault-Token")
+		w.Write([]byte(`{"data": {}}`))
+	}))
+	defer server.Close()
+
+	config := vault.DefaultConfig()
+	config.Address = server.URL
+	vaultClient, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	vaultClient.SetToken("shared-token")
+	vaultClient.SetNamespace("global")
+
+	client, err := namespacedClient(vaultClient, "team")
+	if err != nil {
+		t.Fatalf("Unable to create namespaced client: %v", err)
+	}
+
+	if _, err := client.Logical().Read("secret/foo"); err != nil {
+		t.Fatalf("Unexpected error reading from namespaced client: %v", err)
+	}
+	if namespace != "team" || token != "shared-token" {
+		t.Errorf("Unexpected headers from namespaced client: namespace '%s', token '%s'", namespace, token)
+	}
+
+	if _, err := vaultClient.Logical().Read("secret/foo"); err != nil {
+		t.Fatalf("Unexpected error reading from shared client: %v", err)
+	}
+	if namespace != "global" {
+		t.Errorf("Shared client namespace was modified: %s", namespace)
+	}
+
+	client, err = namespacedClient(vaultClient, "")
+	if err != nil || client != vaultClient {
+		t.Errorf("Expected shared client to be used when no namespace is set")
+	}
+}
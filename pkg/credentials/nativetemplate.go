@@ -0,0 +1,484 @@
+package credentials
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	multierror "github.com/hashicorp/go-multierror"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// NativeTemplate renders a text/template to a credential file without
+// consul-template.  The vault paths read while rendering are tracked, and the
+// template is rendered again when a lease used by it nears expiry or when the
+// data at a path without a lease changes.
+//
+// Templates may use the following functions:
+//
+//	secret "path" ["key=value" ...]     reads path, or writes the key/value pairs to it, returning the secret
+//	pkiCert "pki/issue/role" "key=value" ...  issues a certificate, returning the response data
+//	kv "mount" "path"                   reads the data at path from a version 2 kv mount
+//	file "path"                         returns the contents of a local file
+//	env "NAME"                          returns an environment variable
+//	base64 "value"                      base64 encodes value
+//	toJSON value                        encodes value as json
+//	envQuote "value"                    double quotes value for an environment file
+//	envFile "NAME" "value" ...          formats name/value pairs as an environment file
+type NativeTemplate struct {
+	Name         string  `yaml:"name"`
+	TemplateFile string  `yaml:"template_file"`
+	Contents     string  `yaml:"contents"`
+	OutputFile   *Output `yaml:"output_file"`
+	// CheckInterval is how often paths without a lease are checked for changes
+	CheckInterval time.Duration `yaml:"check_interval"`
+	// Namespace overrides the vault namespace of the daemon's client
+	Namespace   string       `yaml:"namespace"`
+	Notifies    string       `yaml:"notifies"`
+	HealthCheck *HealthCheck `yaml:"health_check"`
+	vaultClient *vault.Client
+	renewer     *CredentialRenewer
+	// dependencies of the last render, replaced by the renewer and read by
+	// Expiration from other goroutines
+	dependencyLock sync.Mutex
+	dependencies   []*templateDependency
+	// dependencies of the renders replaced since the last commit, their leases
+	// are revoked once the consumer is using the new render
+	superseded [][]*templateDependency
+}
+
+// templateDependency is a vault path or file read by the last render of a
+// native template
+type templateDependency struct {
+	description string
+	// renewAt is when the lease used by the render nears expiry, zero if there
+	// is no lease
+	renewAt    time.Time
+	expiration time.Time
+	// leaseID is revoked once a later render replaces the lease
+	leaseID string
+	// changed reports whether the data read during the render has changed, nil
+	// if the data can't be checked without side effects
+	changed func(*vault.Client) (bool, error)
+}
+
+// leased records the lease of a dependency, rendering again after two thirds
+// of the lease duration
+func (d *templateDependency) leased(issued time.Time, duration time.Duration) {
+	d.expiration = issued.Add(duration)
+	d.renewAt = issued.Add(duration * 2 / 3)
+}
+
+func (t *NativeTemplate) Initialize(vaultClient *vault.Client) error {
+	t.setup(vaultClient)
+	t.renewer.Renew()
+	return nil
+}
+
+// IssueOnce renders the template without starting a renewal process
+func (t *NativeTemplate) IssueOnce(vaultClient *vault.Client, maxAttempts uint, runAction bool) error {
+	t.setup(vaultClient)
+	return t.renewer.RenewOnce(maxAttempts, runAction)
+}
+
+func (t *NativeTemplate) setup(vaultClient *vault.Client) {
+	t.vaultClient = vaultClient
+	useVaultClient(vaultClient, t.Files()...)
+	t.renewer = NewCredentialRenewer(t, notifyAction(t.Notifies, t.OutputFile))
+	t.renewer.HealthCheck = t.HealthCheck
+}
+
+// source returns the template text
+func (t *NativeTemplate) source() (string, error) {
+	if t.Contents != "" {
+		return t.Contents, nil
+	}
+	contents, err := ioutil.ReadFile(t.TemplateFile)
+	return string(contents), err
+}
+
+// parse parses the template using funcs
+func (t *NativeTemplate) parse(funcs template.FuncMap) (*template.Template, error) {
+	source, err := t.source()
+	if err != nil {
+		return nil, err
+	}
+	return template.New(t.String()).Option("missingkey=error").Funcs(funcs).Parse(source)
+}
+
+// NeedsRenewal returns true if the template hasn't been rendered, the output
+// is missing or empty, a lease used
+// by the last render nears expiry or any checked dependency changed.  A
+// dependency that can't be checked is logged and treated as unchanged, since
+// rendering again issues new leases for everything the template uses.
+func (t *NativeTemplate) NeedsRenewal() (bool, error) {
+	dependencies := t.renderDependencies()
+	if dependencies == nil {
+		return true, nil
+	}
+	if contents, err := t.OutputFile.Read(); os.IsNotExist(err) || (err == nil && contents == "") {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	client, err := namespacedClient(t.vaultClient, t.Namespace)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	for _, d := range dependencies {
+		if !d.renewAt.IsZero() && now.After(d.renewAt) {
+			credentialLogger(t).Debug("dependency_expiring", "Lease used by template nears expiry", logging.Fields{"dependency": d.description})
+			return true, nil
+		}
+		if d.changed == nil {
+			continue
+		}
+		changed, err := d.changed(client)
+		if err != nil {
+			credentialLogger(t).Warn("dependency_check_failed", "Unable to check data used by template, keeping the current render", logging.Fields{"dependency": d.description, "error": err})
+			continue
+		}
+		if changed {
+			credentialLogger(t).Debug("dependency_changed", "Data used by template changed", logging.Fields{"dependency": d.description})
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Renew renders the template and writes the output file
+func (t *NativeTemplate) Renew() error {
+	client, err := namespacedClient(t.vaultClient, t.Namespace)
+	if err != nil {
+		return err
+	}
+
+	render := &templateRender{client: client}
+	tmpl, err := t.parse(render.funcs())
+	if err != nil {
+		return err
+	}
+
+	var output bytes.Buffer
+	if err := tmpl.Execute(&output, nil); err != nil {
+		return err
+	}
+	if err := t.OutputFile.Write(output.String()); err != nil {
+		return err
+	}
+
+	if render.dependencies == nil {
+		// rendered without reading anything that needs to be tracked
+		render.dependencies = []*templateDependency{}
+	}
+	t.dependencyLock.Lock()
+	t.superseded = append(t.superseded, t.dependencies)
+	t.dependencies = render.dependencies
+	t.dependencyLock.Unlock()
+
+	descriptions := make([]string, 0, len(render.dependencies))
+	for _, d := range render.dependencies {
+		descriptions = append(descriptions, d.description)
+	}
+	credentialLogger(t).Debug("template_dependencies", "Rendered template", logging.Fields{"dependencies": strings.Join(descriptions, ",")})
+	return nil
+}
+
+// Commit revokes the leases used by previous renders, they are no longer used
+// once the consumer has picked up the new render
+func (t *NativeTemplate) Commit() error {
+	client, err := namespacedClient(t.vaultClient, t.Namespace)
+	if err != nil {
+		return err
+	}
+
+	t.dependencyLock.Lock()
+	superseded := t.superseded
+	t.superseded = nil
+	t.dependencyLock.Unlock()
+
+	for _, dependencies := range superseded {
+		t.revokeLeases(client, dependencies)
+	}
+	return nil
+}
+
+// Rollback revokes the leases of the render rejected by the health check and
+// goes back to tracking the dependencies of the restored render
+func (t *NativeTemplate) Rollback() error {
+	client, err := namespacedClient(t.vaultClient, t.Namespace)
+	if err != nil {
+		return err
+	}
+
+	t.dependencyLock.Lock()
+	rejected := t.dependencies
+	if last := len(t.superseded) - 1; last >= 0 {
+		t.dependencies, t.superseded = t.superseded[last], t.superseded[:last]
+	}
+	t.dependencyLock.Unlock()
+
+	t.revokeLeases(client, rejected)
+	return nil
+}
+
+// revokeLeases revokes the leases used by a render that is no longer in use
+func (t *NativeTemplate) revokeLeases(client *vault.Client, dependencies []*templateDependency) {
+	for _, d := range dependencies {
+		if d.leaseID == "" {
+			continue
+		}
+		if err := client.Sys().Revoke(d.leaseID); err != nil {
+			credentialLogger(t).Warn("revoke_failed", "Unable to revoke lease of previous render", logging.Fields{"dependency": d.description, "error": err})
+		}
+	}
+}
+
+// renderDependencies returns the dependencies of the last render, nil if the
+// template hasn't been rendered
+func (t *NativeTemplate) renderDependencies() []*templateDependency {
+	t.dependencyLock.Lock()
+	defer t.dependencyLock.Unlock()
+	return t.dependencies
+}
+
+// templateRender tracks the dependencies of a single render of a template
+type templateRender struct {
+	client       *vault.Client
+	dependencies []*templateDependency
+}
+
+func (r *templateRender) funcs() template.FuncMap {
+	return template.FuncMap{
+		"secret":   r.secret,
+		"pkiCert":  r.pkiCert,
+		"kv":       r.kv,
+		"file":     r.file,
+		"env":      os.Getenv,
+		"base64":   func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"toJSON":   toJSON,
+		"envQuote": envQuote,
+		"envFile":  envFile,
+	}
+}
+
+// secret reads path, or writes the key=value pairs in args to it
+func (r *templateRender) secret(path string, args ...string) (*vault.Secret, error) {
+	d := &templateDependency{description: fmt.Sprintf("secret %s", path)}
+	issued := time.Now()
+
+	var secret *vault.Secret
+	var err error
+	if len(args) > 0 {
+		data, parseErr := keyValueArgs(args)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		secret, err = r.client.Logical().Write(path, data)
+	} else {
+		secret, err = r.client.Logical().Read(path)
+		if err == nil && secret != nil {
+			previous := secret.Data
+			d.changed = func(client *vault.Client) (bool, error) {
+				current, err := client.Logical().Read(path)
+				if err != nil || current == nil {
+					return true, err
+				}
+				return !reflect.DeepEqual(current.Data, previous), nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("no secret found at %s", path)
+	}
+
+	if secret.LeaseID != "" && secret.LeaseDuration > 0 {
+		// reading a leased secret again issues a new one, so it is only
+		// replaced when the lease nears expiry
+		d.leased(issued, time.Duration(secret.LeaseDuration)*time.Second)
+		d.leaseID = secret.LeaseID
+		d.changed = nil
+	}
+	r.dependencies = append(r.dependencies, d)
+	return secret, nil
+}
+
+// pkiCert issues a certificate, rendering again before it expires
+func (r *templateRender) pkiCert(path string, args ...string) (map[string]interface{}, error) {
+	data, err := keyValueArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	issued := time.Now()
+	secret, err := r.client.Logical().Write(path, data)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("no certificate returned by %s", path)
+	}
+
+	expiration, err := jsonInt(secret.Data["expiration"])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse certificate expiration from %s: %v", path, err)
+	}
+	d := &templateDependency{description: fmt.Sprintf("pkiCert %s", path), leaseID: secret.LeaseID}
+	d.leased(issued, time.Unix(expiration, 0).Sub(issued))
+	r.dependencies = append(r.dependencies, d)
+	return secret.Data, nil
+}
+
+// kv reads the current version of path from a version 2 kv mount
+func (r *templateRender) kv(mount, path string) (map[string]interface{}, error) {
+	mount = strings.Trim(mount, "/")
+	path = strings.Trim(path, "/")
+	secret, err := r.client.Logical().Read(fmt.Sprintf("%s/data/%s", mount, path))
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("no data found at %s/%s", mount, path)
+	}
+	data, _ := secret.Data["data"].(map[string]interface{})
+	if data == nil {
+		return nil, fmt.Errorf("no data found at %s/%s", mount, path)
+	}
+
+	metadata, _ := secret.Data["metadata"].(map[string]interface{})
+	version, err := jsonInt(metadata["version"])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse version of %s/%s: %v", mount, path, err)
+	}
+
+	metadataPath := fmt.Sprintf("%s/metadata/%s", mount, path)
+	r.dependencies = append(r.dependencies, &templateDependency{
+		description: fmt.Sprintf("kv %s/%s", mount, path),
+		changed: func(client *vault.Client) (bool, error) {
+			current, err := client.Logical().Read(metadataPath)
+			if err != nil || current == nil || current.Data == nil {
+				return true, err
+			}
+			currentVersion, err := jsonInt(current.Data["current_version"])
+			return currentVersion != version, err
+		},
+	})
+	return data, nil
+}
+
+// file returns the contents of a local file
+func (r *templateRender) file(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	r.dependencies = append(r.dependencies, &templateDependency{
+		description: fmt.Sprintf("file %s", path),
+		changed: func(*vault.Client) (bool, error) {
+			current, err := ioutil.ReadFile(path)
+			if err != nil {
+				return true, nil
+			}
+			return !bytes.Equal(current, contents), nil
+		},
+	})
+	return string(contents), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	encoded, err := json.Marshal(v)
+	return string(encoded), err
+}
+
+// keyValueArgs converts key=value template arguments to request data
+func keyValueArgs(args []string) (map[string]interface{}, error) {
+	data := make(map[string]interface{}, len(args))
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid argument '%s', expected key=value", arg)
+		}
+		data[parts[0]] = parts[1]
+	}
+	return data, nil
+}
+
+// Validate checks that all required fields are set and that the template parses
+func (t *NativeTemplate) Validate() error {
+	var result *multierror.Error
+	if (t.TemplateFile == "") == (t.Contents == "") {
+		result = multierror.Append(result, fmt.Errorf("exactly one of template_file or contents is required"))
+	}
+	result = multierror.Append(result,
+		requireOutput("output_file", t.OutputFile),
+		validateOutputs(t.OutputFile),
+	)
+	if t.HealthCheck != nil {
+		result = multierror.Append(result, multierror.Prefix(t.HealthCheck.Validate(), "health_check:"))
+	}
+	if result.ErrorOrNil() != nil {
+		return result.ErrorOrNil()
+	}
+
+	// the functions aren't called while parsing
+	if _, err := t.parse((&templateRender{}).funcs()); err != nil {
+		result = multierror.Append(result, err)
+	}
+	return result.ErrorOrNil()
+}
+
+func (t *NativeTemplate) Stop() {
+	t.renewer.Stop()
+}
+
+// MaxRenewInterval returns how often the template's dependencies are checked
+func (t *NativeTemplate) MaxRenewInterval() time.Duration {
+	if t.CheckInterval <= 0 {
+		return 5 * time.Minute
+	}
+	return t.CheckInterval
+}
+
+// Expiration returns the time the first lease used by the last render expires
+func (t *NativeTemplate) Expiration() time.Time {
+	var expiration time.Time
+	for _, d := range t.renderDependencies() {
+		if !d.expiration.IsZero() && (expiration.IsZero() || d.expiration.Before(expiration)) {
+			expiration = d.expiration
+		}
+	}
+	return expiration
+}
+
+// Files returns the output file if it is a local file
+func (t *NativeTemplate) Files() []*CredentialFile {
+	return outputFiles(t.OutputFile)
+}
+
+func (t *NativeTemplate) Renewer() Renewer {
+	return t.renewer
+}
+
+func (t *NativeTemplate) logFields() logging.Fields {
+	return credentialFields(t.Name, "native_template", t)
+}
+
+func (t *NativeTemplate) String() string {
+	return fmt.Sprintf("Native template for: %s", t.OutputFile.Path())
+}
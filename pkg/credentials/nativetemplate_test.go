@@ -0,0 +1,258 @@
+package credentials
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// fakeTemplateServer emulates a version 2 kv mount at secret, a database
+// secrets engine and a pki role.
+type fakeTemplateServer struct {
+	*httptest.Server
+	lock          sync.Mutex
+	kvVersion     int
+	leaseDuration int
+	issued        int
+	revoked       []string
+	// unavailable makes the kv mount return server errors
+	unavailable bool
+}
+
+func newFakeTemplateServer(t *testing.T) *fakeTemplateServer {
+	s := &fakeTemplateServer{kvVersion: 1, leaseDuration: 3600}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		var response map[string]interface{}
+		if s.unavailable && strings.HasPrefix(r.URL.Path, "/v1/secret/") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/v1/sys/leases/revoke/") {
+			s.revoked = append(s.revoked, strings.TrimPrefix(r.URL.Path, "/v1/sys/leases/revoke/"))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/app":
+			response = map[string]interface{}{"data": map[string]interface{}{
+				"data":     map[string]interface{}{"password": "hunter2"},
+				"metadata": map[string]interface{}{"version": s.kvVersion},
+			}}
+		case "/v1/secret/metadata/app":
+			response = map[string]interface{}{"data": map[string]interface{}{"current_version": s.kvVersion}}
+		case "/v1/database/creds/app":
+			s.issued++
+			response = map[string]interface{}{
+				"lease_id":       fmt.Sprintf("database/creds/app/%d", s.issued),
+				"lease_duration": s.leaseDuration,
+				"renewable":      true,
+				"data":           map[string]interface{}{"username": "app-user"},
+			}
+		case "/v1/pki/issue/web":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["common_name"] != "foo.local" {
+				t.Errorf("Wrong common name requested: %v", body["common_name"])
+			}
+			response = map[string]interface{}{"data": map[string]interface{}{
+				"certificate": "CERT",
+				"expiration":  time.Now().Add(time.Hour).Unix(),
+			}}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	return s
+}
+
+func (s *fakeTemplateServer) revokedLeases() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.revoked...)
+}
+
+func (s *fakeTemplateServer) set(kvVersion, leaseDuration int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.kvVersion = kvVersion
+	s.leaseDuration = leaseDuration
+}
+
+func TestNativeTemplateRender(t *testing.T) {
+	server := newFakeTemplateServer(t)
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "nativetemplatetest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	localFile := filepath.Join(tempDir, "local")
+	if err := ioutil.WriteFile(localFile, []byte("local"), 0600); err != nil {
+		t.Fatalf("Unable to write local file: %v", err)
+	}
+	os.Setenv("CREDMANAGER_TEST_ENV", "env")
+	defer os.Unsetenv("CREDMANAGER_TEST_ENV")
+
+	config := vault.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	vaultClient, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	vaultClient.SetToken("test-token")
+
+	outFile := &CredentialFile{FilePath: filepath.Join(tempDir, "out"), Mode: 0600}
+	tmpl := &NativeTemplate{
+		Contents: `{{ with kv "secret" "app" }}{{ .password }}{{ end }}
+{{ with secret "database/creds/app" }}{{ .Data.username }}{{ end }}
+{{ with pkiCert "pki/issue/web" "common_name=foo.local" }}{{ .certificate }}{{ end }}
+{{ file "` + localFile + `" }} {{ env "CREDMANAGER_TEST_ENV" }} {{ base64 "foo" }} {{ toJSON (kv "secret" "app") }}`,
+		OutputFile: FileOutput(outFile),
+	}
+	if err := tmpl.Validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+	tmpl.setup(vaultClient)
+
+	if needed, err := tmpl.NeedsRenewal(); err != nil || !needed {
+		t.Errorf("Template should need rendering before the first render: %t, %v", needed, err)
+	}
+
+	if err := tmpl.Renew(); err != nil {
+		t.Fatalf("Unable to render template: %v", err)
+	}
+	expected := "hunter2\napp-user\nCERT\nlocal env Zm9v {\"password\":\"hunter2\"}"
+	if contents, _ := outFile.Read(); contents != expected {
+		t.Errorf("Wrong contents rendered, expected '%s' got '%s'", expected, contents)
+	}
+	if len(tmpl.dependencies) != 5 {
+		t.Errorf("Expected 5 dependencies, got %d", len(tmpl.dependencies))
+	}
+	if remaining := time.Until(tmpl.Expiration()); remaining < 59*time.Minute || remaining > time.Hour {
+		t.Errorf("Wrong expiration for rendered template: %s", tmpl.Expiration())
+	}
+
+	if needed, err := tmpl.NeedsRenewal(); err != nil || needed {
+		t.Errorf("Template shouldn't need rendering without changes: %t, %v", needed, err)
+	}
+
+	// data that can't be checked keeps the current render
+	server.lock.Lock()
+	server.unavailable = true
+	server.lock.Unlock()
+	if needed, err := tmpl.NeedsRenewal(); err != nil || needed {
+		t.Errorf("Template shouldn't need rendering when vault is unavailable: %t, %v", needed, err)
+	}
+	server.lock.Lock()
+	server.unavailable = false
+	server.lock.Unlock()
+
+	// a new kv version is picked up
+	server.set(2, 1)
+	if needed, err := tmpl.NeedsRenewal(); err != nil || !needed {
+		t.Errorf("Template should need rendering after kv change: %t, %v", needed, err)
+	}
+
+	// a short lease is replaced once two thirds of it have passed, the lease of
+	// the previous render is revoked once the new render is committed
+	if err := tmpl.Renew(); err != nil {
+		t.Fatalf("Unable to render template: %v", err)
+	}
+	if revoked := server.revokedLeases(); len(revoked) != 0 {
+		t.Errorf("Lease of previous render revoked before commit: %v", revoked)
+	}
+	if err := tmpl.Commit(); err != nil {
+		t.Fatalf("Unable to commit render: %v", err)
+	}
+	if revoked := server.revokedLeases(); len(revoked) != 1 || revoked[0] != "database/creds/app/1" {
+		t.Errorf("Lease of previous render not revoked: %v", revoked)
+	}
+	if needed, err := tmpl.NeedsRenewal(); err != nil || needed {
+		t.Errorf("Template shouldn't need rendering right after render: %t, %v", needed, err)
+	}
+	time.Sleep(700 * time.Millisecond)
+	if needed, err := tmpl.NeedsRenewal(); err != nil || !needed {
+		t.Errorf("Template should need rendering when lease nears expiry: %t, %v", needed, err)
+	}
+
+	// a render rejected by the health check has its lease revoked, the restored
+	// render's dependencies are tracked again
+	if err := tmpl.Renew(); err != nil {
+		t.Fatalf("Unable to render template: %v", err)
+	}
+	if err := tmpl.Rollback(); err != nil {
+		t.Fatalf("Unable to roll back render: %v", err)
+	}
+	if revoked := server.revokedLeases(); len(revoked) != 2 || revoked[1] != "database/creds/app/3" {
+		t.Errorf("Lease of rejected render not revoked: %v", revoked)
+	}
+	if needed, err := tmpl.NeedsRenewal(); err != nil || !needed {
+		t.Errorf("Restored render with an expiring lease should need rendering: %t, %v", needed, err)
+	}
+}
+
+func TestNativeTemplateNonFileOutput(t *testing.T) {
+	server := newFakeTemplateServer(t)
+	defer server.Close()
+
+	config := vault.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	vaultClient, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	vaultClient.SetToken("test-token")
+
+	output := &MemoryOutput{Name: "password"}
+	tmpl := &NativeTemplate{
+		Contents:   `{{ with kv "secret" "app" }}{{ .password }}{{ end }}`,
+		OutputFile: &Output{Type: "memory", OutputSink: output},
+	}
+	tmpl.setup(vaultClient)
+
+	if err := tmpl.Renew(); err != nil {
+		t.Fatalf("Unable to render template: %v", err)
+	}
+	if needed, err := tmpl.NeedsRenewal(); err != nil || needed {
+		t.Errorf("Template written to memory shouldn't need rendering without changes: %t, %v", needed, err)
+	}
+
+	output.Write("")
+	if needed, err := tmpl.NeedsRenewal(); err != nil || !needed {
+		t.Errorf("Template should need rendering after its output was emptied: %t, %v", needed, err)
+	}
+}
+
+func TestNativeTemplateValidate(t *testing.T) {
+	tmpl := &NativeTemplate{
+		Contents:   `{{ with secret "kv/foo" }}{{ .Data.value }}`,
+		OutputFile: FileOutput(&CredentialFile{FilePath: "/test/foo"}),
+	}
+	if err := tmpl.Validate(); err == nil || !strings.Contains(err.Error(), "unexpected EOF") {
+		t.Errorf("Expected parse error: %v", err)
+	}
+
+	tmpl.TemplateFile = "/test/foo.tmpl"
+	if err := tmpl.Validate(); err == nil || !strings.Contains(err.Error(), "exactly one of template_file or contents") {
+		t.Errorf("Expected error with both template_file and contents: %v", err)
+	}
+}
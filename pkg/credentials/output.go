@@ -0,0 +1,332 @@
+package credentials
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	multierror "github.com/hashicorp/go-multierror"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// OutputSink is a destination for a single credential output, such as a
+// certificate or token.
+type OutputSink interface {
+	// Write replaces the contents of the output
+	Write(content string) error
+	// Read returns the current contents.  Outputs backed by files return an
+	// error satisfying os.IsNotExist if they haven't been written yet, others
+	// return an empty string.
+	Read() (string, error)
+	// Path identifies the destination in log messages and status output
+	Path() string
+	// Validate checks the configuration of the output
+	Validate() error
+	// String describes the output
+	String() string
+}
+
+// outputTypes creates an empty sink for each type of output block.  New
+// destinations only need to be registered here to be available to every
+// credential that writes its outputs with Output.
+var outputTypes = map[string]func() OutputSink{
+	"file":               func() OutputSink { return &CredentialFile{} },
+	"tmpfs":              func() OutputSink { return &TmpfsFile{} },
+	"stdout":             func() OutputSink { return &StdoutOutput{} },
+	"kubernetes_secret":  func() OutputSink { return &KubernetesSecretOutput{} },
+	"memory":             func() OutputSink { return &MemoryOutput{} },
+	"env_file":           func() OutputSink { return &EnvFileOutput{} },
+	"systemd_credential": func() OutputSink { return &SystemdCredentialOutput{} },
+}
+
+// defaultOutputType is used for output blocks without a type, keeping
+// configurations written for CredentialFile valid
+const defaultOutputType = "file"
+
+// Output is an output block of a credential.  The type key selects the sink,
+// the remaining keys configure it.
+type Output struct {
+	Type string
+	OutputSink
+}
+
+// FileOutput returns an output that writes to f
+func FileOutput(f *CredentialFile) *Output {
+	return &Output{Type: "file", OutputSink: f}
+}
+
+// UnmarshalYAML creates the sink selected by the type key and unmarshals the
+// rest of the block into it.  Unknown keys are rejected since they are most
+// likely settings of a different output type.
+func (o *Output) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var block map[string]interface{}
+	if err := unmarshal(&block); err != nil {
+		return err
+	}
+
+	outputType, _ := block["type"].(string)
+	delete(block, "type")
+	if outputType == "" {
+		outputType = defaultOutputType
+	}
+	newSink, ok := outputTypes[outputType]
+	if !ok {
+		return fmt.Errorf("unknown output type '%s', expected one of %s", outputType, strings.Join(OutputTypes(), ", "))
+	}
+
+	serialized, err := yaml.Marshal(block)
+	if err != nil {
+		return err
+	}
+	sink := newSink()
+	if err := yaml.UnmarshalStrict(serialized, sink); err != nil {
+		return fmt.Errorf("invalid %s output: %v", outputType, err)
+	}
+	o.Type, o.OutputSink = outputType, sink
+	return nil
+}
+
+// MarshalYAML serializes the type followed by the settings of the sink
+func (o *Output) MarshalYAML() (interface{}, error) {
+	serialized, err := yaml.Marshal(o.OutputSink)
+	if err != nil {
+		return nil, err
+	}
+	var settings yaml.MapSlice
+	if err := yaml.Unmarshal(serialized, &settings); err != nil {
+		return nil, err
+	}
+	return append(yaml.MapSlice{{Key: "type", Value: o.Type}}, settings...), nil
+}
+
+// File returns the local file written by the output, or nil if the output
+// isn't written to a local file
+func (o *Output) File() *CredentialFile {
+	if o == nil {
+		return nil
+	}
+	switch sink := o.OutputSink.(type) {
+	case *CredentialFile:
+		return sink
+	case *TmpfsFile:
+		return &sink.CredentialFile
+	case *EnvFileOutput:
+		return &sink.CredentialFile
+	}
+	return nil
+}
+
+// startupOutput is implemented by outputs that units only read when they
+// start, such as environment files
+type startupOutput interface {
+	readOnStart() bool
+}
+
+// notifyAction returns the action notifying unit of renewed outputs, or nil if
+// no unit is set.  The unit is restarted if it only reads one of the outputs
+// when starting, otherwise it is reloaded if it supports reloading.
+func notifyAction(unit string, outputs ...*Output) PostRenewAction {
+	if unit == "" {
+		return nil
+	}
+	for _, o := range outputs {
+		if o == nil {
+			continue
+		}
+		if s, ok := o.OutputSink.(startupOutput); ok && s.readOnStart() {
+			return &RestartSystemdUnit{UnitName: unit}
+		}
+	}
+	return &ReloadOrRestartSystemdUnit{UnitName: unit}
+}
+
+// remove deletes the output if the sink supports it, otherwise the output is
+// emptied
+func (o *Output) remove() error {
+	if r, ok := o.OutputSink.(interface{ Remove() error }); ok {
+		return r.Remove()
+	}
+	return o.Write("")
+}
+
+// OutputTypes returns the names of the supported output types
+func OutputTypes() []string {
+	types := make([]string, 0, len(outputTypes))
+	for t := range outputTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// outputFiles returns the local files of outputs, for backups and encryption
+func outputFiles(outputs ...*Output) []*CredentialFile {
+	files := make([]*CredentialFile, 0, len(outputs))
+	for _, o := range outputs {
+		if f := o.File(); f != nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// outputContent is content to be written to an output
+type outputContent struct {
+	output  *Output
+	content string
+}
+
+// writeOutputs writes each content to its output, skipping unset outputs.
+// Outputs stored in the same kubernetes secret are written in a single request
+// so the secret never holds a certificate without its key.
+func writeOutputs(contents ...outputContent) error {
+	set := make([]outputContent, 0, len(contents))
+	for _, c := range contents {
+		if c.output != nil && c.output.OutputSink != nil {
+			set = append(set, c)
+		}
+	}
+
+	for _, c := range set {
+		if _, ok := c.output.OutputSink.(*KubernetesSecretOutput); ok {
+			continue
+		}
+		if err := c.output.Write(c.content); err != nil {
+			return err
+		}
+	}
+	for _, group := range groupSecretOutputs(set) {
+		if err := group.write(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateOutputs checks outputs that are only valid together, such as the
+// outputs sharing a kubernetes secret
+func validateOutputs(outputs ...*Output) error {
+	contents := make([]outputContent, 0, len(outputs))
+	for _, o := range outputs {
+		if o != nil && o.OutputSink != nil {
+			contents = append(contents, outputContent{output: o})
+		}
+	}
+	var result *multierror.Error
+	for _, group := range groupSecretOutputs(contents) {
+		result = multierror.Append(result, group.validate())
+	}
+	return result.ErrorOrNil()
+}
+
+// requireOutput returns an error if a required output is missing or invalid
+func requireOutput(name string, o *Output) error {
+	if o == nil || o.OutputSink == nil {
+		return fmt.Errorf("%s is required", name)
+	}
+	return multierror.Prefix(o.Validate(), fmt.Sprintf("%s:", name))
+}
+
+// TmpfsFile is a credential file that is only written if its directory is on
+// a memory backed filesystem, so the credential never reaches a disk.
+type TmpfsFile struct {
+	CredentialFile `yaml:",inline"`
+}
+
+// Write writes the file after checking the filesystem it is written to
+func (f *TmpfsFile) Write(content string) error {
+	if err := requireTmpfs(f.Path()); err != nil {
+		return err
+	}
+	return f.CredentialFile.Write(content)
+}
+
+func (f *TmpfsFile) String() string {
+	return fmt.Sprintf("tmpfs file %s", f.Path())
+}
+
+// StdoutOutput prints the output to stdout, for use with the once command
+// where the output is consumed by the invoking process.
+type StdoutOutput struct {
+	lock     sync.Mutex
+	writer   io.Writer
+	contents string
+}
+
+// Write prints content, followed by a newline if it doesn't end with one
+func (s *StdoutOutput) Write(content string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w := s.writer
+	if w == nil {
+		w = os.Stdout
+	}
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		return err
+	}
+	s.contents = content
+	return nil
+}
+
+// Read returns the last content printed
+func (s *StdoutOutput) Read() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.contents, nil
+}
+
+// Remove does nothing, printed output can't be taken back
+func (s *StdoutOutput) Remove() error {
+	return nil
+}
+
+func (s *StdoutOutput) Path() string {
+	return "stdout"
+}
+
+func (s *StdoutOutput) Validate() error {
+	return nil
+}
+
+func (s *StdoutOutput) String() string {
+	return "stdout"
+}
+
+// MemoryOutput keeps the output in memory, it is lost when credmanager exits
+type MemoryOutput struct {
+	// Name identifies the output in log messages
+	Name     string `yaml:"name"`
+	lock     sync.Mutex
+	contents string
+}
+
+func (m *MemoryOutput) Write(content string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.contents = content
+	return nil
+}
+
+func (m *MemoryOutput) Read() (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.contents, nil
+}
+
+func (m *MemoryOutput) Path() string {
+	return "memory:" + m.Name
+}
+
+func (m *MemoryOutput) Validate() error {
+	return nil
+}
+
+func (m *MemoryOutput) String() string {
+	return fmt.Sprintf("in-memory output %s", m.Name)
+}
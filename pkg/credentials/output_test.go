@@ -0,0 +1,121 @@
+package credentials
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/kubernetes"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestOutputUnmarshalYAML(t *testing.T) {
+	config := `name: web
+certificate_file:
+  path: /test/host.crt
+  mode: 0644
+private_key_file:
+  type: kubernetes_secret
+  namespace: web
+  name: web-tls
+  secret_type: kubernetes.io/tls
+  type_: ignored
+ca_cert_file:
+  type: memory
+  name: ca
+`
+	cert := &PKICertificate{}
+	if err := yaml.UnmarshalStrict([]byte(config), cert); err == nil || !strings.Contains(err.Error(), "type_") {
+		t.Errorf("Expected error for unknown key in output block: %v", err)
+	}
+
+	config = strings.Replace(config, "type_: ignored", "key: tls.key", 1)
+	cert = &PKICertificate{}
+	if err := yaml.UnmarshalStrict([]byte(config), cert); err != nil {
+		t.Fatalf("Unable to unmarshal outputs: %v", err)
+	}
+
+	if f := cert.CertificateFile.File(); cert.CertificateFile.Type != "file" || f == nil || f.Path() != "/test/host.crt" || f.Mode != 0644 {
+		t.Errorf("Output without a type should be a file: %#v", cert.CertificateFile)
+	}
+	secret, ok := cert.PrivateKeyFile.OutputSink.(*KubernetesSecretOutput)
+	if !ok || secret.Namespace != "web" || secret.Name != "web-tls" || secret.Key != "tls.key" || secret.SecretType != kubernetes.SecretTypeTLS {
+		t.Errorf("Wrong kubernetes secret output: %#v", cert.PrivateKeyFile.OutputSink)
+	}
+	if cert.PrivateKeyFile.File() != nil {
+		t.Errorf("Kubernetes secret output shouldn't have a local file")
+	}
+	if memory, ok := cert.CertificateAuthorityCertificateFile.OutputSink.(*MemoryOutput); !ok || memory.Name != "ca" {
+		t.Errorf("Wrong memory output: %#v", cert.CertificateAuthorityCertificateFile.OutputSink)
+	}
+	if files := cert.Files(); len(files) != 1 || files[0].Path() != "/test/host.crt" {
+		t.Errorf("Only local files should be returned: %v", files)
+	}
+
+	// the type is kept when serialized, so reloads see the same configuration
+	serialized, err := yaml.Marshal(cert)
+	if err != nil {
+		t.Fatalf("Unable to marshal outputs: %v", err)
+	}
+	reloaded := &PKICertificate{}
+	if err := yaml.UnmarshalStrict(serialized, reloaded); err != nil {
+		t.Fatalf("Unable to unmarshal serialized outputs: %v\n%s", err, serialized)
+	}
+	if reloaded.PrivateKeyFile.Type != "kubernetes_secret" || reloaded.CertificateAuthorityCertificateFile.Type != "memory" {
+		t.Errorf("Output types lost when serialized:\n%s", serialized)
+	}
+
+	err = yaml.Unmarshal([]byte("certificate_file:\n  type: floppy\n"), &PKICertificate{})
+	if err == nil || !strings.Contains(err.Error(), "unknown output type 'floppy'") {
+		t.Errorf("Expected unknown output type error: %v", err)
+	}
+}
+
+func TestOutputSinks(t *testing.T) {
+	server := newFakeKubernetesServer(t)
+	defer server.Close()
+	defer useFakeKubernetesServer(server)()
+
+	var stdout bytes.Buffer
+	cert := &PKICertificate{
+		CertificateFile:                     &Output{Type: "stdout", OutputSink: &StdoutOutput{writer: &stdout}},
+		PrivateKeyFile:                      kubernetesSecretOutput("web-key", "tls.key", ""),
+		CertificateAuthorityCertificateFile: &Output{Type: "memory", OutputSink: &MemoryOutput{Name: "ca"}},
+	}
+	if err := cert.write("CA", "CERT", "KEY"); err != nil {
+		t.Fatalf("Unable to write outputs: %v", err)
+	}
+
+	if stdout.String() != "CERT\n" {
+		t.Errorf("Wrong certificate printed: '%s'", stdout.String())
+	}
+	for _, o := range []*Output{cert.CertificateFile, cert.PrivateKeyFile, cert.CertificateAuthorityCertificateFile} {
+		if contents, err := o.Read(); err != nil || strings.TrimSpace(contents) == "" {
+			t.Errorf("Unable to read back %s: '%s' %v", o, contents, err)
+		}
+	}
+
+	stored := server.secret("credmanager", "web-key")
+	if stored == nil || string(stored.Data["tls.key"]) != "KEY" || len(stored.Data) != 1 {
+		t.Fatalf("Private key not stored in secret: %v", stored)
+	}
+
+	if err := cert.PrivateKeyFile.remove(); err != nil {
+		t.Errorf("Unable to remove output: %v", err)
+	}
+	if contents, _ := cert.PrivateKeyFile.Read(); contents != "" {
+		t.Errorf("Removed output not emptied: '%s'", contents)
+	}
+}
+
+func TestRequireTmpfs(t *testing.T) {
+	if err := requireTmpfs("/proc/credmanager-test"); err == nil {
+		t.Errorf("Expected error for a file outside of tmpfs")
+	}
+	if _, err := os.Stat("/dev/shm"); err == nil {
+		if err := requireTmpfs("/dev/shm/credmanager-test"); err != nil {
+			t.Errorf("Unexpected error for a file on tmpfs: %v", err)
+		}
+	}
+}
@@ -9,40 +9,60 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	multierror "github.com/hashicorp/go-multierror"
 	vault "github.com/hashicorp/vault/api"
 )
 
 type PKICertificate struct {
-	PrivateKeyFile                      *CredentialFile `yaml:"private_key_file"`
-	CertificateFile                     *CredentialFile `yaml:"certificate_file"`
-	CertificateAuthorityCertificateFile *CredentialFile `yaml:"ca_cert_file"`
-	RoleName                            string          `yaml:"role"`
-	CommonName                          string          `yaml:"common_name"`
-	AlternativeNames                    []string        `yaml:"alternative_names"`
-	IPSubjectAlternativeNames           []string        `yaml:"ip_sans"`
-	LeaseDuration                       time.Duration   `yaml:"lifetime"`
-	BackendMountPoint                   string          `yaml:"vault_backend_mount"`
-	Notifies                            string          `yaml:"notifies"`
-	vaultClient                         *vault.Client
-	renewer                             *CredentialRenewer
-	configuredDuration                  time.Duration
+	Name                                string        `yaml:"name"`
+	PrivateKeyFile                      *Output       `yaml:"private_key_file"`
+	CertificateFile                     *Output       `yaml:"certificate_file"`
+	CertificateAuthorityCertificateFile *Output       `yaml:"ca_cert_file"`
+	RoleName                            string        `yaml:"role"`
+	CommonName                          string        `yaml:"common_name"`
+	AlternativeNames                    []string      `yaml:"alternative_names"`
+	IPSubjectAlternativeNames           []string      `yaml:"ip_sans"`
+	LeaseDuration                       time.Duration `yaml:"lifetime"`
+	BackendMountPoint                   string        `yaml:"vault_backend_mount"`
+	// Namespace overrides the vault namespace of the daemon's client
+	Namespace          string       `yaml:"namespace"`
+	Notifies           string       `yaml:"notifies"`
+	HealthCheck        *HealthCheck `yaml:"health_check"`
+	vaultClient        *vault.Client
+	renewer            *CredentialRenewer
+	configuredDuration time.Duration
+	expiration         expirationTime
 }
 
 func (p *PKICertificate) Initialize(vaultClient *vault.Client) error {
+	p.setup(vaultClient)
+	p.renewer.Renew()
+	return nil
+}
+
+// IssueOnce issues the certificate without starting a renewal process
+func (p *PKICertificate) IssueOnce(vaultClient *vault.Client, maxAttempts uint, runAction bool) error {
+	p.setup(vaultClient)
+	return p.renewer.RenewOnce(maxAttempts, runAction)
+}
+
+func (p *PKICertificate) setup(vaultClient *vault.Client) {
 	p.vaultClient = vaultClient
+	useVaultClient(vaultClient, p.Files()...)
 	p.configuredDuration = p.LeaseDuration
 
-	var postAction PostRenewAction
-	if p.Notifies != "" {
-		postAction = &ReloadOrRestartSystemdUnit{UnitName: p.Notifies}
-	}
+	postAction := notifyAction(p.Notifies, p.CertificateAuthorityCertificateFile, p.CertificateFile, p.PrivateKeyFile)
 	p.renewer = NewCredentialRenewer(p, postAction)
-	p.renewer.Renew()
-	return nil
+	if p.HealthCheck != nil {
+		if p.CertificateFile != nil {
+			p.HealthCheck.expectedCertificate = p.CertificateFile
+		}
+		p.renewer.HealthCheck = p.HealthCheck
+	}
 }
 
 func (p *PKICertificate) MaxRenewInterval() time.Duration {
@@ -54,15 +74,43 @@ func (p *PKICertificate) Renew() error {
 }
 
 func (p *PKICertificate) Stop() {
-	log.Printf("Entering stop")
 	p.renewer.Stop()
-	log.Printf("Exiting stop")
 }
 
 func (p *PKICertificate) Renewer() Renewer {
 	return p.renewer
 }
 
+// Expiration returns the expiration time of the current certificate
+func (p *PKICertificate) Expiration() time.Time {
+	return p.expiration.get()
+}
+
+// Files returns the local files written by this certificate
+func (p *PKICertificate) Files() []*CredentialFile {
+	return outputFiles(p.CertificateAuthorityCertificateFile, p.CertificateFile, p.PrivateKeyFile)
+}
+
+// Validate checks that all required fields are set
+func (p *PKICertificate) Validate() error {
+	var result *multierror.Error
+	result = multierror.Append(result,
+		requireString("role", p.RoleName),
+		requireString("vault_backend_mount", p.BackendMountPoint),
+		requireString("common_name", p.CommonName),
+	)
+	result = multierror.Append(result,
+		requireOutput("private_key_file", p.PrivateKeyFile),
+		requireOutput("certificate_file", p.CertificateFile),
+		requireOutput("ca_cert_file", p.CertificateAuthorityCertificateFile),
+		validateOutputs(p.CertificateAuthorityCertificateFile, p.CertificateFile, p.PrivateKeyFile),
+	)
+	if p.HealthCheck != nil {
+		result = multierror.Append(result, multierror.Prefix(p.HealthCheck.Validate(), "health_check:"))
+	}
+	return result.ErrorOrNil()
+}
+
 func (p *PKICertificate) sign() error {
 	keyBytes, err := rsa.GenerateKey(rand.Reader, 4096)
 	if err != nil {
@@ -89,7 +137,12 @@ func (p *PKICertificate) sign() error {
 	csrBytesPem := bytes.NewBuffer([]byte{})
 	pem.Encode(csrBytesPem, &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})
 
-	request := p.vaultClient.NewRequest("POST", fmt.Sprintf("/v1/%s/sign/%s", p.BackendMountPoint, p.RoleName))
+	client, err := namespacedClient(p.vaultClient, p.Namespace)
+	if err != nil {
+		return err
+	}
+
+	request := client.NewRequest("POST", fmt.Sprintf("/v1/%s/sign/%s", p.BackendMountPoint, p.RoleName))
 	pki_request := make(map[string]interface{})
 	pki_request["common_name"] = p.CommonName
 	pki_request["alt_names"] = strings.Join(p.AlternativeNames, ",")
@@ -99,7 +152,7 @@ func (p *PKICertificate) sign() error {
 	}
 	pki_request["csr"] = string(csrBytesPem.Bytes())
 	request.SetJSONBody(pki_request)
-	response, err := p.vaultClient.RawRequest(request)
+	response, err := client.RawRequest(request)
 	if err != nil {
 		return err
 	}
@@ -120,29 +173,20 @@ func (p *PKICertificate) sign() error {
 			return fmt.Errorf("error parsing certificate expiration time: %v", err)
 		}
 
+		p.expiration.set(time.Unix(expiresAt, 0))
 		p.LeaseDuration = time.Until(time.Unix(expiresAt, 0))
 	}
 
-	err = p.CertificateAuthorityCertificateFile.Write(data["issuing_ca"].(string))
-	if err != nil {
-		return err
-	}
-
-	err = p.CertificateFile.Write(data["certificate"].(string))
-	if err != nil {
-		return err
-	}
+	return p.write(data["issuing_ca"].(string), data["certificate"].(string), string(keyBytesPem.Bytes()))
+}
 
-	err = p.PrivateKeyFile.Write(string(keyBytesPem.Bytes()))
+func (p *PKICertificate) issue() error {
+	client, err := namespacedClient(p.vaultClient, p.Namespace)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func (p *PKICertificate) issue() error {
-	request := p.vaultClient.NewRequest("POST", fmt.Sprintf("/v1/%s/issue/%s", p.BackendMountPoint, p.RoleName))
+	request := client.NewRequest("POST", fmt.Sprintf("/v1/%s/issue/%s", p.BackendMountPoint, p.RoleName))
 	pki_request := make(map[string]interface{})
 	pki_request["common_name"] = p.CommonName
 	pki_request["alt_names"] = strings.Join(p.AlternativeNames, ",")
@@ -151,7 +195,7 @@ func (p *PKICertificate) issue() error {
 		pki_request["ttl"] = int64(p.configuredDuration.Seconds())
 	}
 	request.SetJSONBody(pki_request)
-	response, err := p.vaultClient.RawRequest(request)
+	response, err := client.RawRequest(request)
 	if err != nil {
 		return err
 	}
@@ -172,25 +216,24 @@ func (p *PKICertificate) issue() error {
 			return fmt.Errorf("error parsing certificate expiration time: %v", err)
 		}
 
+		p.expiration.set(time.Unix(expiresAt, 0))
 		p.LeaseDuration = time.Until(time.Unix(expiresAt, 0))
 	}
 
-	err = p.CertificateAuthorityCertificateFile.Write(data["issuing_ca"].(string))
-	if err != nil {
-		return err
-	}
-
-	err = p.CertificateFile.Write(data["certificate"].(string))
-	if err != nil {
-		return err
-	}
+	return p.write(data["issuing_ca"].(string), data["certificate"].(string), data["private_key"].(string))
+}
 
-	err = p.PrivateKeyFile.Write(data["private_key"].(string))
-	if err != nil {
-		return err
-	}
+// write stores the certificate in the configured outputs
+func (p *PKICertificate) write(caCert, cert, key string) error {
+	return writeOutputs(
+		outputContent{p.CertificateAuthorityCertificateFile, caCert},
+		outputContent{p.CertificateFile, cert},
+		outputContent{p.PrivateKeyFile, key},
+	)
+}
 
-	return nil
+func (p *PKICertificate) logFields() logging.Fields {
+	return credentialFields(p.Name, "pki", p)
 }
 
 func (p *PKICertificate) String() string {
@@ -120,9 +120,9 @@ func TestPKICertManage(t *testing.T) {
 	}
 
 	cert := &PKICertificate{
-		PrivateKeyFile:                      keyFile,
-		CertificateFile:                     certFile,
-		CertificateAuthorityCertificateFile: caFile,
+		PrivateKeyFile:                      FileOutput(keyFile),
+		CertificateFile:                     FileOutput(certFile),
+		CertificateAuthorityCertificateFile: FileOutput(caFile),
 		CommonName:                          "test.local",
 		AlternativeNames:                    []string{"foo.local", "bar.local"},
 		IPSubjectAlternativeNames:           []string{"10.2.0.1"},
@@ -213,9 +213,9 @@ func getTestPKICertificateInfo() (*PKICertificate, string) {
 	keyFile, _ := NewCredentialFile(filepath.Join("/test", "host.key"), 0600, "", "")
 
 	cert := &PKICertificate{
-		PrivateKeyFile:                      keyFile,
-		CertificateAuthorityCertificateFile: caFile,
-		CertificateFile:                     certFile,
+		PrivateKeyFile:                      FileOutput(keyFile),
+		CertificateAuthorityCertificateFile: FileOutput(caFile),
+		CertificateFile:                     FileOutput(certFile),
 		RoleName:                            "testhost",
 		CommonName:                          "foo.local",
 		AlternativeNames:                    []string{"bar.local", "baz.local"},
@@ -259,9 +259,9 @@ func TestPKICertificateUnmarshalYAML(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unable to unmarshal: %v", err)
 	}
-	dst.CertificateFile.populateUserGroupData()
-	dst.CertificateAuthorityCertificateFile.populateUserGroupData()
-	dst.PrivateKeyFile.populateUserGroupData()
+	dst.CertificateFile.File().populateUserGroupData()
+	dst.CertificateAuthorityCertificateFile.File().populateUserGroupData()
+	dst.PrivateKeyFile.File().populateUserGroupData()
 
 	if diff := deep.Equal(dst, expected); diff != nil {
 		t.Errorf("Unmarshaled not equal to expected:")
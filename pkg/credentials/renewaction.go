@@ -17,3 +17,19 @@ func (a *ReloadOrRestartSystemdUnit) Do() error {
 	_, err = c.ReloadOrRestartUnit(a.UnitName, "replace", nil)
 	return err
 }
+
+// RestartSystemdUnit restarts a unit, for units that only read their
+// credentials when they start
+type RestartSystemdUnit struct {
+	UnitName string
+}
+
+func (a *RestartSystemdUnit) Do() error {
+	c, err := systemctl.New()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.RestartUnit(a.UnitName, "replace", nil)
+	return err
+}
@@ -2,10 +2,11 @@ package credentials
 
 import (
 	"fmt"
-	"log"
 	"math/rand"
 	"sync"
 	"time"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
 )
 
 type ErrMaxRetriesExceeded struct {
@@ -17,6 +18,27 @@ func (e ErrMaxRetriesExceeded) Error() string {
 	return fmt.Sprintf("Exceeded maximum allowed retries (%d): %s", e.MaxRetries, e.Message)
 }
 
+// ErrRenewalFailed is returned when a credential couldn't be renewed
+type ErrRenewalFailed struct {
+	Source fmt.Stringer
+	Err    error
+}
+
+func (e ErrRenewalFailed) Error() string {
+	return e.Err.Error()
+}
+
+// ErrActionFailed is returned when a credential was renewed but the post renew
+// action or health check that followed failed
+type ErrActionFailed struct {
+	Source fmt.Stringer
+	Err    error
+}
+
+func (e ErrActionFailed) Error() string {
+	return e.Err.Error()
+}
+
 type RenewableCredential interface {
 	Renew() error
 	MaxRenewInterval() time.Duration
@@ -27,10 +49,68 @@ type PostRenewAction interface {
 	Do() error
 }
 
+// ConditionalCredential is implemented by credentials that only need to be
+// renewed under some condition, such as a wrapping token having been used.
+// NeedsRenewal is checked before every scheduled renewal, forced renewals
+// always renew the credential.  A failed check is retried with the same
+// backoff as a failed renewal, without renewing the credential.  If the first
+// check finds the credential doesn't need renewal it's reported on RenewCh with
+// the message "already valid".
+type ConditionalCredential interface {
+	NeedsRenewal() (bool, error)
+}
+
+// CommittableCredential is implemented by credentials that clean up after the
+// previous credential once the consumer has switched to the renewed one.
+// Commit is called after the post renew action and health check succeed.
+// Rollback is called instead if the health check failed and the previous
+// credential's files were restored, the renewed credential is no longer used.
+type CommittableCredential interface {
+	Commit() error
+	Rollback() error
+}
+
+// TokenConsumer is implemented by credentials that hold on to a copy of the
+// vault client's token.  TokenChanged is called after the client's token has
+// been replaced.
+type TokenConsumer interface {
+	TokenChanged() error
+}
+
+// RevocableCredential is implemented by credentials that are revoked when they
+// are removed from the configuration.  Revoke is called after Stop.
+// RevocationKey identifies where the revoked credential is written, a
+// credential isn't revoked if a configured credential writes to the same place
+// and takes it over.
+type RevocableCredential interface {
+	Revoke() error
+	RevocationKey() string
+}
+
+// VaultConfigConsumer is implemented by credentials that connect to vault with
+// their own client.  SetVaultConfig is called before Initialize or IssueOnce
+// with the connection settings of the daemon's vault client.
+// ClientCertificateChanged is called after the client certificate files named
+// in the settings have been replaced, so that new connections present it.
+type VaultConfigConsumer interface {
+	SetVaultConfig(TemplateVaultConfig)
+	ClientCertificateChanged() error
+}
+
+// FileCredential is implemented by credentials that write their output to
+// credential files, allowing the files to be restored after a failed health
+// check.
+type FileCredential interface {
+	Files() []*CredentialFile
+}
+
 type RenewOutput struct {
 	Source      fmt.Stringer
 	Message     string
 	RenewalTime time.Time
+	// ActionFailed is set if the credential was written but the action that
+	// followed failed, the failure is reported on the renewer's DoneCh
+	ActionFailed bool
 }
 
 func (o *RenewOutput) String() string {
@@ -46,6 +126,7 @@ type RenewTimer struct {
 	initialFailInterval  time.Duration
 	defaultRenewalWindow time.Duration
 	failCount            uint
+	next                 time.Time
 }
 
 func NewRenewTimer(initialDelay, expirationWindow, initialFailInterval time.Duration, jitterPercent int64) *RenewTimer {
@@ -58,14 +139,47 @@ func NewRenewTimer(initialDelay, expirationWindow, initialFailInterval time.Dura
 
 	if expirationWindow <= 0 {
 		// negative or zero expiration windows are invalid, default to 24h and print a warning
-		log.Printf("Warning: initial expiration window set to invalid value (%s).  Defaulting to 24h.", expirationWindow)
+		logger.Warn("invalid_expiration_window", "Initial expiration window set to invalid value, defaulting to 24h", logging.Fields{"expiration_window": expirationWindow})
 		expirationWindow = time.Hour * 24
 	}
 	t.defaultRenewalWindow = expirationWindow
 	t.Timer = time.NewTimer(initialDelay)
+	t.next = time.Now().Add(initialDelay)
 	return t
 }
 
+// Next returns the time the timer is next scheduled to fire
+func (t *RenewTimer) Next() time.Time {
+	return t.next
+}
+
+func (t *RenewTimer) reset(interval time.Duration) {
+	t.next = time.Now().Add(interval)
+	t.Timer.Reset(interval)
+}
+
+// stopAndDrain stops the timer, discarding any pending firing
+func (t *RenewTimer) stopAndDrain() {
+	if !t.Timer.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// cancel stops any pending firing of the timer and clears the failure count
+func (t *RenewTimer) cancel() {
+	t.failCount = 0
+	t.stopAndDrain()
+}
+
+// Trigger stops any pending firing of the timer and causes it to fire immediately
+func (t *RenewTimer) Trigger() {
+	t.stopAndDrain()
+	t.reset(0)
+}
+
 func (t *RenewTimer) jitterWindowNanoseconds(interval time.Duration) int64 {
 	return t.jitterPercent * interval.Nanoseconds() / 100
 }
@@ -94,22 +208,79 @@ func (t *RenewTimer) getInterval(expirationWindow time.Duration, failCount uint)
 // the failure count
 func (t *RenewTimer) FailReset(expirationWindow time.Duration) {
 	t.failCount++
-	t.Timer.Reset(t.getInterval(expirationWindow, t.failCount))
+	t.reset(t.getInterval(expirationWindow, t.failCount))
 }
 
 // Reset resets the timer using the success interval
 func (t *RenewTimer) Reset(expirationWindow time.Duration) {
 	t.failCount = 0
-	t.Timer.Reset(t.getInterval(expirationWindow, t.failCount))
+	t.reset(t.getInterval(expirationWindow, t.failCount))
+}
+
+// ExpiringCredential is implemented by credentials that know when the
+// currently issued credential expires.
+type ExpiringCredential interface {
+	Expiration() time.Time
+}
+
+// expirationTime holds the expiration of the current credential.  It is set
+// by the renewer and read from other goroutines through Expiration.
+type expirationTime struct {
+	lock sync.Mutex
+	time time.Time
+}
+
+func (e *expirationTime) set(expiration time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.time = expiration
+}
+
+func (e *expirationTime) get() time.Time {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.time
+}
+
+// RenewerStatus describes the current state of a renewer
+type RenewerStatus struct {
+	LastRenewal  time.Time `json:"last_renewal"`
+	NextRenewal  time.Time `json:"next_renewal"`
+	Expiration   time.Time `json:"expiration"`
+	FailureCount uint      `json:"failure_count"`
+	LastError    string    `json:"last_error,omitempty"`
+	Paused       bool      `json:"paused"`
+}
+
+// StatusRenewer is a renewer that can report its status
+type StatusRenewer interface {
+	Renewer
+	Status() RenewerStatus
+}
+
+// ControllableRenewer is a renewer that can report its status and be
+// controlled while running.
+type ControllableRenewer interface {
+	StatusRenewer
+	// ForceRenew renews the credential immediately, even if paused
+	ForceRenew() error
+	// Pause stops scheduled renewals until Resume is called
+	Pause() error
+	Resume() error
 }
 
 type CredentialRenewer struct {
 	Credential  RenewableCredential
 	Action      PostRenewAction
+	HealthCheck *HealthCheck
 	renewCh     chan *RenewOutput
 	doneCh      chan error
 	stopCh      chan bool
-	lastRenewal time.Time
+	forceCh     chan bool
+	resumeCh    chan bool
+	statusLock  sync.Mutex
+	status      RenewerStatus
+	log         *logging.Logger
 }
 
 func NewCredentialRenewer(cred RenewableCredential, action PostRenewAction) *CredentialRenewer {
@@ -117,9 +288,11 @@ func NewCredentialRenewer(cred RenewableCredential, action PostRenewAction) *Cre
 	r.renewCh = make(chan *RenewOutput, 100)
 	r.doneCh = make(chan error, 100)
 	r.stopCh = make(chan bool, 100)
-	r.lastRenewal = time.Now()
+	r.forceCh = make(chan bool, 1)
+	r.resumeCh = make(chan bool, 1)
 	r.Action = action
-	log.Printf("Returning credentialRenewer")
+	r.log = credentialLogger(cred)
+	r.log.Debug("renewer_created", "Created credential renewer")
 	return r
 }
 
@@ -135,39 +308,155 @@ func (r *CredentialRenewer) Stop() {
 	r.stopCh <- true
 }
 
+// Status returns the current state of the renewer
+func (r *CredentialRenewer) Status() RenewerStatus {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	status := r.status
+	if cred, ok := r.Credential.(ExpiringCredential); ok {
+		status.Expiration = cred.Expiration()
+	}
+	return status
+}
+
+// ForceRenew triggers an immediate renewal
+func (r *CredentialRenewer) ForceRenew() error {
+	select {
+	case r.forceCh <- true:
+		r.log.Info("renewal_forced", "Forcing renewal")
+	default:
+		// a forced renewal is already pending
+	}
+	return nil
+}
+
+// Pause stops scheduled renewals until Resume is called
+func (r *CredentialRenewer) Pause() error {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	r.status.Paused = true
+	r.log.Info("renewer_paused", "Paused scheduled renewals")
+	return nil
+}
+
+// Resume restarts scheduled renewals, renewing immediately if a renewal was
+// skipped while paused.
+func (r *CredentialRenewer) Resume() error {
+	r.statusLock.Lock()
+	r.status.Paused = false
+	r.statusLock.Unlock()
+	r.log.Info("renewer_resumed", "Resumed scheduled renewals")
+
+	select {
+	case r.resumeCh <- true:
+	default:
+	}
+	return nil
+}
+
+func (r *CredentialRenewer) paused() bool {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	return r.status.Paused
+}
+
+func (r *CredentialRenewer) recordSuccess(next time.Time) {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	r.status.LastRenewal = time.Now()
+	r.status.NextRenewal = next
+	r.status.FailureCount = 0
+	r.status.LastError = ""
+}
+
+func (r *CredentialRenewer) recordFailure(err error, next time.Time) {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	r.status.NextRenewal = next
+	r.status.FailureCount++
+	r.status.LastError = err.Error()
+}
+
 func (r *CredentialRenewer) Renew() {
 	maxFail := uint(18)
 	timer := NewRenewTimer(0, r.Credential.MaxRenewInterval(), 5*time.Second, 10)
 	var failCount uint
 	failCount = 0
+	// set when a scheduled renewal is skipped because the renewer is paused
+	skipped := false
+
+	attempt := func(force bool) {
+		if !force {
+			needed, err := r.needsRenewal()
+			if err != nil {
+				timer.FailReset(r.Credential.MaxRenewInterval())
+				r.recordFailure(err, timer.Next())
+				r.log.Error("renewal_check_failed", "Unable to check whether credential needs renewal", logging.Fields{"error": err, "next_renewal": timer.Next()})
+				r.doneCh <- err
+				return
+			}
+			if !needed {
+				timer.Reset(r.Credential.MaxRenewInterval())
+				if !r.Status().LastRenewal.IsZero() {
+					r.statusLock.Lock()
+					r.status.NextRenewal = timer.Next()
+					r.statusLock.Unlock()
+					return
+				}
+				// the credential issued before we started is still valid, report it
+				// like a renewal so it doesn't look like it was never issued
+				r.recordSuccess(timer.Next())
+				r.log.Info("credential_valid", "Credential is already valid", logging.Fields{"next_renewal": timer.Next()})
+				r.renewCh <- &RenewOutput{RenewalTime: r.Status().LastRenewal, Source: r.Credential, Message: "already valid"}
+				return
+			}
+		}
+
+		err := r.renew(true)
+		if err != nil {
+			timer.FailReset(r.Credential.MaxRenewInterval())
+			r.recordFailure(err, timer.Next())
+			r.log.Error("renewal_failed", "Unable to renew credential", logging.Fields{"error": err, "next_renewal": timer.Next()})
+			r.doneCh <- err
+			if failCount > maxFail {
+				r.doneCh <- ErrMaxRetriesExceeded{MaxRetries: maxFail, Message: fmt.Sprintf("credential: %s", r.Credential)}
+			}
+			return
+		}
+
+		failCount = 0
+		timer.Reset(r.Credential.MaxRenewInterval())
+		r.recordSuccess(timer.Next())
+		r.log.Info("credential_renewed", "Renewed credential", logging.Fields{"next_renewal": timer.Next()})
+		update := &RenewOutput{RenewalTime: r.Status().LastRenewal, Source: r.Credential}
+		r.renewCh <- update
+	}
+
+	r.statusLock.Lock()
+	r.status.NextRenewal = timer.Next()
+	r.statusLock.Unlock()
+
 	go func() {
 		for {
 			select {
 			case <-timer.C:
-				err := r.Credential.Renew()
-				if err != nil {
-					r.doneCh <- fmt.Errorf("error renewing %s: %v", r.Credential.String(), err)
-					if failCount > maxFail {
-						r.doneCh <- ErrMaxRetriesExceeded{MaxRetries: maxFail, Message: fmt.Sprintf("credential: %s", r.Credential)}
-					}
-					timer.FailReset(r.Credential.MaxRenewInterval())
+				if r.paused() {
+					skipped = true
 					continue
-				} else if r.Action != nil {
-					actionErr := r.Action.Do()
-					if actionErr != nil {
-						r.doneCh <- fmt.Errorf("error while executing post renew action: %v", actionErr)
-						timer.FailReset(r.Credential.MaxRenewInterval())
-						continue
-					}
 				}
-
-				r.lastRenewal = time.Now()
-				update := &RenewOutput{RenewalTime: r.lastRenewal, Source: r.Credential}
-				r.renewCh <- update
-				failCount = 0
-				timer.Reset(r.Credential.MaxRenewInterval())
+				attempt(false)
+			case <-r.forceCh:
+				skipped = false
+				timer.stopAndDrain()
+				attempt(true)
+			case <-r.resumeCh:
+				if skipped {
+					skipped = false
+					timer.Trigger()
+				}
 			case stop := <-r.stopCh:
 				if stop {
+					timer.Stop()
 					return
 				}
 			}
@@ -175,85 +464,241 @@ func (r *CredentialRenewer) Renew() {
 	}()
 }
 
-type Renewer interface {
-	DoneCh() <-chan error
-	RenewCh() <-chan *RenewOutput
-}
+// RenewOnce renews the credential synchronously, retrying failures using the
+// same backoff as Renew until maxAttempts have been made.  The post renew
+// action and health check are only run if runAction is true.
+func (r *CredentialRenewer) RenewOnce(maxAttempts uint, runAction bool) error {
+	timer := NewRenewTimer(0, r.Credential.MaxRenewInterval(), 5*time.Second, 10)
+	defer timer.Stop()
+
+	var err error
+	for attempt := uint(0); attempt < maxAttempts; attempt++ {
+		<-timer.C
+		var needed bool
+		needed, err = r.needsRenewal()
+		if err == nil && !needed {
+			r.recordSuccess(time.Time{})
+			return nil
+		}
 
-type RenewerMerger struct {
-	renewCh []<-chan *RenewOutput
-	doneCh  []<-chan error
-	r       <-chan *RenewOutput
-	d       <-chan error
+		if err == nil {
+			err = r.renew(runAction)
+		}
+		if err == nil {
+			r.recordSuccess(time.Time{})
+			return nil
+		}
+		r.log.Warn("renewal_failed", "Renewal attempt failed", logging.Fields{"attempt": attempt, "error": err})
+		timer.FailReset(r.Credential.MaxRenewInterval())
+	}
+	return ErrMaxRetriesExceeded{MaxRetries: maxAttempts, Message: fmt.Sprintf("credential: %s -- %v", r.Credential, err)}
 }
 
-func (l *RenewerMerger) AddRenewer(r Renewer) {
-	l.renewCh = append(l.renewCh, r.RenewCh())
-	l.doneCh = append(l.doneCh, r.DoneCh())
+// needsRenewal checks whether a conditional credential needs to be renewed.
+// Other credentials always need to be renewed.  A failed check isn't treated
+// as a reason to renew, the current credential may still be in use.
+func (r *CredentialRenewer) needsRenewal() (bool, error) {
+	cred, ok := r.Credential.(ConditionalCredential)
+	if !ok {
+		return true, nil
+	}
+
+	needed, err := cred.NeedsRenewal()
+	if err != nil {
+		return false, ErrRenewalFailed{Source: r.Credential, Err: fmt.Errorf("unable to check whether %s needs renewal: %v", r.Credential.String(), err)}
+	}
+	return needed, nil
 }
 
-func (l *RenewerMerger) makeDoneCh() <-chan error {
-	var wg sync.WaitGroup
-	out := make(chan error)
+// renew renews the credential, then runs the post renew action and health
+// check if runAction is set.  The previous credential is restored if the health
+// check fails.
+func (r *CredentialRenewer) renew(runAction bool) error {
+	backups, err := r.backupFiles()
+	if err != nil {
+		return ErrRenewalFailed{Source: r.Credential, Err: fmt.Errorf("unable to backup existing files for %s: %v", r.Credential.String(), err)}
+	}
 
-	// Start an output goroutine for each input channel in cs.  output
-	// copies values from c to out until c is closed, then calls wg.Done.
-	output := func(c <-chan error) {
-		for n := range c {
-			out <- n
+	err = r.Credential.Renew()
+	if err != nil {
+		return ErrRenewalFailed{Source: r.Credential, Err: fmt.Errorf("error renewing %s: %v", r.Credential.String(), err)}
+	}
+
+	if !runAction {
+		return nil
+	}
+
+	if r.Action != nil {
+		actionErr := r.Action.Do()
+		if actionErr != nil {
+			return ErrActionFailed{Source: r.Credential, Err: fmt.Errorf("error while executing post renew action: %v", actionErr)}
 		}
-		wg.Done()
 	}
-	wg.Add(len(l.doneCh))
-	for _, c := range l.doneCh {
-		go output(c)
+
+	if r.HealthCheck != nil {
+		checkErr := r.HealthCheck.Check()
+		if checkErr != nil {
+			rollbackErr := r.rollback(backups)
+			if rollbackErr != nil {
+				return ErrActionFailed{Source: r.Credential, Err: fmt.Errorf("health check failed after renewing %s: %v -- error rolling back: %v", r.Credential.String(), checkErr, rollbackErr)}
+			}
+			return ErrActionFailed{Source: r.Credential, Err: fmt.Errorf("health check failed after renewing %s: %v", r.Credential.String(), checkErr)}
+		}
 	}
 
-	// Start a goroutine to close out once all the output goroutines are
-	// done.  This must start after the wg.Add call.
-	go func() {
-		wg.Wait()
-		close(out)
-	}()
-	return out
+	if cred, ok := r.Credential.(CommittableCredential); ok {
+		if err := cred.Commit(); err != nil {
+			// the renewed credential is in use, failing to clean up the old one
+			// doesn't warrant another renewal
+			r.log.Warn("commit_failed", "Unable to clean up previous credential", logging.Fields{"error": err})
+		}
+	}
+	return nil
 }
 
-func (l *RenewerMerger) DoneCh() <-chan error {
-	if l.d == nil {
-		l.d = l.makeDoneCh()
+// backupFiles saves the current contents of the credential's files if a health
+// check is configured.
+func (r *CredentialRenewer) backupFiles() ([]*credentialFileBackup, error) {
+	fileCred, ok := r.Credential.(FileCredential)
+	if r.HealthCheck == nil || !ok {
+		return nil, nil
 	}
-	return l.d
+
+	backups := make([]*credentialFileBackup, 0, len(fileCred.Files()))
+	for _, f := range fileCred.Files() {
+		if f == nil {
+			continue
+		}
+		b, err := f.backup()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, b)
+	}
+	return backups, nil
 }
 
-func (l *RenewerMerger) makeRenewCh() <-chan *RenewOutput {
-	var wg sync.WaitGroup
-	out := make(chan *RenewOutput)
+// rollback restores the previous credential files and re-runs the post renew
+// action so that the service picks the old credential back up.
+func (r *CredentialRenewer) rollback(backups []*credentialFileBackup) error {
+	previous := false
+	for _, b := range backups {
+		previous = previous || b.existed
+	}
+	if !previous {
+		return fmt.Errorf("no previous credential available")
+	}
 
-	// Start an output goroutine for each input channel in cs.  output
-	// copies values from c to out until c is closed, then calls wg.Done.
-	output := func(c <-chan *RenewOutput) {
-		for n := range c {
-			out <- n
+	for _, b := range backups {
+		if err := b.restore(); err != nil {
+			return err
 		}
-		wg.Done()
 	}
-	wg.Add(len(l.renewCh))
-	for _, c := range l.renewCh {
-		go output(c)
+	if cred, ok := r.Credential.(CommittableCredential); ok {
+		if err := cred.Rollback(); err != nil {
+			r.log.Warn("rollback_cleanup_failed", "Unable to clean up rejected credential", logging.Fields{"error": err})
+		}
 	}
 
-	// Start a goroutine to close out once all the output goroutines are
-	// done.  This must start after the wg.Add call.
-	go func() {
-		wg.Wait()
-		close(out)
-	}()
-	return out
+	if r.Action != nil {
+		return r.Action.Do()
+	}
+	return nil
 }
 
-func (l *RenewerMerger) RenewCh() <-chan *RenewOutput {
-	if l.r == nil {
-		l.r = l.makeRenewCh()
+type Renewer interface {
+	DoneCh() <-chan error
+	RenewCh() <-chan *RenewOutput
+}
+
+// RenewerMerger combines the output of multiple renewers into a single pair of
+// channels.  Renewers may be added and removed at any time.
+type RenewerMerger struct {
+	lock     sync.Mutex
+	renewers map[Renewer]chan bool
+	r        chan *RenewOutput
+	d        chan error
+}
+
+func (l *RenewerMerger) init() {
+	if l.renewers == nil {
+		l.renewers = make(map[Renewer]chan bool)
+		l.r = make(chan *RenewOutput)
+		l.d = make(chan error)
+	}
+}
+
+// AddRenewer starts forwarding output from r to the merged channels
+func (l *RenewerMerger) AddRenewer(r Renewer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.init()
+
+	if _, ok := l.renewers[r]; ok {
+		return
+	}
+	stopCh := make(chan bool)
+	l.renewers[r] = stopCh
+	go l.forward(r, stopCh)
+}
+
+// RemoveRenewer stops forwarding output from r to the merged channels
+func (l *RenewerMerger) RemoveRenewer(r Renewer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.init()
+
+	stopCh, ok := l.renewers[r]
+	if !ok {
+		return
 	}
+	close(stopCh)
+	delete(l.renewers, r)
+}
+
+// forward copies values from the renewer's channels to the merged channels
+// until stopCh is closed.
+func (l *RenewerMerger) forward(r Renewer, stopCh <-chan bool) {
+	renewCh := r.RenewCh()
+	doneCh := r.DoneCh()
+	for renewCh != nil || doneCh != nil {
+		select {
+		case n, ok := <-renewCh:
+			if !ok {
+				renewCh = nil
+				continue
+			}
+			select {
+			case l.r <- n:
+			case <-stopCh:
+				return
+			}
+		case n, ok := <-doneCh:
+			if !ok {
+				doneCh = nil
+				continue
+			}
+			select {
+			case l.d <- n:
+			case <-stopCh:
+				return
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (l *RenewerMerger) DoneCh() <-chan error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.init()
+	return l.d
+}
+
+func (l *RenewerMerger) RenewCh() <-chan *RenewOutput {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.init()
 	return l.r
 }
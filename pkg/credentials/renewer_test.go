@@ -2,6 +2,11 @@ package credentials
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -98,3 +103,289 @@ func TestRenewerMerger(t *testing.T) {
 		t.Logf("Expected: %v", err)
 	}
 }
+
+type testFileRenewable struct {
+	testRenewable
+	File *CredentialFile
+}
+
+func (t *testFileRenewable) Renew() error {
+	if err := t.testRenewable.Renew(); err != nil {
+		return err
+	}
+	return t.File.Write(fmt.Sprintf("renewal %d", t.RenewCount))
+}
+
+func (t *testFileRenewable) Files() []*CredentialFile {
+	return []*CredentialFile{t.File}
+}
+
+func TestRenewerHealthCheckRollback(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "renewertest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	f, err := NewCredentialFile(filepath.Join(tempDir, "cred"), 0600, "", "")
+	if err != nil {
+		t.Fatalf("Unable to create credential file: %v", err)
+	}
+	err = f.Write("original")
+	if err != nil {
+		t.Fatalf("Unable to write initial credential: %v", err)
+	}
+
+	test := &testFileRenewable{testRenewable: testRenewable{MaxRenewals: 5}, File: f}
+	action := &testAction{}
+	renewer := NewCredentialRenewer(test, action)
+	renewer.HealthCheck = &HealthCheck{Type: "exec", Command: []string{"false"}}
+	renewer.Renew()
+	defer renewer.Stop()
+
+	select {
+	case out := <-renewer.RenewCh():
+		t.Fatalf("Unexpected renewal despite failing health check: %v", out)
+	case err := <-renewer.DoneCh():
+		t.Logf("Expected: %v", err)
+	}
+
+	contents, err := f.Read()
+	if err != nil {
+		t.Fatalf("Unable to read credential file: %v", err)
+	}
+	if contents != "original" {
+		t.Errorf("Credential not rolled back after failed health check, got: '%s'", contents)
+	}
+
+	if !action.Fired {
+		t.Errorf("Post renew action didn't fire after rollback")
+	}
+}
+
+func TestRenewerMergerRemove(t *testing.T) {
+	m := &RenewerMerger{}
+	first := NewCredentialRenewer(&testRenewable{MaxRenewals: 100}, nil)
+	second := NewCredentialRenewer(&testRenewable{MaxRenewals: 100}, nil)
+	m.AddRenewer(first)
+	m.AddRenewer(second)
+	first.Renew()
+	second.Renew()
+	defer first.Stop()
+	defer second.Stop()
+
+	sources := make(map[fmt.Stringer]bool)
+	for len(sources) < 2 {
+		select {
+		case out := <-m.RenewCh():
+			sources[out.Source] = true
+		case err := <-m.DoneCh():
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	m.RemoveRenewer(first)
+	time.Sleep(10 * time.Millisecond)
+	timeout := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case out := <-m.RenewCh():
+			if out.Source == first.Credential {
+				t.Fatalf("Got renewal from removed renewer: %v", out)
+			}
+		case err := <-m.DoneCh():
+			t.Fatalf("Unexpected error: %v", err)
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestRenewerRenewOnce(t *testing.T) {
+	test := &testRenewable{MaxRenewals: 1}
+	action := &testAction{}
+	renewer := NewCredentialRenewer(test, action)
+
+	err := renewer.RenewOnce(1, false)
+	if err != nil {
+		t.Fatalf("Unexpected error renewing once: %v", err)
+	}
+	if test.RenewCount != 1 {
+		t.Errorf("Expected exactly one renewal, got %d", test.RenewCount)
+	}
+	if action.Fired {
+		t.Errorf("Post renew action fired when actions were disabled")
+	}
+
+	err = renewer.RenewOnce(1, true)
+	if _, ok := err.(ErrMaxRetriesExceeded); !ok {
+		t.Errorf("Expected max retries error once renewals were exhausted, got: %v", err)
+	}
+}
+
+func TestRenewerPauseResume(t *testing.T) {
+	test := &testRenewable{MaxRenewals: 100}
+	renewer := NewCredentialRenewer(test, nil)
+	renewer.Renew()
+	defer renewer.Stop()
+
+	<-renewer.RenewCh()
+	renewer.Pause()
+	if !renewer.Status().Paused {
+		t.Errorf("Renewer not reported as paused")
+	}
+
+	// drain a renewal that may have been in progress while pausing
+	time.Sleep(100 * time.Millisecond)
+	for len(renewer.RenewCh()) > 0 {
+		<-renewer.RenewCh()
+	}
+
+	select {
+	case out := <-renewer.RenewCh():
+		t.Fatalf("Renewed while paused: %v", out)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	renewer.ForceRenew()
+	select {
+	case <-renewer.RenewCh():
+	case <-time.After(time.Second):
+		t.Fatalf("Forced renewal didn't happen while paused")
+	}
+
+	renewer.Resume()
+	select {
+	case <-renewer.RenewCh():
+	case <-time.After(time.Second):
+		t.Fatalf("Renewal didn't resume")
+	}
+
+	status := renewer.Status()
+	if status.LastRenewal.IsZero() || status.NextRenewal.IsZero() {
+		t.Errorf("Renewal times not recorded in status: %+v", status)
+	}
+}
+
+type testConditionalRenewable struct {
+	testRenewable
+	lock   sync.Mutex
+	checks int
+	// checkErr is returned by every check if set
+	checkErr error
+}
+
+// NeedsRenewal only requires renewal on every third check
+func (t *testConditionalRenewable) NeedsRenewal() (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.checks++
+	if t.checkErr != nil {
+		return false, t.checkErr
+	}
+	return t.checks%3 == 0, nil
+}
+
+func (t *testConditionalRenewable) Renew() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.testRenewable.Renew()
+}
+
+func (t *testConditionalRenewable) counts() (uint, int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.RenewCount, t.checks
+}
+
+func TestRenewerConditional(t *testing.T) {
+	test := &testConditionalRenewable{testRenewable: testRenewable{MaxRenewals: 10}}
+	action := &testAction{}
+	renewer := NewCredentialRenewer(test, action)
+	renewer.Renew()
+	defer renewer.Stop()
+
+	for renewed := false; !renewed; {
+		select {
+		case renewal := <-renewer.RenewCh():
+			renewed = renewal.Message == ""
+		case err := <-renewer.DoneCh():
+			t.Fatalf("Renewer failed: %v", err)
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for renewal")
+		}
+	}
+
+	if renewals, checks := test.counts(); renewals != 1 || checks != 3 {
+		t.Errorf("Expected a single renewal after 3 checks, got %d renewals after %d checks", renewals, checks)
+	}
+
+	// forced renewals don't check whether renewal is needed
+	renewer.Pause()
+	renewer.ForceRenew()
+	select {
+	case <-renewer.RenewCh():
+	case err := <-renewer.DoneCh():
+		t.Fatalf("Renewer failed: %v", err)
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for forced renewal")
+	}
+
+	if renewals, _ := test.counts(); renewals != 2 {
+		t.Errorf("Forced renewal didn't renew credential")
+	}
+}
+
+func TestRenewerConditionalAlreadyValid(t *testing.T) {
+	test := &testConditionalRenewable{testRenewable: testRenewable{MaxRenewals: 10}}
+	action := &testAction{}
+	renewer := NewCredentialRenewer(test, action)
+	renewer.Renew()
+	defer renewer.Stop()
+
+	select {
+	case renewal := <-renewer.RenewCh():
+		if renewal.Message != "already valid" {
+			t.Errorf("Unexpected renewal message for valid credential: %s", renewal)
+		}
+	case err := <-renewer.DoneCh():
+		t.Fatalf("Renewer failed: %v", err)
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for check")
+	}
+
+	if renewals, checks := test.counts(); renewals != 0 || checks != 1 {
+		t.Errorf("Expected no renewals after the first check, got %d renewals after %d checks", renewals, checks)
+	}
+	if action.Fired {
+		t.Errorf("Post renew action fired for a credential that wasn't renewed")
+	}
+	if status := renewer.Status(); status.LastRenewal.IsZero() || status.NextRenewal.IsZero() {
+		t.Errorf("Valid credential not recorded in status: %+v", status)
+	}
+}
+
+func TestRenewerConditionalCheckFailed(t *testing.T) {
+	test := &testConditionalRenewable{testRenewable: testRenewable{MaxRenewals: 10}, checkErr: fmt.Errorf("vault is sealed")}
+	renewer := NewCredentialRenewer(test, nil)
+	renewer.Renew()
+	defer renewer.Stop()
+
+	select {
+	case <-renewer.RenewCh():
+		t.Fatalf("Credential renewed after failed check")
+	case err := <-renewer.DoneCh():
+		if _, ok := err.(ErrRenewalFailed); !ok || !strings.Contains(err.Error(), "vault is sealed") {
+			t.Errorf("Wrong error for failed check: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for check")
+	}
+
+	if renewals, _ := test.counts(); renewals != 0 {
+		t.Errorf("Credential renewed after failed check")
+	}
+	if status := renewer.Status(); status.FailureCount != 1 || status.NextRenewal.IsZero() {
+		t.Errorf("Failed check not recorded in status: %+v", status)
+	}
+}
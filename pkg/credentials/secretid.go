@@ -0,0 +1,83 @@
+package credentials
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// SecretIDOptions are the settings used to generate an AppRole secret_id
+type SecretIDOptions struct {
+	// Mount is the path the AppRole auth method is mounted at, approle by default
+	Mount string `yaml:"mount"`
+	Role  string `yaml:"role"`
+	// Metadata is attached to tokens issued using the secret_id
+	Metadata map[string]string `yaml:"metadata"`
+	// CIDRList restricts the addresses the secret_id can be used from
+	CIDRList []string `yaml:"cidr_list"`
+	// TokenBoundCIDRs restricts the addresses tokens issued using the
+	// secret_id can be used from
+	TokenBoundCIDRs []string      `yaml:"token_bound_cidrs"`
+	TTL             time.Duration `yaml:"ttl"`
+	NumUses         int           `yaml:"num_uses"`
+}
+
+func (o *SecretIDOptions) mount() string {
+	if o.Mount == "" {
+		return "approle"
+	}
+	return strings.Trim(o.Mount, "/")
+}
+
+// rolePath returns the path of the role's endpoints, relative to the mount
+func (o *SecretIDOptions) rolePath(endpoint string) string {
+	return fmt.Sprintf("auth/%s/role/%s/%s", o.mount(), o.Role, endpoint)
+}
+
+// requestData builds the request used to generate a new secret_id
+func (o *SecretIDOptions) requestData() (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	if len(o.Metadata) > 0 {
+		// metadata is passed to vault as a json encoded string
+		metadata, err := json.Marshal(o.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		data["metadata"] = string(metadata)
+	}
+	if len(o.CIDRList) > 0 {
+		data["cidr_list"] = strings.Join(o.CIDRList, ",")
+	}
+	if len(o.TokenBoundCIDRs) > 0 {
+		data["token_bound_cidrs"] = strings.Join(o.TokenBoundCIDRs, ",")
+	}
+	if o.TTL.Seconds() > 0 {
+		data["ttl"] = int(o.TTL.Seconds())
+	}
+	if o.NumUses > 0 {
+		data["num_uses"] = o.NumUses
+	}
+	return data, nil
+}
+
+// generate generates a new secret_id using client
+func (o *SecretIDOptions) generate(client *vault.Client) (*vault.Secret, error) {
+	data, err := o.requestData()
+	if err != nil {
+		return nil, err
+	}
+	return client.Logical().Write(o.rolePath("secret-id"), data)
+}
+
+func (o *SecretIDOptions) validate() error {
+	if err := requireString("role", o.Role); err != nil {
+		return err
+	}
+	if o.NumUses < 0 {
+		return fmt.Errorf("num_uses must not be negative")
+	}
+	return nil
+}
@@ -6,33 +6,49 @@ import (
 	"strings"
 	"time"
 
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	multierror "github.com/hashicorp/go-multierror"
 	vault "github.com/hashicorp/vault/api"
+	"golang.org/x/crypto/ssh"
 )
 
 // SSHHostCertificate is a credential type for ssh host certificate creation
 type SSHHostCertificate struct {
-	PublicKeyFile     string          `yaml:"public_key_file"`
-	CertificateFile   *CredentialFile `yaml:"certificate_file"`
-	BackendMountPoint string          `yaml:"vault_backend_mount"`
-	LeaseDuration     time.Duration   `yaml:"lifetime"`
-	RoleName          string          `yaml:"role"`
-	ValidPrincipals   []string        `yaml:"valid_principals"`
-	Notifies          string          `yaml:"notifies"`
-	vaultClient       *vault.Client
-	renewer           *CredentialRenewer
+	Name              string  `yaml:"name"`
+	PublicKeyFile     string  `yaml:"public_key_file"`
+	CertificateFile   *Output `yaml:"certificate_file"`
+	BackendMountPoint string  `yaml:"vault_backend_mount"`
+	// Namespace overrides the vault namespace of the daemon's client
+	Namespace       string        `yaml:"namespace"`
+	LeaseDuration   time.Duration `yaml:"lifetime"`
+	RoleName        string        `yaml:"role"`
+	ValidPrincipals []string      `yaml:"valid_principals"`
+	Notifies        string        `yaml:"notifies"`
+	HealthCheck     *HealthCheck  `yaml:"health_check"`
+	vaultClient     *vault.Client
+	renewer         *CredentialRenewer
+	expiration      expirationTime
 }
 
 func (s *SSHHostCertificate) Initialize(vaultClient *vault.Client) error {
+	s.setup(vaultClient)
+	s.renewer.Renew()
+	return nil
+}
+
+// IssueOnce signs the host key without starting a renewal process
+func (s *SSHHostCertificate) IssueOnce(vaultClient *vault.Client, maxAttempts uint, runAction bool) error {
+	s.setup(vaultClient)
+	return s.renewer.RenewOnce(maxAttempts, runAction)
+}
+
+func (s *SSHHostCertificate) setup(vaultClient *vault.Client) {
 	s.vaultClient = vaultClient
+	useVaultClient(vaultClient, s.Files()...)
 
-	var postAction PostRenewAction
-	if s.Notifies != "" {
-		postAction = &ReloadOrRestartSystemdUnit{UnitName: s.Notifies}
-	}
+	postAction := notifyAction(s.Notifies, s.CertificateFile)
 	s.renewer = NewCredentialRenewer(s, postAction)
-	s.renewer.Renew()
-
-	return nil
+	s.renewer.HealthCheck = s.HealthCheck
 }
 
 func (s *SSHHostCertificate) Renew() error {
@@ -40,8 +56,7 @@ func (s *SSHHostCertificate) Renew() error {
 	if err != nil {
 		return err
 	}
-	s.write(secret)
-	return nil
+	return s.write(secret)
 }
 
 func (s *SSHHostCertificate) MaxRenewInterval() time.Duration {
@@ -56,6 +71,29 @@ func (s *SSHHostCertificate) Renewer() Renewer {
 	return s.renewer
 }
 
+// Files returns the local files written by this certificate
+func (s *SSHHostCertificate) Files() []*CredentialFile {
+	return outputFiles(s.CertificateFile)
+}
+
+// Validate checks that all required fields are set
+func (s *SSHHostCertificate) Validate() error {
+	var result *multierror.Error
+	result = multierror.Append(result,
+		requireString("public_key_file", s.PublicKeyFile),
+		requireString("role", s.RoleName),
+		requireString("vault_backend_mount", s.BackendMountPoint),
+	)
+	result = multierror.Append(result,
+		requireOutput("certificate_file", s.CertificateFile),
+		validateOutputs(s.CertificateFile),
+	)
+	if s.HealthCheck != nil {
+		result = multierror.Append(result, multierror.Prefix(s.HealthCheck.Validate(), "health_check:"))
+	}
+	return result.ErrorOrNil()
+}
+
 // signs the public key and writes the result to file, returning the secret and any errors
 func (s *SSHHostCertificate) sign() (*vault.Secret, error) {
 
@@ -68,7 +106,12 @@ func (s *SSHHostCertificate) sign() (*vault.Secret, error) {
 	keyData["public_key"] = string(publicKey)
 	keyData["cert_type"] = "host"
 	keyData["valid_principals"] = strings.Join(s.ValidPrincipals, ",")
-	secret, err := s.vaultClient.SSHWithMountPoint(s.BackendMountPoint).SignKey(s.RoleName, keyData)
+	client, err := namespacedClient(s.vaultClient, s.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := client.SSHWithMountPoint(s.BackendMountPoint).SignKey(s.RoleName, keyData)
 	if err != nil {
 		return nil, err
 	}
@@ -76,7 +119,22 @@ func (s *SSHHostCertificate) sign() (*vault.Secret, error) {
 }
 
 func (s *SSHHostCertificate) write(secret *vault.Secret) error {
-	return s.CertificateFile.Write(secret.Data["signed_key"].(string))
+	signedKey := secret.Data["signed_key"].(string)
+	if pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signedKey)); err == nil {
+		if cert, ok := pubKey.(*ssh.Certificate); ok {
+			s.expiration.set(time.Unix(int64(cert.ValidBefore), 0))
+		}
+	}
+	return s.CertificateFile.Write(signedKey)
+}
+
+// Expiration returns the expiration time of the current certificate
+func (s *SSHHostCertificate) Expiration() time.Time {
+	return s.expiration.get()
+}
+
+func (s *SSHHostCertificate) logFields() logging.Fields {
+	return credentialFields(s.Name, "ssh", s)
 }
 
 func (s *SSHHostCertificate) String() string {
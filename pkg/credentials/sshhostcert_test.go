@@ -102,7 +102,7 @@ func TestSSHCertManage(t *testing.T) {
 
 	cert := &SSHHostCertificate{
 		PublicKeyFile:     "test_data/ssh_host_key.pub",
-		CertificateFile:   certFile,
+		CertificateFile:   FileOutput(certFile),
 		BackendMountPoint: "ssh",
 		RoleName:          "testhost",
 		LeaseDuration:     1 * time.Second,
@@ -193,7 +193,7 @@ func getTestSSHHostCertificateInfo() (*SSHHostCertificate, string) {
 
 	cert := &SSHHostCertificate{
 		PublicKeyFile:     "test_data/ssh_host_key.pub",
-		CertificateFile:   certFile,
+		CertificateFile:   FileOutput(certFile),
 		BackendMountPoint: "ssh",
 		RoleName:          "testhost",
 		LeaseDuration:     72 * time.Hour,
@@ -226,7 +226,7 @@ func TestSSHHostCertificateUnmarshalYAML(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unable to unmarshal: %v", err)
 	}
-	dst.CertificateFile.populateUserGroupData()
+	dst.CertificateFile.File().populateUserGroupData()
 
 	if diff := deep.Equal(dst, expected); diff != nil {
 		t.Errorf("Unmarshaled not equal to expected:")
@@ -0,0 +1,97 @@
+package credentials
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const defaultCredentialStore = "/run/credstore"
+
+// SystemdCredentialOutput writes a credential to systemd's credential store for
+// units to load with LoadCredential=<name>.  The store directory is created
+// with mode 0700 and credentials are written read-only for their owner, as
+// systemd expects.  Units only load credentials when they start, so notified
+// units are restarted rather than reloaded.
+type SystemdCredentialOutput struct {
+	// CredentialName is the name passed to LoadCredential=
+	CredentialName string `yaml:"name"`
+	// Directory defaults to /run/credstore
+	Directory string `yaml:"directory"`
+}
+
+func (c *SystemdCredentialOutput) directory() string {
+	if c.Directory == "" {
+		return defaultCredentialStore
+	}
+	return c.Directory
+}
+
+// Write replaces the credential atomically so a starting unit never loads a
+// partially written credential
+func (c *SystemdCredentialOutput) Write(content string) error {
+	if err := os.MkdirAll(c.directory(), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(c.directory(), "."+c.CredentialName+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0400); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.Path())
+}
+
+func (c *SystemdCredentialOutput) Read() (string, error) {
+	contents, err := ioutil.ReadFile(c.Path())
+	return string(contents), err
+}
+
+// Remove deletes the credential, it is not an error if it doesn't exist
+func (c *SystemdCredentialOutput) Remove() error {
+	if err := os.Remove(c.Path()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *SystemdCredentialOutput) Path() string {
+	return filepath.Join(c.directory(), c.CredentialName)
+}
+
+// Validate checks that the name is usable as a credential name
+func (c *SystemdCredentialOutput) Validate() error {
+	var result *multierror.Error
+	result = multierror.Append(result, requireString("name", c.CredentialName))
+	if c.CredentialName == "." || c.CredentialName == ".." || strings.Contains(c.CredentialName, "/") {
+		result = multierror.Append(result, fmt.Errorf("invalid credential name '%s'", c.CredentialName))
+	}
+	if c.Directory != "" && !filepath.IsAbs(c.Directory) {
+		result = multierror.Append(result, fmt.Errorf("directory must be an absolute path"))
+	}
+	return result.ErrorOrNil()
+}
+
+func (c *SystemdCredentialOutput) readOnStart() bool {
+	return true
+}
+
+func (c *SystemdCredentialOutput) String() string {
+	return fmt.Sprintf("systemd credential %s", c.Path())
+}
@@ -0,0 +1,58 @@
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSystemdCredentialOutput(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "credstoretest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	c := &SystemdCredentialOutput{CredentialName: "app.db-password", Directory: filepath.Join(tempDir, "credstore")}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+	for _, contents := range []string{"hunter2", "hunter3"} {
+		if err := c.Write(contents); err != nil {
+			t.Fatalf("Unable to write credential: %v", err)
+		}
+		if read, err := c.Read(); err != nil || read != contents {
+			t.Errorf("Wrong credential read back: '%s' %v", read, err)
+		}
+	}
+
+	dirInfo, err := os.Stat(c.Directory)
+	if err != nil || dirInfo.Mode().Perm() != 0700 {
+		t.Errorf("Credential store should have mode 0700: %v %v", dirInfo.Mode(), err)
+	}
+	info, err := os.Stat(filepath.Join(c.Directory, "app.db-password"))
+	if err != nil || info.Mode().Perm() != 0400 {
+		t.Errorf("Credential should have mode 0400: %v %v", info.Mode(), err)
+	}
+	if entries, _ := ioutil.ReadDir(c.Directory); len(entries) != 1 {
+		t.Errorf("Temporary files left in credential store: %v", entries)
+	}
+
+	if err := c.Remove(); err != nil {
+		t.Errorf("Unable to remove credential: %v", err)
+	}
+	if _, err := c.Read(); !os.IsNotExist(err) {
+		t.Errorf("Credential not removed: %v", err)
+	}
+
+	for _, name := range []string{"", "..", "app/token"} {
+		c := &SystemdCredentialOutput{CredentialName: name}
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected error for credential name '%s'", name)
+		}
+	}
+	if c.Path() != filepath.Join(c.Directory, "app.db-password") || (&SystemdCredentialOutput{CredentialName: "x"}).Path() != "/run/credstore/x" {
+		t.Errorf("Wrong credential path: %s", c.Path())
+	}
+}
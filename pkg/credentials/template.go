@@ -2,42 +2,237 @@ package credentials
 
 import (
 	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
 	ctemplatecfg "github.com/hashicorp/consul-template/config"
 	ctemplatemgr "github.com/hashicorp/consul-template/manager"
+	multierror "github.com/hashicorp/go-multierror"
 	vault "github.com/hashicorp/vault/api"
 )
 
 type CredentialTemplateRenewer struct {
 	renewCh chan *RenewOutput
 	doneCh  chan error
+	source  *CredentialTemplate
+	action  PostRenewAction
+	// actionRetryInterval is the delay before the first retry of a failed post
+	// render action, doubling with each failure
+	actionRetryInterval time.Duration
+	// healthCheck is run after the post render action, a render it rejects is
+	// replaced by lastGood, the files as of the last accepted render
+	healthCheck *HealthCheck
+	checkLock   sync.Mutex
+	lastGood    []*credentialFileBackup
+	log         *logging.Logger
+	statusLock  sync.Mutex
+	status      RenewerStatus
 }
 
-func newCredentialTemplateRenewer(runner *ctemplatemgr.Runner, source *CredentialTemplate, action PostRenewAction) *CredentialTemplateRenewer {
-	r := &CredentialTemplateRenewer{}
+func newCredentialTemplateRenewer(source *CredentialTemplate, action PostRenewAction) *CredentialTemplateRenewer {
+	r := &CredentialTemplateRenewer{source: source, action: action, actionRetryInterval: 5 * time.Second}
 	r.renewCh = make(chan *RenewOutput)
 	r.doneCh = make(chan error)
+	r.log = credentialLogger(source)
+	return r
+}
 
+// watch forwards render events and errors from runner until it is stopped.
+// The runner may be replaced by a new one without disturbing consumers of the
+// renewer's channels.  A failed post render action is retried with backoff
+// until it succeeds or the templates are rendered again.
+func (r *CredentialTemplateRenewer) watch(runner *ctemplatemgr.Runner) {
 	go func() {
-		for _ = range runner.RenderEventCh() {
-			for _, e := range runner.RenderEvents() {
-				if e.DidRender {
-					r.renewCh <- &RenewOutput{Source: source, Message: "render completed", RenewalTime: e.LastDidRender}
-					if action != nil {
-						action.Do()
+		lastRendered := make(map[string]time.Time)
+		retryTimer := NewRenewTimer(time.Hour, time.Hour, r.actionRetryInterval, 10)
+		retryTimer.cancel()
+		defer retryTimer.Stop()
+		var retryCh <-chan time.Time
+
+		for {
+			select {
+			case <-runner.RenderEventCh():
+			case <-retryCh:
+				r.log.Info("action_retry", "Retrying post render action")
+				if err := r.runAction(); err != nil {
+					retryTimer.FailReset(0)
+					r.actionFailed(runner, err, retryTimer.Next())
+					continue
+				}
+				retryTimer.cancel()
+				retryCh = nil
+				if err := r.checkHealth(); err != nil {
+					r.checkFailed(runner, err)
+					continue
+				}
+				r.log.Info("action_succeeded", "Post render action succeeded after retrying")
+				continue
+			case <-runner.DoneCh:
+				return
+			}
+
+			// render events are kept for every template, only those rendered since
+			// the last notification are new
+			var rendered time.Time
+			for id, e := range runner.RenderEvents() {
+				if e.DidRender && e.LastDidRender.After(lastRendered[id]) {
+					lastRendered[id] = e.LastDidRender
+					if e.LastDidRender.After(rendered) {
+						rendered = e.LastDidRender
 					}
 				}
 			}
+			if rendered.IsZero() {
+				continue
+			}
+
+			r.statusLock.Lock()
+			r.status.LastRenewal = rendered
+			r.statusLock.Unlock()
+
+			// the action runs once for all of the templates rendered together,
+			// replacing any pending retry
+			retryTimer.cancel()
+			retryCh = nil
+			if err := r.runAction(); err != nil {
+				retryTimer.FailReset(0)
+				retryCh = retryTimer.C
+				r.log.Warn("credential_renewed", "Rendered template but post render action failed")
+				r.sendRenewal(runner, &RenewOutput{Source: r.source, Message: "rendered but action failed", RenewalTime: rendered, ActionFailed: true})
+				r.actionFailed(runner, err, retryTimer.Next())
+				continue
+			}
+			if err := r.checkHealth(); err != nil {
+				r.log.Warn("credential_renewed", "Rendered template but health check failed")
+				r.sendRenewal(runner, &RenewOutput{Source: r.source, Message: "rendered but health check failed", RenewalTime: rendered, ActionFailed: true})
+				r.checkFailed(runner, err)
+				continue
+			}
+
+			r.log.Info("credential_renewed", "Rendered template")
+			r.sendRenewal(runner, &RenewOutput{Source: r.source, Message: "render completed", RenewalTime: rendered})
 		}
 	}()
 
 	go func() {
-		for err := range runner.ErrCh {
-			r.doneCh <- err
+		for {
+			var err error
+			select {
+			case err = <-runner.ErrCh:
+			case <-runner.DoneCh:
+				return
+			}
+
+			r.statusLock.Lock()
+			r.status.FailureCount++
+			r.status.LastError = err.Error()
+			r.statusLock.Unlock()
+
+			r.log.Error("renewal_failed", "Error rendering template", logging.Fields{"error": err})
+
+			r.sendError(runner, ErrRenewalFailed{Source: r.source, Err: err})
 		}
 	}()
+}
 
-	return r
+// sendRenewal reports a render, giving up if runner is stopped before the
+// render is received so that a removed renewer doesn't leak the goroutine
+func (r *CredentialTemplateRenewer) sendRenewal(runner *ctemplatemgr.Runner, output *RenewOutput) {
+	select {
+	case r.renewCh <- output:
+	case <-runner.DoneCh:
+	}
+}
+
+// sendError reports an error, giving up if runner is stopped before the error
+// is received
+func (r *CredentialTemplateRenewer) sendError(runner *ctemplatemgr.Runner, err error) {
+	select {
+	case r.doneCh <- err:
+	case <-runner.DoneCh:
+	}
+}
+
+// runAction runs the post render action, recording success in the status
+func (r *CredentialTemplateRenewer) runAction() error {
+	if r.action != nil {
+		if err := r.action.Do(); err != nil {
+			return err
+		}
+	}
+
+	r.statusLock.Lock()
+	r.status.FailureCount = 0
+	r.status.LastError = ""
+	r.status.NextRenewal = time.Time{}
+	r.statusLock.Unlock()
+	return nil
+}
+
+// snapshot saves the template output files as the last accepted render
+func (r *CredentialTemplateRenewer) snapshot() error {
+	if r.healthCheck == nil {
+		return nil
+	}
+	backups, err := backupOutputs(r.source)
+	if err != nil {
+		return err
+	}
+	r.lastGood = backups
+	return nil
+}
+
+// checkHealth runs the health check after a successful post render action.  A
+// rejected render is replaced by the last accepted one, which is kept until
+// consul-template renders the templates again.
+func (r *CredentialTemplateRenewer) checkHealth() error {
+	if r.healthCheck == nil {
+		return nil
+	}
+	r.checkLock.Lock()
+	defer r.checkLock.Unlock()
+
+	if checkErr := r.healthCheck.Check(); checkErr != nil {
+		if err := restoreOutputs(r.lastGood, r.action); err != nil {
+			return fmt.Errorf("%v -- error rolling back: %v", checkErr, err)
+		}
+		return checkErr
+	}
+	if err := r.snapshot(); err != nil {
+		// the render is in use, it just can't be restored later
+		r.log.Warn("backup_failed", "Unable to save accepted render", logging.Fields{"error": err})
+	}
+	return nil
+}
+
+// checkFailed records and reports a render rejected by the health check.  The
+// rejected render isn't retried.
+func (r *CredentialTemplateRenewer) checkFailed(runner *ctemplatemgr.Runner, err error) {
+	err = fmt.Errorf("health check failed after rendering %s: %v", r.source, err)
+	r.statusLock.Lock()
+	r.status.FailureCount++
+	r.status.LastError = err.Error()
+	r.statusLock.Unlock()
+
+	r.log.Error("health_check_failed", "Health check failed, restored previous render", logging.Fields{"error": err})
+	r.sendError(runner, ErrActionFailed{Source: r.source, Err: err})
+}
+
+// actionFailed records and reports a failed post render action
+func (r *CredentialTemplateRenewer) actionFailed(runner *ctemplatemgr.Runner, err error, retry time.Time) {
+	err = fmt.Errorf("error while executing post render action: %v", err)
+	r.statusLock.Lock()
+	r.status.FailureCount++
+	r.status.LastError = err.Error()
+	r.status.NextRenewal = retry
+	r.statusLock.Unlock()
+
+	r.log.Error("action_failed", "Post render action failed", logging.Fields{"error": err, "next_retry": retry})
+	r.sendError(runner, ErrActionFailed{Source: r.source, Err: err})
 }
 
 func (r *CredentialTemplateRenewer) RenewCh() <-chan *RenewOutput {
@@ -48,53 +243,452 @@ func (r *CredentialTemplateRenewer) DoneCh() <-chan error {
 	return r.doneCh
 }
 
-// CredentialTemplate wraps an invocation of consul-template, using the vault
-// token and address configured for the vaultClient
-type CredentialTemplate struct {
+// Status returns the current state of the renewer.  Templates are rendered
+// whenever their dependencies change, so the only scheduled renewal is the
+// retry of a failed post render action.  Templates can't be renewed, paused
+// or resumed on demand since consul-template renders them as soon as their
+// dependencies change.
+func (r *CredentialTemplateRenewer) Status() RenewerStatus {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	return r.status
+}
+
+// TemplateVaultConfig holds the settings of the daemon's vault client that
+// can't be read back from the client, so that consul-template can connect to
+// vault the same way.
+type TemplateVaultConfig struct {
+	TLS     vault.TLSConfig
+	Timeout time.Duration
+}
+
+// TemplateWait is the minimum and maximum time to wait for a template's
+// dependencies to settle before rendering it
+type TemplateWait struct {
+	Min time.Duration `yaml:"min"`
+	Max time.Duration `yaml:"max"`
+}
+
+// TemplateOutput is a template and the file it is rendered to.  The template
+// is read from TemplateFile, or given inline as Contents.
+type TemplateOutput struct {
 	TemplateFile string          `yaml:"template_file"`
+	Contents     string          `yaml:"contents"`
 	OutputFile   *CredentialFile `yaml:"output_file"`
-	Notifies     string          `yaml:"notifies"`
-	vaultClient  *vault.Client
-	renewer      *CredentialTemplateRenewer
-	runner       *ctemplatemgr.Runner
+}
+
+func (o *TemplateOutput) validate() error {
+	var result *multierror.Error
+	if (o.TemplateFile == "") == (o.Contents == "") {
+		result = multierror.Append(result, fmt.Errorf("exactly one of template_file or contents is required"))
+	}
+	result = multierror.Append(result, requireFile("output_file", o.OutputFile))
+	if o.OutputFile != nil && o.OutputFile.Encryption != nil {
+		// consul-template writes the output file itself
+		result = multierror.Append(result, fmt.Errorf("output_file: encryption isn't supported for templates"))
+	}
+	return result.ErrorOrNil()
+}
+
+// CredentialTemplate wraps an invocation of consul-template, using the vault
+// token and address configured for the vaultClient.  A single template may be
+// configured directly on the credential, and any number more listed under
+// templates.  All of them are rendered by the same runner and share the post
+// render action.
+type CredentialTemplate struct {
+	Name           string            `yaml:"name"`
+	TemplateFile   string            `yaml:"template_file"`
+	Contents       string            `yaml:"contents"`
+	OutputFile     *CredentialFile   `yaml:"output_file"`
+	Templates      []*TemplateOutput `yaml:"templates"`
+	Notifies       string            `yaml:"notifies"`
+	Wait           *TemplateWait     `yaml:"wait"`
+	LeftDelimiter  string            `yaml:"left_delimiter"`
+	RightDelimiter string            `yaml:"right_delimiter"`
+	// Command is run by consul-template after each render
+	Command string `yaml:"command"`
+	// Backup keeps the previous output as <output_file>.bak
+	Backup            bool         `yaml:"backup"`
+	ErrorOnMissingKey bool         `yaml:"error_on_missing_key"`
+	HealthCheck       *HealthCheck `yaml:"health_check"`
+	vaultClient       *vault.Client
+	vaultConfig       TemplateVaultConfig
+	renewer           *CredentialTemplateRenewer
+	runnerLock        sync.Mutex
+	runner            *ctemplatemgr.Runner
+	// token the runner was started with
+	token string
+}
+
+// SetVaultConfig sets the connection settings consul-template uses to connect
+// to vault, it must be called before Initialize or IssueOnce
+func (t *CredentialTemplate) SetVaultConfig(config TemplateVaultConfig) {
+	t.vaultConfig = config
 }
 
 func (t *CredentialTemplate) Initialize(vaultClient *vault.Client) error {
 	t.vaultClient = vaultClient
+	t.renewer = newCredentialTemplateRenewer(t, t.postRenderAction())
+	t.renewer.healthCheck = t.HealthCheck
+	if err := t.renewer.snapshot(); err != nil {
+		return fmt.Errorf("unable to backup existing files for %s: %v", t, err)
+	}
+
+	t.runnerLock.Lock()
+	defer t.runnerLock.Unlock()
+	return t.startRunner()
+}
+
+// startRunner starts a consul-template runner using the current token of the
+// vault client.  The caller must hold runnerLock.
+func (t *CredentialTemplate) startRunner() error {
+	cfg, err := t.runnerConfig()
+	if err != nil {
+		return err
+	}
+	t.token = t.vaultClient.Token()
+
+	runner, err := ctemplatemgr.NewRunner(cfg, false, false)
+	if err != nil {
+		return fmt.Errorf("error creating consult-template runner: %v", err)
+	}
+	t.runner = runner
+
+	t.renewer.watch(runner)
+	go runner.Start()
+	return nil
+}
+
+// TokenChanged restarts the consul-template runner so that it uses the vault
+// client's new token.  The renewer is kept, so the restart is invisible to
+// consumers of its channels.
+func (t *CredentialTemplate) TokenChanged() error {
+	t.runnerLock.Lock()
+	defer t.runnerLock.Unlock()
+
+	if t.runner != nil && t.token == t.vaultClient.Token() {
+		return nil
+	}
+	if t.runner != nil {
+		t.runner.Stop()
+	}
+	return t.startRunner()
+}
+
+// ClientCertificateChanged restarts the consul-template runner, which only
+// loads the client certificate when it starts.  Like TokenChanged, the
+// restart is invisible to consumers of the renewer's channels.
+func (t *CredentialTemplate) ClientCertificateChanged() error {
+	t.runnerLock.Lock()
+	defer t.runnerLock.Unlock()
+
+	if t.runner == nil {
+		// not running yet, the runner loads the certificate when it's started
+		return nil
+	}
+	t.runner.Stop()
+	return t.startRunner()
+}
+
+// IssueOnce renders the template a single time, running the post render
+// action and health check afterwards if runAction is true.  The previous
+// files are restored if the health check fails.
+func (t *CredentialTemplate) IssueOnce(vaultClient *vault.Client, maxAttempts uint, runAction bool) error {
+	t.vaultClient = vaultClient
+	cfg, err := t.runnerConfig()
+	if err != nil {
+		return err
+	}
+	var backups []*credentialFileBackup
+	if runAction && t.HealthCheck != nil {
+		backups, err = backupOutputs(t)
+		if err != nil {
+			return fmt.Errorf("unable to backup existing files for %s: %v", t, err)
+		}
+	}
+	cfg.Vault.Retry.Attempts = ctemplatecfg.Int(int(maxAttempts))
+
+	runner, err := ctemplatemgr.NewRunner(cfg, false, true)
+	if err != nil {
+		return fmt.Errorf("error creating consult-template runner: %v", err)
+	}
+	go runner.Start()
+	defer runner.Stop()
+
+	select {
+	case err := <-runner.ErrCh:
+		return fmt.Errorf("error rendering %s: %v", t, err)
+	case <-runner.DoneCh:
+	}
+
+	if !runAction {
+		return nil
+	}
+	action := t.postRenderAction()
+	if action != nil {
+		if err := action.Do(); err != nil {
+			return err
+		}
+	}
+	if t.HealthCheck != nil {
+		if checkErr := t.HealthCheck.Check(); checkErr != nil {
+			if err := restoreOutputs(backups, action); err != nil {
+				return fmt.Errorf("health check failed after rendering %s: %v -- error rolling back: %v", t, checkErr, err)
+			}
+			return fmt.Errorf("health check failed after rendering %s: %v", t, checkErr)
+		}
+	}
+	return nil
+}
+
+// backupOutputs saves the current contents of the template's output files
+func backupOutputs(t *CredentialTemplate) ([]*credentialFileBackup, error) {
+	outputs := t.outputs()
+	backups := make([]*credentialFileBackup, 0, len(outputs))
+	for _, output := range outputs {
+		b, err := output.OutputFile.backup()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, b)
+	}
+	return backups, nil
+}
+
+// restoreOutputs restores the template's output files from backups and re-runs
+// the post render action so that the service picks the old files back up
+func restoreOutputs(backups []*credentialFileBackup, action PostRenewAction) error {
+	previous := false
+	for _, b := range backups {
+		previous = previous || b.existed
+	}
+	if !previous {
+		return fmt.Errorf("no previous render available")
+	}
+
+	for _, b := range backups {
+		if err := b.restore(); err != nil {
+			return err
+		}
+	}
+	if action != nil {
+		return action.Do()
+	}
+	return nil
+}
+
+// directOutput returns the template configured directly on the credential,
+// or nil if there is none
+func (t *CredentialTemplate) directOutput() *TemplateOutput {
+	if t.TemplateFile == "" && t.Contents == "" && t.OutputFile == nil {
+		return nil
+	}
+	return &TemplateOutput{TemplateFile: t.TemplateFile, Contents: t.Contents, OutputFile: t.OutputFile}
+}
+
+// outputs returns every template rendered by the credential
+func (t *CredentialTemplate) outputs() []*TemplateOutput {
+	outputs := make([]*TemplateOutput, 0, len(t.Templates)+1)
+	if direct := t.directOutput(); direct != nil {
+		outputs = append(outputs, direct)
+	}
+	return append(outputs, t.Templates...)
+}
+
+// runnerConfig builds the consul-template configuration for this template,
+// connecting to vault with the current token and the connection settings of
+// the daemon's client
+func (t *CredentialTemplate) runnerConfig() (*ctemplatecfg.Config, error) {
 	cfg := ctemplatecfg.DefaultConfig()
-	vaultAddress := vaultClient.Address()
-	vaultToken := vaultClient.Token()
+	vaultAddress := t.vaultClient.Address()
+	vaultToken := t.vaultClient.Token()
+	// an empty namespace overrides VAULT_NAMESPACE in the environment, matching
+	// the daemon's client
+	vaultNamespace := t.vaultClient.Headers().Get("X-Vault-Namespace")
 	myVault := &ctemplatecfg.VaultConfig{
 		Address:    &vaultAddress,
+		Namespace:  &vaultNamespace,
 		Token:      &vaultToken,
 		RenewToken: ctemplatecfg.Bool(false),
+		SSL:        templateSSLConfig(vaultAddress, t.vaultConfig.TLS),
+	}
+	if timeout := t.vaultConfig.Timeout; timeout > 0 {
+		myVault.Transport = &ctemplatecfg.TransportConfig{
+			DialTimeout:         ctemplatecfg.TimeDuration(timeout),
+			TLSHandshakeTimeout: ctemplatecfg.TimeDuration(timeout),
+		}
 	}
 	cfg.Vault = cfg.Vault.Merge(myVault)
+
+	templateConfigs := ctemplatecfg.TemplateConfigs{}
+	for _, output := range t.outputs() {
+		templateConfigs = append(templateConfigs, t.templateConfig(output))
+	}
+	cfg.Templates = &templateConfigs
+	return cfg, nil
+}
+
+// templateConfig builds the consul-template configuration for one output
+func (t *CredentialTemplate) templateConfig(output *TemplateOutput) *ctemplatecfg.TemplateConfig {
 	templateConfig := ctemplatecfg.DefaultTemplateConfig()
-	outputPath := t.OutputFile.Path()
-	templateConfig.Destination = &outputPath
-	templateConfig.Source = &t.TemplateFile
-	templateConfig.Perms = &t.OutputFile.Mode
+	templateConfig.Destination = ctemplatecfg.String(output.OutputFile.Path())
+	if output.Contents != "" {
+		templateConfig.Contents = ctemplatecfg.String(output.Contents)
+	} else {
+		templateConfig.Source = ctemplatecfg.String(output.TemplateFile)
+	}
+	templateConfig.Perms = &output.OutputFile.Mode
 	templateConfig.CreateDestDirs = ctemplatecfg.Bool(true)
+	templateConfig.Backup = ctemplatecfg.Bool(t.Backup)
+	templateConfig.ErrMissingKey = ctemplatecfg.Bool(t.ErrorOnMissingKey)
+	if t.Command != "" {
+		// consul-template runs identical commands once per render
+		templateConfig.Command = ctemplatecfg.String(t.Command)
+	}
+	if t.LeftDelimiter != "" {
+		templateConfig.LeftDelim = ctemplatecfg.String(t.LeftDelimiter)
+	}
+	if t.RightDelimiter != "" {
+		templateConfig.RightDelim = ctemplatecfg.String(t.RightDelimiter)
+	}
+	if t.Wait != nil {
+		templateConfig.Wait = &ctemplatecfg.WaitConfig{
+			Enabled: ctemplatecfg.Bool(true),
+			Min:     ctemplatecfg.TimeDuration(t.Wait.Min),
+		}
+		if t.Wait.Max > 0 {
+			// consul-template defaults max to 4 times min
+			templateConfig.Wait.Max = ctemplatecfg.TimeDuration(t.Wait.Max)
+		}
+	}
+	return templateConfig
+}
 
-	cfg.Templates = &ctemplatecfg.TemplateConfigs{templateConfig}
-
-	runner, err := ctemplatemgr.NewRunner(cfg, false, false)
-	if err != nil {
-		return fmt.Errorf("error creating consult-template runner: %v", err)
+// templateSSLConfig converts the TLS settings of the daemon's vault client to
+// consul-template's SSL configuration
+func templateSSLConfig(address string, tlsConfig vault.TLSConfig) *ctemplatecfg.SSLConfig {
+	ssl := &ctemplatecfg.SSLConfig{
+		Enabled: ctemplatecfg.Bool(strings.HasPrefix(address, "https://")),
+		Verify:  ctemplatecfg.Bool(!tlsConfig.Insecure),
 	}
-	t.runner = runner
+	if tlsConfig.CACert != "" {
+		ssl.CaCert = ctemplatecfg.String(tlsConfig.CACert)
+	}
+	if tlsConfig.CAPath != "" {
+		ssl.CaPath = ctemplatecfg.String(tlsConfig.CAPath)
+	}
+	if tlsConfig.ClientCert != "" && tlsConfig.ClientKey != "" {
+		ssl.Cert = ctemplatecfg.String(tlsConfig.ClientCert)
+		ssl.Key = ctemplatecfg.String(tlsConfig.ClientKey)
+	}
+	if tlsConfig.TLSServerName != "" {
+		ssl.ServerName = ctemplatecfg.String(tlsConfig.TLSServerName)
+	}
+	return ssl
+}
 
-	var action PostRenewAction
+func (t *CredentialTemplate) postRenderAction() PostRenewAction {
 	if t.Notifies != "" {
-		action = &ReloadOrRestartSystemdUnit{UnitName: t.Notifies}
+		return &ReloadOrRestartSystemdUnit{UnitName: t.Notifies}
+	}
+	return nil
+}
+
+// Validate checks that all required fields are set and that the templates parse
+func (t *CredentialTemplate) Validate() error {
+	var result *multierror.Error
+	if len(t.outputs()) == 0 {
+		result = multierror.Append(result, fmt.Errorf("one of template_file, contents or templates is required"))
+	}
+	if t.Wait != nil && t.Wait.Max > 0 && t.Wait.Max < t.Wait.Min {
+		result = multierror.Append(result, fmt.Errorf("wait: max must not be shorter than min"))
+	}
+	if t.HealthCheck != nil {
+		result = multierror.Append(result, multierror.Prefix(t.HealthCheck.Validate(), "health_check:"))
+	}
+
+	destinations := make(map[string]bool)
+	check := func(prefix string, output *TemplateOutput) {
+		prefixed := func(err error) error {
+			if prefix == "" {
+				return err
+			}
+			return multierror.Prefix(err, prefix)
+		}
+
+		if err := output.validate(); err != nil {
+			result = multierror.Append(result, prefixed(err))
+			return
+		}
+		if destinations[output.OutputFile.Path()] {
+			result = multierror.Append(result, prefixed(fmt.Errorf("duplicate output_file '%s'", output.OutputFile.Path())))
+		}
+		destinations[output.OutputFile.Path()] = true
+		if err := t.parse(output); err != nil {
+			result = multierror.Append(result, prefixed(err))
+		}
+	}
+
+	if direct := t.directOutput(); direct != nil {
+		check("", direct)
+	}
+	for i, output := range t.Templates {
+		check(fmt.Sprintf("templates[%d]:", i), output)
+	}
+	return result.ErrorOrNil()
+}
+
+// consulTemplateFuncs are the functions consul-template makes available to
+// templates.  consul-template doesn't export them, TestConsulTemplateFuncs
+// checks the list against the version in go.mod.
+var consulTemplateFuncs = []string{
+	"datacenters", "file", "key", "keyExists", "keyOrDefault", "ls", "node",
+	"nodes", "secret", "secrets", "service", "services", "tree", "scratch",
+	"base64Decode", "base64Encode", "base64URLDecode", "base64URLEncode",
+	"byKey", "byTag", "contains", "containsAll", "containsAny", "containsNone",
+	"containsNotAll", "env", "executeTemplate", "explode", "in", "indent",
+	"loop", "join", "trimSpace", "parseBool", "parseFloat", "parseInt",
+	"parseJSON", "parseUint", "plugin", "regexReplaceAll", "regexMatch",
+	"replaceAll", "timestamp", "toLower", "toJSON", "toJSONPretty", "toTitle",
+	"toTOML", "toUpper", "toYAML", "split", "add", "subtract", "multiply",
+	"divide", "modulo",
+}
+
+// consulTemplateFuncStubs returns stand-ins for the consul-template functions,
+// templates are only parsed so the functions are never called
+func consulTemplateFuncStubs() template.FuncMap {
+	funcs := make(template.FuncMap, len(consulTemplateFuncs))
+	for _, name := range consulTemplateFuncs {
+		funcs[name] = func(...interface{}) (interface{}, error) { return nil, nil }
+	}
+	return funcs
+}
+
+// parse checks that a template parses
+func (t *CredentialTemplate) parse(output *TemplateOutput) error {
+	field, source := "contents", output.Contents
+	if output.Contents == "" {
+		field = "template_file"
+		contents, err := ioutil.ReadFile(output.TemplateFile)
+		if err != nil {
+			return fmt.Errorf("%s: %v", field, err)
+		}
+		source = string(contents)
+	}
+
+	_, err := template.New(output.OutputFile.Path()).
+		Delims(t.LeftDelimiter, t.RightDelimiter).
+		Funcs(consulTemplateFuncStubs()).
+		Parse(source)
+	if err != nil {
+		return fmt.Errorf("%s: %v", field, err)
 	}
-	t.renewer = newCredentialTemplateRenewer(t.runner, t, action)
-	go t.runner.Start()
 	return nil
 }
 
 func (t *CredentialTemplate) Stop() {
+	t.runnerLock.Lock()
+	defer t.runnerLock.Unlock()
 	t.runner.Stop()
 }
 
@@ -102,6 +696,16 @@ func (t *CredentialTemplate) Renewer() Renewer {
 	return t.renewer
 }
 
+func (t *CredentialTemplate) logFields() logging.Fields {
+	return credentialFields(t.Name, "template", t)
+}
+
 func (t *CredentialTemplate) String() string {
-	return fmt.Sprintf("Template for: %s", t.OutputFile.Path())
+	paths := []string{}
+	for _, output := range t.outputs() {
+		if output.OutputFile != nil {
+			paths = append(paths, output.OutputFile.Path())
+		}
+	}
+	return fmt.Sprintf("Template for: %s", strings.Join(paths, ", "))
 }
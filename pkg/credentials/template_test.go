@@ -2,15 +2,26 @@ package credentials
 
 import (
 	"context"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	vaulttest "github.com/PolarGeospatialCenter/dockertest/pkg/vault"
 	"github.com/PolarGeospatialCenter/vaulthelper/pkg/vaulthelper"
 	"github.com/go-test/deep"
+	ctemplatemgr "github.com/hashicorp/consul-template/manager"
+	multierror "github.com/hashicorp/go-multierror"
 	vault "github.com/hashicorp/vault/api"
 	yaml "gopkg.in/yaml.v1"
 )
@@ -182,3 +193,570 @@ func TestCredentialTemplateUnmarshalYAML(t *testing.T) {
 	}
 
 }
+
+func TestCredentialTemplateTokenChanged(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "templatetest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	templateFile := filepath.Join(tempDir, "foo.tmpl.yml")
+	err = ioutil.WriteFile(templateFile, []byte(`{{ with secret "kv1/client-data/bar" }}{{ .Data.value }}{{ end }}`), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write template: %v", err)
+	}
+
+	outFile, err := NewCredentialFile(filepath.Join(tempDir, "foo.yml"), 0600, "", "")
+	if err != nil {
+		t.Fatalf("Unable to create output CredentialFile: %v", err)
+	}
+
+	tmpl := &CredentialTemplate{TemplateFile: templateFile, OutputFile: outFile}
+
+	ctx := context.Background()
+	vaultInstance, err := vaulttest.Run(ctx)
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	defer vaultInstance.Stop(ctx)
+
+	vaultClient, err := vault.NewClient(vaultInstance.Config())
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	vaultClient.SetToken(vaultInstance.RootToken())
+
+	err = mountV1KVBackend(vaultClient, "kv1")
+	if err != nil {
+		t.Fatalf("Unable to mount v1 of kv backend: %v", err)
+	}
+
+	k := vaulthelper.NewKV(vaultClient, "kv1", 1)
+	writeValue := func(value string) {
+		err := k.Write("client-data/bar", map[string]interface{}{"value": value, "ttl": "1s"}, nil)
+		if err != nil {
+			t.Fatalf("Unable to write test secret data: %v", err)
+		}
+	}
+
+	expectRender := func(expected string) {
+		select {
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for render of: %s", expected)
+		case <-tmpl.Renewer().RenewCh():
+			contents, err := outFile.Read()
+			if err != nil {
+				t.Fatalf("Unable to read from output file: %v", err)
+			}
+			if contents != expected {
+				t.Errorf("Rendered output file doesn't match expected value: actual: '%s', expected: '%s'", contents, expected)
+			}
+		case err := <-tmpl.Renewer().DoneCh():
+			t.Fatalf("Error rendering %s: %v", expected, err)
+		}
+	}
+
+	oldSecret, err := vaultClient.Auth().Token().CreateOrphan(&vault.TokenCreateRequest{})
+	if err != nil {
+		t.Fatalf("Unable to create token: %v", err)
+	}
+	newSecret, err := vaultClient.Auth().Token().CreateOrphan(&vault.TokenCreateRequest{})
+	if err != nil {
+		t.Fatalf("Unable to create token: %v", err)
+	}
+
+	writeValue("old token")
+	client, err := vaultClient.Clone()
+	if err != nil {
+		t.Fatalf("Unable to clone vault client: %v", err)
+	}
+	client.SetToken(oldSecret.Auth.ClientToken)
+
+	err = tmpl.Initialize(client)
+	if err != nil {
+		t.Fatalf("Unable to run Initialize(): %v", err)
+	}
+	defer tmpl.Stop()
+	expectRender("old token")
+
+	err = vaultClient.Auth().Token().RevokeOrphan(oldSecret.Auth.ClientToken)
+	if err != nil {
+		t.Fatalf("Unable to revoke old token: %v", err)
+	}
+
+	client.SetToken(newSecret.Auth.ClientToken)
+	err = tmpl.TokenChanged()
+	if err != nil {
+		t.Fatalf("Unable to update token: %v", err)
+	}
+
+	writeValue("new token")
+	expectRender("new token")
+}
+
+func TestCredentialTemplateRunnerConfig(t *testing.T) {
+	outFile := &CredentialFile{FilePath: "/test/foo.yml", Mode: 0600}
+	tmpl := &CredentialTemplate{
+		TemplateFile:      "test_data/foo.tmpl.yml",
+		OutputFile:        outFile,
+		Wait:              &TemplateWait{Min: 2 * time.Second},
+		LeftDelimiter:     "[[",
+		RightDelimiter:    "]]",
+		Command:           "systemctl reload foo",
+		Backup:            true,
+		ErrorOnMissingKey: true,
+	}
+
+	config := vault.DefaultConfig()
+	config.Address = "https://vault.example.com:8200"
+	vaultClient, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	vaultClient.SetToken("test-token")
+	tmpl.vaultClient = vaultClient
+
+	tmpl.SetVaultConfig(TemplateVaultConfig{
+		TLS:     vault.TLSConfig{CACert: "/test/ca.crt", ClientCert: "/test/client.crt", ClientKey: "/test/client.key"},
+		Timeout: 2 * time.Second,
+	})
+
+	cfg, err := tmpl.runnerConfig()
+	if err != nil {
+		t.Fatalf("Unable to build runner config: %v", err)
+	}
+	cfg.Finalize()
+
+	ssl := cfg.Vault.SSL
+	if !*ssl.Enabled || !*ssl.Verify || *ssl.CaCert != "/test/ca.crt" || *ssl.Cert != "/test/client.crt" || *ssl.Key != "/test/client.key" {
+		t.Errorf("Vault TLS settings not passed to consul-template: %#v", ssl)
+	}
+	if *cfg.Vault.Token != "test-token" || *cfg.Vault.Transport.DialTimeout != 2*time.Second {
+		t.Errorf("Vault client settings not passed to consul-template: %#v", cfg.Vault)
+	}
+
+	templateConfig := (*cfg.Templates)[0]
+	if *templateConfig.LeftDelim != "[[" || *templateConfig.RightDelim != "]]" || *templateConfig.Command != "systemctl reload foo" {
+		t.Errorf("Template settings not passed to consul-template: %#v", templateConfig)
+	}
+	if !*templateConfig.Backup || !*templateConfig.ErrMissingKey {
+		t.Errorf("Template options not passed to consul-template: %#v", templateConfig)
+	}
+	if !*templateConfig.Wait.Enabled || *templateConfig.Wait.Min != 2*time.Second || *templateConfig.Wait.Max != 8*time.Second {
+		t.Errorf("Wrong template wait settings: %#v", templateConfig.Wait)
+	}
+
+	vaultClient.SetNamespace("infra")
+	cfg, err = tmpl.runnerConfig()
+	if err != nil {
+		t.Fatalf("Unable to build runner config for a namespaced client: %v", err)
+	}
+	cfg.Finalize()
+	if *cfg.Vault.Namespace != "infra" {
+		t.Errorf("Vault namespace not passed to consul-template: %v", *cfg.Vault.Namespace)
+	}
+}
+
+// countingAction counts how many times it has been run
+type countingAction struct {
+	lock  sync.Mutex
+	count int
+}
+
+func (a *countingAction) Do() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.count++
+	return nil
+}
+
+func (a *countingAction) Count() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.count
+}
+
+func TestCredentialTemplateMultipleOutputs(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "templatetest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	templateFile := filepath.Join(tempDir, "second.tmpl")
+	if err := ioutil.WriteFile(templateFile, []byte(`second`), 0644); err != nil {
+		t.Fatalf("Unable to write template: %v", err)
+	}
+
+	first := &CredentialFile{FilePath: filepath.Join(tempDir, "first"), Mode: 0600}
+	second := &CredentialFile{FilePath: filepath.Join(tempDir, "second"), Mode: 0600}
+	tmpl := &CredentialTemplate{
+		Templates: []*TemplateOutput{
+			{Contents: `first`, OutputFile: first},
+			{TemplateFile: templateFile, OutputFile: second},
+		},
+	}
+	if err := tmpl.Validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+
+	// the templates don't use vault, so no server is needed
+	vaultClient, err := vault.NewClient(vault.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	tmpl.vaultClient = vaultClient
+
+	action := &countingAction{}
+	tmpl.renewer = newCredentialTemplateRenewer(tmpl, action)
+	tmpl.runnerLock.Lock()
+	err = tmpl.startRunner()
+	tmpl.runnerLock.Unlock()
+	if err != nil {
+		t.Fatalf("Unable to start runner: %v", err)
+	}
+	defer tmpl.Stop()
+
+	select {
+	case <-tmpl.Renewer().RenewCh():
+	case err := <-tmpl.Renewer().DoneCh():
+		t.Fatalf("Error rendering templates: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for templates to render")
+	}
+
+	for _, f := range []*CredentialFile{first, second} {
+		contents, err := f.Read()
+		if err != nil || contents != filepath.Base(f.Path()) {
+			t.Errorf("Wrong contents rendered to %s: '%s' %v", f.Path(), contents, err)
+		}
+	}
+
+	select {
+	case <-tmpl.Renewer().RenewCh():
+		t.Errorf("Templates rendered together reported more than once")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if count := action.Count(); count != 1 {
+		t.Errorf("Expected action to run once for all templates, ran %d times", count)
+	}
+}
+
+func TestCredentialTemplateRenewerStoppedRunner(t *testing.T) {
+	renewer := newCredentialTemplateRenewer(&CredentialTemplate{}, nil)
+	runner := &ctemplatemgr.Runner{DoneCh: make(chan struct{})}
+	close(runner.DoneCh)
+
+	// nothing reads the channels of a removed renewer, sending must give up
+	// once the runner is stopped
+	sent := make(chan bool)
+	go func() {
+		renewer.sendRenewal(runner, &RenewOutput{Source: renewer.source})
+		renewer.sendError(runner, fmt.Errorf("render failed"))
+		sent <- true
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("Sending on the channels of a stopped runner blocked")
+	}
+}
+
+func TestCredentialTemplateValidate(t *testing.T) {
+	tmpl := &CredentialTemplate{
+		Contents:   `{{ with secret "kv/foo" }}{{ .Data.value }}{{ end }}`,
+		OutputFile: &CredentialFile{FilePath: "/test/foo"},
+		Templates: []*TemplateOutput{
+			{Contents: `{{ .Data.value `, OutputFile: &CredentialFile{FilePath: "/test/bar"}},
+			{Contents: `foo`, TemplateFile: "test_data/foo.tmpl", OutputFile: &CredentialFile{FilePath: "/test/baz"}},
+			{Contents: `foo`, OutputFile: &CredentialFile{FilePath: "/test/foo"}},
+		},
+	}
+
+	err := tmpl.Validate()
+	if err == nil {
+		t.Fatalf("Expected validation errors")
+	}
+
+	expected := []string{
+		"templates[0]: contents:",
+		"templates[1]: exactly one of template_file or contents is required",
+		"templates[2]: duplicate output_file '/test/foo'",
+	}
+	errs := err.(*multierror.Error).Errors
+	if len(errs) != len(expected) {
+		t.Fatalf("Wrong number of validation errors, expected %d got %d: %v", len(expected), len(errs), err)
+	}
+	for i, e := range errs {
+		if !strings.HasPrefix(e.Error(), expected[i]) {
+			t.Errorf("Unexpected validation error, expected '%s' got '%s'", expected[i], e)
+		}
+	}
+}
+
+func TestCredentialTemplateParse(t *testing.T) {
+	tmpl := &CredentialTemplate{LeftDelimiter: "[[", RightDelimiter: "]]"}
+	output := &TemplateOutput{
+		Contents:   `[[ with secret "pki/issue/web" "common_name=foo.local" ]][[ .Data.certificate | toJSON ]][[ end ]] {{ literal }}`,
+		OutputFile: &CredentialFile{FilePath: "/test/foo"},
+	}
+	if err := tmpl.parse(output); err != nil {
+		t.Errorf("Unexpected error parsing template: %v", err)
+	}
+
+	output.Contents = `[[ vaultSecret "kv/foo" ]]`
+	if err := tmpl.parse(output); err == nil || !strings.Contains(err.Error(), `function "vaultSecret" not defined`) {
+		t.Errorf("Expected error for unknown function: %v", err)
+	}
+
+	output.Contents, output.TemplateFile = "", "/test/missing.tmpl"
+	if err := tmpl.parse(output); err == nil || !strings.HasPrefix(err.Error(), "template_file:") {
+		t.Errorf("Expected error for missing template file: %v", err)
+	}
+}
+
+// failingAction fails the first Failures times it is run
+type failingAction struct {
+	countingAction
+	Failures int
+}
+
+func (a *failingAction) Do() error {
+	a.countingAction.Do()
+	if a.Count() <= a.Failures {
+		return fmt.Errorf("action failed")
+	}
+	return nil
+}
+
+func TestCredentialTemplateActionFailure(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "templatetest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tmpl := &CredentialTemplate{
+		Contents:   `foo`,
+		OutputFile: &CredentialFile{FilePath: filepath.Join(tempDir, "foo"), Mode: 0600},
+	}
+
+	vaultClient, err := vault.NewClient(vault.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	tmpl.vaultClient = vaultClient
+
+	action := &failingAction{Failures: 2}
+	tmpl.renewer = newCredentialTemplateRenewer(tmpl, action)
+	tmpl.renewer.actionRetryInterval = 10 * time.Millisecond
+	tmpl.runnerLock.Lock()
+	err = tmpl.startRunner()
+	tmpl.runnerLock.Unlock()
+	if err != nil {
+		t.Fatalf("Unable to start runner: %v", err)
+	}
+	defer tmpl.Stop()
+
+	select {
+	case output := <-tmpl.Renewer().RenewCh():
+		if output.Message != "rendered but action failed" || !output.ActionFailed {
+			t.Errorf("Wrong message for render with failed action: %s", output)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for template to render")
+	}
+
+	// the initial failure and the first retry are reported
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-tmpl.Renewer().DoneCh():
+			if _, ok := err.(ErrActionFailed); !ok {
+				t.Errorf("Expected action failure, got: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for action failure %d", i)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for action.Count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// give the renewer a moment to record the successful retry
+	time.Sleep(50 * time.Millisecond)
+
+	status := tmpl.renewer.Status()
+	if action.Count() != 3 || status.FailureCount != 0 || status.LastError != "" {
+		t.Errorf("Action not retried until it succeeded: %d runs, status %+v", action.Count(), status)
+	}
+}
+
+func TestCredentialTemplateHealthCheckRollback(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "templatetest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	outputFile := &CredentialFile{FilePath: filepath.Join(tempDir, "foo"), Mode: 0600}
+	if err := outputFile.Write("previous"); err != nil {
+		t.Fatalf("Unable to write previous render: %v", err)
+	}
+	tmpl := &CredentialTemplate{
+		Contents:    `foo`,
+		OutputFile:  outputFile,
+		HealthCheck: &HealthCheck{Type: "exec", Command: []string{"false"}},
+	}
+
+	vaultClient, err := vault.NewClient(vault.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	tmpl.vaultClient = vaultClient
+
+	action := &countingAction{}
+	tmpl.renewer = newCredentialTemplateRenewer(tmpl, action)
+	tmpl.renewer.healthCheck = tmpl.HealthCheck
+	if err := tmpl.renewer.snapshot(); err != nil {
+		t.Fatalf("Unable to backup previous render: %v", err)
+	}
+	tmpl.runnerLock.Lock()
+	err = tmpl.startRunner()
+	tmpl.runnerLock.Unlock()
+	if err != nil {
+		t.Fatalf("Unable to start runner: %v", err)
+	}
+	defer tmpl.Stop()
+
+	select {
+	case output := <-tmpl.Renewer().RenewCh():
+		if output.Message != "rendered but health check failed" || !output.ActionFailed {
+			t.Errorf("Wrong message for render rejected by health check: %s", output)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for template to render")
+	}
+
+	select {
+	case err := <-tmpl.Renewer().DoneCh():
+		if _, ok := err.(ErrActionFailed); !ok {
+			t.Errorf("Expected action failure, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for health check failure")
+	}
+
+	if contents, _ := outputFile.Read(); contents != "previous" {
+		t.Errorf("Previous render not restored: '%s'", contents)
+	}
+	// the action runs after the render and again after the rollback
+	if action.Count() != 2 {
+		t.Errorf("Expected action to run twice, ran %d times", action.Count())
+	}
+}
+
+func TestCredentialTemplateClientCertificateChanged(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "templatetest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tmpl := &CredentialTemplate{
+		Contents:   `foo`,
+		OutputFile: &CredentialFile{FilePath: filepath.Join(tempDir, "foo"), Mode: 0600},
+	}
+	// a template that isn't running yet loads the certificate when it starts
+	if err := tmpl.ClientCertificateChanged(); err != nil {
+		t.Fatalf("Unexpected error before the template was started: %v", err)
+	}
+
+	vaultClient, err := vault.NewClient(vault.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	if err := tmpl.Initialize(vaultClient); err != nil {
+		t.Fatalf("Unable to initialize template: %v", err)
+	}
+	defer tmpl.Stop()
+
+	select {
+	case <-tmpl.Renewer().RenewCh():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for template to render")
+	}
+
+	// the token is unchanged, but the runner must be restarted to load the new
+	// certificate
+	oldRunner := tmpl.runner
+	if err := tmpl.ClientCertificateChanged(); err != nil {
+		t.Fatalf("Unable to restart runner: %v", err)
+	}
+	if tmpl.runner == oldRunner {
+		t.Errorf("Runner not restarted after the client certificate changed")
+	}
+	select {
+	case <-oldRunner.DoneCh:
+	default:
+		t.Errorf("Previous runner not stopped")
+	}
+}
+
+// TestConsulTemplateFuncs fails when consulTemplateFuncs no longer matches the
+// functions of the consul-template version in go.mod
+func TestConsulTemplateFuncs(t *testing.T) {
+	pkg, err := build.Import("github.com/hashicorp/consul-template/template", ".", build.FindOnly)
+	if err != nil {
+		t.Fatalf("Unable to find consul-template source: %v", err)
+	}
+	source := filepath.Join(pkg.Dir, "template.go")
+	file, err := parser.ParseFile(token.NewFileSet(), source, nil, 0)
+	if err != nil {
+		t.Fatalf("Unable to parse consul-template source: %v", err)
+	}
+
+	// the functions are the keys of the map returned by funcMap
+	expected := []string{}
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Name.Name != "funcMap" {
+			continue
+		}
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			if kv, ok := n.(*ast.KeyValueExpr); ok {
+				if key, ok := kv.Key.(*ast.BasicLit); ok && key.Kind == token.STRING {
+					name, _ := strconv.Unquote(key.Value)
+					expected = append(expected, name)
+				}
+			}
+			return true
+		})
+	}
+	if len(expected) == 0 {
+		t.Fatalf("No functions found in funcMap of %s", source)
+	}
+
+	listed := make(map[string]bool, len(consulTemplateFuncs))
+	for _, name := range consulTemplateFuncs {
+		listed[name] = true
+	}
+	missing := []string{}
+	for _, name := range expected {
+		if !listed[name] {
+			missing = append(missing, name)
+		}
+		delete(listed, name)
+	}
+	extra := []string{}
+	for name := range listed {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+
+	if len(missing) > 0 || len(extra) > 0 {
+		t.Errorf("consulTemplateFuncs doesn't match consul-template, missing: %v, not in consul-template: %v", missing, extra)
+	}
+}
@@ -0,0 +1,22 @@
+package credentials
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// requireTmpfs returns an error unless the directory containing path is on a
+// tmpfs or ramfs filesystem
+func requireTmpfs(path string) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(filepath.Dir(path), &stat); err != nil {
+		return fmt.Errorf("unable to determine filesystem of %s: %v", path, err)
+	}
+	switch uint32(stat.Type) {
+	case unix.TMPFS_MAGIC, unix.RAMFS_MAGIC:
+		return nil
+	}
+	return fmt.Errorf("refusing to write %s, %s is not on a tmpfs filesystem", path, filepath.Dir(path))
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package credentials
+
+import "fmt"
+
+// requireTmpfs always fails, memory backed filesystems can only be detected on
+// linux
+func requireTmpfs(path string) error {
+	return fmt.Errorf("refusing to write %s, tmpfs outputs are only supported on linux", path)
+}
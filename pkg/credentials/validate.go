@@ -0,0 +1,24 @@
+package credentials
+
+import (
+	"fmt"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// requireString returns an error if a required string field is empty
+func requireString(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s is required", name)
+	}
+	return nil
+}
+
+// requireFile returns an error if a required credential file is missing or
+// invalid
+func requireFile(name string, f *CredentialFile) error {
+	if f == nil {
+		return fmt.Errorf("%s is required", name)
+	}
+	return multierror.Prefix(f.Validate(), fmt.Sprintf("%s:", name))
+}
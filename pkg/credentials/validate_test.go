@@ -0,0 +1,48 @@
+package credentials
+
+import (
+	"strings"
+	"testing"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+func TestPKICertificateValidate(t *testing.T) {
+	cert := &PKICertificate{
+		CertificateFile: FileOutput(&CredentialFile{FilePath: "/test/host.crt"}),
+		RoleName:        "testrole",
+	}
+
+	err := cert.Validate()
+	if err == nil {
+		t.Fatalf("Expected validation errors for incomplete certificate")
+	}
+
+	expected := []string{
+		"vault_backend_mount is required",
+		"common_name is required",
+		"private_key_file is required",
+		"ca_cert_file is required",
+	}
+	errs := err.(*multierror.Error).Errors
+	if len(errs) != len(expected) {
+		t.Fatalf("Wrong number of validation errors, expected %d got %d: %v", len(expected), len(errs), err)
+	}
+	for i, e := range errs {
+		if !strings.Contains(e.Error(), expected[i]) {
+			t.Errorf("Unexpected validation error, expected '%s' got '%s'", expected[i], e)
+		}
+	}
+}
+
+func TestCredentialFileValidate(t *testing.T) {
+	f := &CredentialFile{FilePath: "/test/file", Owner: "nonexistent-credmanager-user"}
+	if err := f.Validate(); err == nil {
+		t.Errorf("Expected error validating file with unknown owner")
+	}
+
+	f = &CredentialFile{FilePath: "/test/file"}
+	if err := f.Validate(); err != nil {
+		t.Errorf("Unexpected error validating file owned by current user: %v", err)
+	}
+}
@@ -2,25 +2,103 @@ package credentials
 
 import (
 	"fmt"
-	"log"
+	"net/http"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	multierror "github.com/hashicorp/go-multierror"
 	vault "github.com/hashicorp/vault/api"
 )
 
+// TokenOptions are the settings used to create a vault token
+type TokenOptions struct {
+	Policies        []string `yaml:"policies"`
+	TokenCreateRole string   `yaml:"creation_role"`
+	// Orphan tokens outlive the daemon's own token.  Ignored if a creation role
+	// is set, the role determines whether its tokens are orphans.
+	Orphan bool `yaml:"orphan"`
+	// Period makes the token periodic, it can be renewed indefinitely
+	Period         time.Duration     `yaml:"period"`
+	TTL            time.Duration     `yaml:"ttl"`
+	ExplicitMaxTTL time.Duration     `yaml:"explicit_max_ttl"`
+	DisplayName    string            `yaml:"display_name"`
+	Metadata       map[string]string `yaml:"metadata"`
+	NumUses        int               `yaml:"num_uses"`
+}
+
+// createRequest builds the request used to create a new token, using
+// defaultTTL if no ttl is set.
+func (o *TokenOptions) createRequest(defaultTTL time.Duration) *vault.TokenCreateRequest {
+	tokenRequest := &vault.TokenCreateRequest{
+		Policies:    o.Policies,
+		Metadata:    o.Metadata,
+		DisplayName: o.DisplayName,
+		NumUses:     o.NumUses,
+	}
+
+	ttl := o.TTL
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	if ttl.Seconds() > 0 {
+		tokenRequest.TTL = fmt.Sprintf("%d", int(ttl.Seconds()))
+	}
+	if o.ExplicitMaxTTL.Seconds() > 0 {
+		tokenRequest.ExplicitMaxTTL = fmt.Sprintf("%d", int(o.ExplicitMaxTTL.Seconds()))
+	}
+	if o.Period.Seconds() > 0 {
+		tokenRequest.Period = fmt.Sprintf("%d", int(o.Period.Seconds()))
+	}
+	return tokenRequest
+}
+
+// create creates a new token using client
+func (o *TokenOptions) create(client *vault.Client, defaultTTL time.Duration) (*vault.Secret, error) {
+	tokenRequest := o.createRequest(defaultTTL)
+	switch {
+	case o.TokenCreateRole != "":
+		return client.Auth().Token().CreateWithRole(tokenRequest, o.TokenCreateRole)
+	case o.Orphan:
+		return client.Auth().Token().CreateOrphan(tokenRequest)
+	default:
+		return client.Auth().Token().Create(tokenRequest)
+	}
+}
+
+func (o *TokenOptions) validate() error {
+	var result *multierror.Error
+	if len(o.Policies) == 0 && o.TokenCreateRole == "" {
+		result = multierror.Append(result, fmt.Errorf("one of policies or creation_role is required"))
+	}
+	if o.NumUses < 0 {
+		result = multierror.Append(result, fmt.Errorf("num_uses must not be negative"))
+	}
+	return result.ErrorOrNil()
+}
+
+// VaultToken issues a vault token for use by another service and keeps it
+// renewed.  The token is revoked when the credential is removed from the
+// configuration, it outlives restarts of credmanager.
 type VaultToken struct {
-	Policies           []string        `yaml:"policies"`
-	TokenCreateRole    string          `yaml:"creation_role"`
-	TokenFile          *CredentialFile `yaml:"token_file"`
-	MaxRenewalInterval time.Duration   `yaml:"max_renew"`
+	Name         string `yaml:"name"`
+	TokenOptions `yaml:",inline"`
+	TokenFile    *Output `yaml:"token_file"`
+	// Namespace overrides the vault namespace of the daemon's client
+	Namespace   string       `yaml:"namespace"`
+	Notifies    string       `yaml:"notifies"`
+	HealthCheck *HealthCheck `yaml:"health_check"`
+	// MaxRenewalInterval is also used as the ttl of new tokens if no ttl is set
+	MaxRenewalInterval time.Duration `yaml:"max_renew"`
 	renewer            *CredentialRenewer
 	vaultClient        *vault.Client
+	expiration         expirationTime
 }
 
 func (t *VaultToken) Initialize(vaultClient *vault.Client) error {
 	t.vaultClient = vaultClient
+	useVaultClient(vaultClient, outputFiles(t.TokenFile)...)
 	if t.MaxRenewalInterval <= 0 {
 		// No renewal interval set, must get token now to update default interval
 		err := t.getNewToken()
@@ -30,24 +108,40 @@ func (t *VaultToken) Initialize(vaultClient *vault.Client) error {
 		}
 	}
 
-	t.renewer = NewCredentialRenewer(t, nil)
+	t.renewer = t.newRenewer()
 	t.renewer.Renew()
 	return nil
 }
 
+// IssueOnce issues or renews the token without starting a renewal process
+func (t *VaultToken) IssueOnce(vaultClient *vault.Client, maxAttempts uint, runAction bool) error {
+	t.vaultClient = vaultClient
+	useVaultClient(vaultClient, outputFiles(t.TokenFile)...)
+	t.renewer = t.newRenewer()
+	return t.renewer.RenewOnce(maxAttempts, runAction)
+}
+
+func (t *VaultToken) newRenewer() *CredentialRenewer {
+	renewer := NewCredentialRenewer(t, notifyAction(t.Notifies, t.TokenFile))
+	renewer.HealthCheck = t.HealthCheck
+	return renewer
+}
+
 func (t *VaultToken) updateRenewalInterval(ttl int) {
-	log.Printf("Updating renewal interval on token to: %ds", ttl)
+	credentialLogger(t).Debug("renewal_interval_updated", "Updating renewal interval on token", logging.Fields{"ttl": time.Duration(ttl) * time.Second})
+	t.expiration.set(time.Now().Add(time.Duration(ttl) * time.Second))
 	if 0 < ttl && (ttl < int(t.MaxRenewalInterval.Seconds()) || t.MaxRenewalInterval.Seconds() == 0) {
 		t.MaxRenewalInterval = time.Duration(ttl) * time.Second
 	}
 }
 
 func (t *VaultToken) getNewToken() error {
-	tokenRequest := &vault.TokenCreateRequest{Policies: t.Policies}
-	if t.MaxRenewalInterval.Seconds() > 0 {
-		tokenRequest.TTL = fmt.Sprintf("%d", int(t.MaxRenewalInterval.Seconds()))
+	client, err := namespacedClient(t.vaultClient, t.Namespace)
+	if err != nil {
+		return err
 	}
-	secret, err := t.vaultClient.Auth().Token().CreateWithRole(tokenRequest, t.TokenCreateRole)
+
+	secret, err := t.TokenOptions.create(client, t.MaxRenewalInterval)
 	if err != nil {
 		return err
 	}
@@ -55,15 +149,26 @@ func (t *VaultToken) getNewToken() error {
 	return t.TokenFile.Write(secret.Auth.ClientToken)
 }
 
+// Renew renews the token in the token file with the daemon's token, so that
+// renewals don't use up the token's uses.  A new token is issued if there is no
+// token or vault no longer knows the existing one.
 func (t *VaultToken) Renew() error {
 	existingToken, err := t.TokenFile.Read()
-	if err != nil && os.IsExist(err) {
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
 	if existingToken != "" {
-		newSecret, err := t.vaultClient.Auth().Token().RenewTokenAsSelf(existingToken, int(t.MaxRenewalInterval.Seconds()))
+		client, err := namespacedClient(t.vaultClient, t.Namespace)
 		if err != nil {
+			return err
+		}
+
+		newSecret, err := client.Auth().Token().Renew(existingToken, int(t.MaxRenewalInterval.Seconds()))
+		if vaultTokenNotFound(err) {
+			credentialLogger(t).Warn("token_invalid", "Token has expired, been revoked or used up, issuing a new one", logging.Fields{"error": err})
+			return t.getNewToken()
+		} else if err != nil {
 			return fmt.Errorf("unable to renew %s: %v", t, err)
 		}
 		t.updateRenewalInterval(newSecret.Auth.LeaseDuration)
@@ -73,18 +178,95 @@ func (t *VaultToken) Renew() error {
 	return t.getNewToken()
 }
 
+// vaultTokenNotFound returns true if err is vault's response to renewing or
+// revoking a token that has expired, been revoked or run out of uses.  Other
+// errors, such as a sealed vault or missing permissions, say nothing about the
+// token.
+func vaultTokenNotFound(err error) bool {
+	respErr, ok := err.(*vault.ResponseError)
+	if !ok || respErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	for _, e := range respErr.Errors {
+		if strings.Contains(e, "token not found") || strings.Contains(e, "token to revoke not found") {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that all required fields are set
+func (t *VaultToken) Validate() error {
+	var result *multierror.Error
+	result = multierror.Append(result,
+		requireOutput("token_file", t.TokenFile),
+		validateOutputs(t.TokenFile),
+		t.TokenOptions.validate(),
+	)
+	if t.HealthCheck != nil {
+		result = multierror.Append(result, multierror.Prefix(t.HealthCheck.Validate(), "health_check:"))
+	}
+	return result.ErrorOrNil()
+}
+
+// Stop stops renewing the token, leaving it in place for the next run
 func (t *VaultToken) Stop() {
 	t.renewer.Stop()
 }
 
+// Revoke revokes the token in the token file, removing the output once the
+// token has been revoked.
+func (t *VaultToken) Revoke() error {
+	token, err := t.TokenFile.Read()
+	if os.IsNotExist(err) || (err == nil && token == "") {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	client, err := namespacedClient(t.vaultClient, t.Namespace)
+	if err != nil {
+		return err
+	}
+
+	// revoke with the daemon's token, the token itself may have no uses left
+	err = client.Auth().Token().RevokeTree(token)
+	if err != nil && !vaultTokenNotFound(err) {
+		return err
+	}
+
+	credentialLogger(t).Info("token_revoked", "Revoked token")
+	return t.TokenFile.remove()
+}
+
+// Files returns the local file of the token output, if any
+func (t *VaultToken) Files() []*CredentialFile {
+	return outputFiles(t.TokenFile)
+}
+
+// RevocationKey identifies the token output, a configured token writing to the
+// same output renews the existing token instead of revoking it
+func (t *VaultToken) RevocationKey() string {
+	return fmt.Sprintf("%s:%s", t.TokenFile.Type, t.TokenFile.Path())
+}
+
 func (t *VaultToken) MaxRenewInterval() time.Duration {
 	return t.MaxRenewalInterval
 }
 
+func (t *VaultToken) logFields() logging.Fields {
+	return credentialFields(t.Name, "vault", t)
+}
+
 func (t *VaultToken) String() string {
 	return fmt.Sprintf("Vault Token for role '%s' stored at '%s'", strings.Join(t.Policies, " "), t.TokenFile.Path())
 }
 
+// Expiration returns the time the current token expires
+func (t *VaultToken) Expiration() time.Time {
+	return t.expiration.get()
+}
+
 func (t *VaultToken) Renewer() Renewer {
 	return t.renewer
 }
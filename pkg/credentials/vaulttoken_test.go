@@ -2,8 +2,11 @@ package credentials
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
@@ -18,6 +21,12 @@ import (
 var (
 	issuerPolicy = `path "auth/token/create/test-issuer" {
   capabilities = ["update"]
+}
+path "auth/token/renew" {
+  capabilities = ["update"]
+}
+path "auth/token/revoke" {
+  capabilities = ["update"]
 }`
 	// Role used to issue tokens.  Setting the period to 1 forces the ttl to 1s for the tokens.
 	issuerRole = map[string]interface{}{
@@ -59,9 +68,11 @@ func TestVaultTokenManage(t *testing.T) {
 	}
 
 	token := &VaultToken{
-		Policies:        []string{"test-policy"},
-		TokenCreateRole: issuerRole["name"].(string),
-		TokenFile:       tokenFile,
+		TokenOptions: TokenOptions{
+			Policies:        []string{"test-policy"},
+			TokenCreateRole: issuerRole["name"].(string),
+		},
+		TokenFile: FileOutput(tokenFile),
 	}
 
 	ctx := context.Background()
@@ -134,17 +145,125 @@ func TestVaultTokenManage(t *testing.T) {
 		}
 	}
 
+	issuedToken, err := tokenFile.Read()
+	if err != nil {
+		t.Fatalf("Unable to read issued token: %v", err)
+	}
+
+	// stopping credmanager leaves the token in place
 	token.Stop()
+	if _, err := vaultClient.Auth().Token().Lookup(issuedToken); err != nil {
+		t.Errorf("Token revoked by Stop(): %v", err)
+	}
+
+	if err := token.Revoke(); err != nil {
+		t.Fatalf("Unable to revoke token: %v", err)
+	}
+
+	if _, err := os.Stat(tokenFile.Path()); !os.IsNotExist(err) {
+		t.Errorf("Token file not removed after revoking token: %v", err)
+	}
+
+	_, err = vaultClient.Auth().Token().Lookup(issuedToken)
+	if err == nil {
+		t.Errorf("Token still valid after Revoke()")
+	}
+}
+
+func TestVaultTokenRenewWithDaemonToken(t *testing.T) {
+	var revoked []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get("X-Vault-Token"); token != "daemon-token" {
+			t.Errorf("Request to %s not made with the daemon's token: %s", r.URL.Path, token)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/v1/auth/token/renew":
+			if body["token"] != "valid-token" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors": ["token not found"]}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{"client_token": "valid-token", "lease_duration": 3600}})
+		case "/v1/auth/token/create":
+			json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{"client_token": "new-token", "lease_duration": 3600}})
+		case "/v1/auth/token/revoke":
+			revoked = append(revoked, fmt.Sprint(body["token"]))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "tokentest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	config := vault.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	vaultClient, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	vaultClient.SetToken("daemon-token")
+
+	tokenFile := &CredentialFile{FilePath: filepath.Join(tempDir, "token"), Mode: 0600}
+	token := &VaultToken{
+		TokenOptions:       TokenOptions{Policies: []string{"test-policy"}, NumUses: 1},
+		TokenFile:          FileOutput(tokenFile),
+		MaxRenewalInterval: time.Hour,
+	}
+	token.vaultClient = vaultClient
+
+	// a token vault doesn't know any more is replaced
+	tokenFile.Write("used-token")
+	if err := token.Renew(); err != nil {
+		t.Fatalf("Unable to renew token: %v", err)
+	}
+	if contents, _ := tokenFile.Read(); contents != "new-token" {
+		t.Errorf("Used up token not replaced: %s", contents)
+	}
+
+	tokenFile.Write("valid-token")
+	if err := token.Renew(); err != nil {
+		t.Fatalf("Unable to renew token: %v", err)
+	}
+	if contents, _ := tokenFile.Read(); contents != "valid-token" {
+		t.Errorf("Valid token replaced: %s", contents)
+	}
+
+	if err := token.Revoke(); err != nil {
+		t.Fatalf("Unable to revoke token: %v", err)
+	}
+	if len(revoked) != 1 || revoked[0] != "valid-token" {
+		t.Errorf("Token not revoked: %v", revoked)
+	}
+	if _, err := os.Stat(tokenFile.Path()); !os.IsNotExist(err) {
+		t.Errorf("Token file not removed after revoking token: %v", err)
+	}
 }
 
 func getTestVaultTokenInfo() (*VaultToken, string) {
 	tokenFile, _ := NewCredentialFile(filepath.Join("/test", "token"), 0600, "", "")
 
 	cert := &VaultToken{
-		TokenFile:          tokenFile,
-		TokenCreateRole:    "testrole",
-		Policies:           []string{"foo-server"},
+		TokenFile: FileOutput(tokenFile),
+		TokenOptions: TokenOptions{
+			TokenCreateRole: "testrole",
+			Policies:        []string{"foo-server"},
+			Period:          24 * time.Hour,
+			ExplicitMaxTTL:  720 * time.Hour,
+			DisplayName:     "foo-server",
+			Metadata:        map[string]string{"host": "foo"},
+			NumUses:         10,
+		},
 		MaxRenewalInterval: 1 * time.Hour,
+		Notifies:           "foo.service",
 	}
 
 	marhsaledYAML := `token_file:
@@ -154,6 +273,13 @@ creation_role: testrole
 policies:
   - foo-server
 max_renew: 1h
+period: 24h
+explicit_max_ttl: 720h
+display_name: foo-server
+metadata:
+  host: foo
+num_uses: 10
+notifies: foo.service
 required_policies:
   - test-issuer
 `
@@ -168,7 +294,7 @@ func TestVaultTokenUnmarshalYAML(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unable to unmarshal: %v", err)
 	}
-	dst.TokenFile.populateUserGroupData()
+	dst.TokenFile.File().populateUserGroupData()
 
 	if diff := deep.Equal(dst, expected); diff != nil {
 		t.Errorf("Unmarshaled not equal to expected:")
@@ -179,3 +305,25 @@ func TestVaultTokenUnmarshalYAML(t *testing.T) {
 	}
 
 }
+
+func TestVaultTokenCreateRequest(t *testing.T) {
+	token, _ := getTestVaultTokenInfo()
+
+	expected := &vault.TokenCreateRequest{
+		Policies:       []string{"foo-server"},
+		Metadata:       map[string]string{"host": "foo"},
+		TTL:            "3600",
+		ExplicitMaxTTL: "2592000",
+		Period:         "86400",
+		DisplayName:    "foo-server",
+		NumUses:        10,
+	}
+	if diff := deep.Equal(token.createRequest(token.MaxRenewalInterval), expected); diff != nil {
+		t.Errorf("Token create request doesn't match expected: %v", diff)
+	}
+
+	token.TTL = 5 * time.Minute
+	if ttl := token.createRequest(token.MaxRenewalInterval).TTL; ttl != "300" {
+		t.Errorf("Explicit ttl not used in token create request: %s", ttl)
+	}
+}
@@ -0,0 +1,233 @@
+package credentials
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/logging"
+	multierror "github.com/hashicorp/go-multierror"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// WrappedSecret writes a response wrapping token for a new vault token or
+// AppRole secret_id, so that the secret itself is never stored on disk.  The
+// wrapping token is checked regularly and regenerated once the consumer has
+// unwrapped it, or shortly before it expires.
+type WrappedSecret struct {
+	Name              string  `yaml:"name"`
+	WrappingTokenFile *Output `yaml:"wrapping_token_file"`
+	// WrapTTL is how long the consumer has to unwrap the secret
+	WrapTTL time.Duration `yaml:"wrap_ttl"`
+	// CheckInterval is how often the wrapping token is checked
+	CheckInterval time.Duration `yaml:"check_interval"`
+	// Namespace overrides the vault namespace of the daemon's client
+	Namespace string `yaml:"namespace"`
+	// Exactly one of Token or SecretID must be set
+	Token       *TokenOptions    `yaml:"token"`
+	SecretID    *SecretIDOptions `yaml:"secret_id"`
+	Notifies    string           `yaml:"notifies"`
+	HealthCheck *HealthCheck     `yaml:"health_check"`
+	vaultClient *vault.Client
+	renewer     *CredentialRenewer
+	expiration  expirationTime
+}
+
+func (w *WrappedSecret) wrapTTL() time.Duration {
+	if w.WrapTTL <= 0 {
+		return 24 * time.Hour
+	}
+	return w.WrapTTL
+}
+
+func (w *WrappedSecret) Initialize(vaultClient *vault.Client) error {
+	w.setup(vaultClient)
+	w.renewer.Renew()
+	return nil
+}
+
+// IssueOnce writes a new wrapping token, unless the existing one hasn't been
+// used yet, without starting a renewal process
+func (w *WrappedSecret) IssueOnce(vaultClient *vault.Client, maxAttempts uint, runAction bool) error {
+	w.setup(vaultClient)
+	return w.renewer.RenewOnce(maxAttempts, runAction)
+}
+
+func (w *WrappedSecret) setup(vaultClient *vault.Client) {
+	w.vaultClient = vaultClient
+	useVaultClient(vaultClient, w.Files()...)
+	w.renewer = NewCredentialRenewer(w, notifyAction(w.Notifies, w.WrappingTokenFile))
+	w.renewer.HealthCheck = w.HealthCheck
+}
+
+// NeedsRenewal returns true if the wrapping token has been unwrapped, is about
+// to expire or doesn't exist.
+func (w *WrappedSecret) NeedsRenewal() (bool, error) {
+	token, err := w.WrappingTokenFile.Read()
+	if os.IsNotExist(err) || (err == nil && token == "") {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	client, err := namespacedClient(w.vaultClient, w.Namespace)
+	if err != nil {
+		return false, err
+	}
+
+	secret, err := client.Logical().Write("sys/wrapping/lookup", map[string]interface{}{"token": token})
+	if wrappingTokenInvalid(err) {
+		// vault doesn't distinguish between unwrapped and expired tokens, neither
+		// can be used any more
+		credentialLogger(w).Debug("wrapping_token_invalid", "Wrapping token has been used or is invalid", logging.Fields{"error": err})
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to look up wrapping token: %v", err)
+	}
+
+	expiration, err := wrappingTokenExpiration(secret)
+	if err != nil {
+		return false, err
+	}
+	w.expiration.set(expiration)
+
+	// replace the token before it expires so that a valid one is always available
+	return time.Until(expiration) < w.MaxRenewInterval(), nil
+}
+
+// wrappingTokenInvalid returns true if err is vault's response to looking up a
+// wrapping token that has been unwrapped or has expired.  Other errors, such
+// as a sealed or unreachable vault, say nothing about the token.
+func wrappingTokenInvalid(err error) bool {
+	respErr, ok := err.(*vault.ResponseError)
+	if !ok || respErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	for _, e := range respErr.Errors {
+		if strings.Contains(e, "wrapping token is not valid") {
+			return true
+		}
+	}
+	return false
+}
+
+// wrappingTokenExpiration returns the expiration of a wrapping token from the
+// response to a wrapping token lookup
+func wrappingTokenExpiration(secret *vault.Secret) (time.Time, error) {
+	if secret == nil || secret.Data == nil {
+		return time.Time{}, fmt.Errorf("no data returned by wrapping token lookup")
+	}
+
+	created, err := time.Parse(time.RFC3339Nano, fmt.Sprint(secret.Data["creation_time"]))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse wrapping token creation time: %v", err)
+	}
+
+	ttl, err := jsonInt(secret.Data["creation_ttl"])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse wrapping token ttl: %v", err)
+	}
+	return created.Add(time.Duration(ttl) * time.Second), nil
+}
+
+// jsonInt converts a number returned by vault to an int64
+func jsonInt(v interface{}) (int64, error) {
+	if n, ok := v.(json.Number); ok {
+		return n.Int64()
+	}
+	return strconv.ParseInt(fmt.Sprint(v), 10, 64)
+}
+
+// Renew generates a new wrapped secret and writes the wrapping token
+func (w *WrappedSecret) Renew() error {
+	client, err := copyClient(w.vaultClient, w.Namespace)
+	if err != nil {
+		return err
+	}
+	wrapTTL := fmt.Sprintf("%d", int(w.wrapTTL().Seconds()))
+	client.SetWrappingLookupFunc(func(operation, path string) string {
+		return wrapTTL
+	})
+
+	var secret *vault.Secret
+	if w.Token != nil {
+		secret, err = w.Token.create(client, 0)
+	} else {
+		secret, err = w.SecretID.generate(client)
+	}
+	if err != nil {
+		return err
+	}
+
+	if secret == nil || secret.WrapInfo == nil || secret.WrapInfo.Token == "" {
+		return fmt.Errorf("no wrapping token returned for %s", w)
+	}
+
+	w.expiration.set(time.Now().Add(time.Duration(secret.WrapInfo.TTL) * time.Second))
+	return writeOutputs(outputContent{w.WrappingTokenFile, secret.WrapInfo.Token})
+}
+
+// Validate checks that all required fields are set
+func (w *WrappedSecret) Validate() error {
+	var result *multierror.Error
+	result = multierror.Append(result,
+		requireOutput("wrapping_token_file", w.WrappingTokenFile),
+		validateOutputs(w.WrappingTokenFile),
+	)
+	switch {
+	case w.Token != nil && w.SecretID != nil, w.Token == nil && w.SecretID == nil:
+		result = multierror.Append(result, fmt.Errorf("exactly one of token or secret_id is required"))
+	case w.Token != nil:
+		result = multierror.Append(result, multierror.Prefix(w.Token.validate(), "token:"))
+	case w.SecretID != nil:
+		result = multierror.Append(result, multierror.Prefix(w.SecretID.validate(), "secret_id:"))
+	}
+	if w.MaxRenewInterval() >= w.wrapTTL() {
+		result = multierror.Append(result, fmt.Errorf("check_interval must be shorter than wrap_ttl"))
+	}
+	if w.HealthCheck != nil {
+		result = multierror.Append(result, multierror.Prefix(w.HealthCheck.Validate(), "health_check:"))
+	}
+	return result.ErrorOrNil()
+}
+
+func (w *WrappedSecret) Stop() {
+	w.renewer.Stop()
+}
+
+// MaxRenewInterval returns how often the wrapping token is checked
+func (w *WrappedSecret) MaxRenewInterval() time.Duration {
+	if w.CheckInterval <= 0 {
+		return time.Minute
+	}
+	return w.CheckInterval
+}
+
+// Expiration returns the time the current wrapping token expires
+func (w *WrappedSecret) Expiration() time.Time {
+	return w.expiration.get()
+}
+
+// Files returns the local file of the wrapping token output, if any
+func (w *WrappedSecret) Files() []*CredentialFile {
+	return outputFiles(w.WrappingTokenFile)
+}
+
+func (w *WrappedSecret) Renewer() Renewer {
+	return w.renewer
+}
+
+func (w *WrappedSecret) logFields() logging.Fields {
+	return credentialFields(w.Name, "wrapped", w)
+}
+
+func (w *WrappedSecret) String() string {
+	if w.SecretID != nil {
+		return fmt.Sprintf("Wrapped secret_id for role '%s' stored at '%s'", w.SecretID.Role, w.WrappingTokenFile.Path())
+	}
+	return fmt.Sprintf("Wrapped token stored at '%s'", w.WrappingTokenFile.Path())
+}
@@ -0,0 +1,172 @@
+package credentials
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// fakeWrappingServer emulates the secret_id generation and wrapping token
+// lookup endpoints of a vault server.  Tokens listed in valid can be looked up.
+func fakeWrappingServer(t *testing.T, valid map[string]bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/wrapping/lookup":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["token"] == "sealed-token" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"errors": ["Vault is sealed"]}`))
+				return
+			}
+			if !valid[body["token"]] {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors": ["wrapping token is not valid or does not exist"]}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"creation_time": time.Now().Format(time.RFC3339Nano),
+				"creation_ttl":  3600,
+				"creation_path": "auth/approle/role/app/secret-id",
+			}})
+		case "/v1/auth/approle/role/app/secret-id":
+			if ttl := r.Header.Get("X-Vault-Wrap-TTL"); ttl != "3600" {
+				t.Errorf("Wrong wrap ttl requested: '%s'", ttl)
+			}
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["metadata"] != `{"host":"foo"}` {
+				t.Errorf("Wrong metadata sent: %v", body["metadata"])
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"wrap_info": map[string]interface{}{"token": "new-wrapping-token", "ttl": 3600}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestWrappedSecretRenewal(t *testing.T) {
+	server := fakeWrappingServer(t, map[string]bool{"valid-token": true})
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "wrappedtest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	config := vault.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	vaultClient, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	vaultClient.SetToken("test-token")
+
+	tokenFile := &CredentialFile{FilePath: filepath.Join(tempDir, "secret_id.wrapped"), Mode: 0600}
+	wrapped := &WrappedSecret{
+		WrappingTokenFile: FileOutput(tokenFile),
+		WrapTTL:           time.Hour,
+		SecretID:          &SecretIDOptions{Role: "app", Metadata: map[string]string{"host": "foo"}},
+	}
+	wrapped.setup(vaultClient)
+
+	if needed, err := wrapped.NeedsRenewal(); err != nil || !needed {
+		t.Errorf("Missing wrapping token should need renewal: %t, %v", needed, err)
+	}
+
+	tokenFile.Write("valid-token")
+	if needed, err := wrapped.NeedsRenewal(); err != nil || needed {
+		t.Errorf("Valid wrapping token shouldn't need renewal: %t, %v", needed, err)
+	}
+	if remaining := time.Until(wrapped.Expiration()); remaining < 59*time.Minute || remaining > time.Hour {
+		t.Errorf("Wrong wrapping token expiration: %s", wrapped.Expiration())
+	}
+
+	// errors that say nothing about the token don't replace it
+	tokenFile.Write("sealed-token")
+	if needed, err := wrapped.NeedsRenewal(); err == nil || needed {
+		t.Errorf("Expected error looking up token with vault sealed: %t, %v", needed, err)
+	}
+
+	tokenFile.Write("unwrapped-token")
+	if needed, err := wrapped.NeedsRenewal(); err != nil || !needed {
+		t.Errorf("Unwrapped token should need renewal: %t, %v", needed, err)
+	}
+
+	if err := wrapped.Renew(); err != nil {
+		t.Fatalf("Unable to renew wrapped secret_id: %v", err)
+	}
+	if token, _ := tokenFile.Read(); token != "new-wrapping-token" {
+		t.Errorf("Wrong wrapping token written: '%s'", token)
+	}
+}
+
+func TestWrappedSecretNonFileOutput(t *testing.T) {
+	server := fakeWrappingServer(t, map[string]bool{})
+	defer server.Close()
+
+	config := vault.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	vaultClient, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatalf("Unable to create vault client: %v", err)
+	}
+	vaultClient.SetToken("test-token")
+
+	output := &MemoryOutput{Name: "wrapped"}
+	wrapped := &WrappedSecret{
+		WrappingTokenFile: &Output{Type: "memory", OutputSink: output},
+		WrapTTL:           time.Hour,
+		SecretID:          &SecretIDOptions{Role: "app", Metadata: map[string]string{"host": "foo"}},
+	}
+	if err := wrapped.Validate(); err != nil {
+		t.Fatalf("Unexpected error validating wrapped secret with memory output: %v", err)
+	}
+	wrapped.setup(vaultClient)
+
+	if len(wrapped.Files()) != 0 {
+		t.Errorf("Memory output shouldn't have local files: %v", wrapped.Files())
+	}
+	if needed, err := wrapped.NeedsRenewal(); err != nil || !needed {
+		t.Errorf("Empty output should need renewal: %t, %v", needed, err)
+	}
+	if err := wrapped.Renew(); err != nil {
+		t.Fatalf("Unable to renew wrapped secret_id: %v", err)
+	}
+	if token, _ := output.Read(); token != "new-wrapping-token" {
+		t.Errorf("Wrong wrapping token written: '%s'", token)
+	}
+}
+
+func TestWrappedSecretValidate(t *testing.T) {
+	wrapped := &WrappedSecret{
+		WrappingTokenFile: FileOutput(&CredentialFile{FilePath: "/test/token.wrapped"}),
+		Token:             &TokenOptions{},
+		SecretID:          &SecretIDOptions{Role: "app"},
+	}
+	if err := wrapped.Validate(); err == nil || !strings.Contains(err.Error(), "exactly one of token or secret_id") {
+		t.Errorf("Expected error validating wrapped secret with both token and secret_id: %v", err)
+	}
+
+	wrapped.Token = nil
+	wrapped.CheckInterval = 48 * time.Hour
+	if err := wrapped.Validate(); err == nil || !strings.Contains(err.Error(), "check_interval") {
+		t.Errorf("Expected error validating check_interval longer than wrap_ttl: %v", err)
+	}
+
+	wrapped.CheckInterval = 0
+	if err := wrapped.Validate(); err != nil {
+		t.Errorf("Unexpected error validating wrapped secret_id: %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+// Package kubernetes is a minimal client for the parts of the Kubernetes API
+// used by credmanager, configured from the service account mounted in a pod.
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client makes requests to the Kubernetes API server
+type Client struct {
+	// Host is the base url of the API server
+	Host string
+	// TokenFile contains the bearer token, it is re-read for every request since
+	// projected service account tokens are rotated
+	TokenFile string
+	// Namespace is used for requests that don't specify a namespace
+	Namespace  string
+	HTTPClient *http.Client
+}
+
+// InClusterClient returns a client configured with the service account
+// credentials and namespace of the pod it is running in.
+func InClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+
+	caCert, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cluster ca certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in cluster ca certificate")
+	}
+
+	namespace, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account namespace: %v", err)
+	}
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return &Client{
+		Host:       "https://" + net.JoinHostPort(host, port),
+		TokenFile:  filepath.Join(serviceAccountDir, "token"),
+		Namespace:  strings.TrimSpace(string(namespace)),
+		HTTPClient: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// StatusError is returned when the API server responds with an error status
+type StatusError struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("kubernetes api error %d %s: %s", e.Code, e.Reason, e.Message)
+	}
+	return fmt.Sprintf("kubernetes api error %d", e.Code)
+}
+
+// IsNotFound returns true if err is a not found response from the API server
+func IsNotFound(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.Code == http.StatusNotFound
+}
+
+// IsConflict returns true if err is a conflict response from the API server,
+// such as an update of a stale object or creation of an existing one
+func IsConflict(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.Code == http.StatusConflict
+}
+
+func (c *Client) namespace(namespace string) string {
+	if namespace == "" {
+		return c.Namespace
+	}
+	return namespace
+}
+
+// do sends a json request with the service account token, decoding a
+// successful response into out
+func (c *Client) do(method, path string, body, out interface{}) error {
+	return c.doContent(method, path, "application/json", body, out)
+}
+
+// doContent sends a request with a body of contentType, such as one of the
+// patch types
+func (c *Client) doContent(method, path, contentType string, body, out interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest(method, strings.TrimSuffix(c.Host, "/")+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if c.TokenFile != "" {
+		token, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return fmt.Errorf("unable to read service account token: %v", err)
+		}
+		request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		statusErr := &StatusError{Code: response.StatusCode}
+		json.NewDecoder(response.Body).Decode(statusErr)
+		return statusErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+func secretPath(namespace, name string) string {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets", url.PathEscape(namespace))
+	if name != "" {
+		path += "/" + url.PathEscape(name)
+	}
+	return path
+}
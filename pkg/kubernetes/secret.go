@@ -0,0 +1,100 @@
+package kubernetes
+
+const (
+	// SecretTypeOpaque is the default type for arbitrary secret data
+	SecretTypeOpaque = "Opaque"
+	// SecretTypeTLS requires tls.crt and tls.key keys
+	SecretTypeTLS = "kubernetes.io/tls"
+)
+
+// mergePatchType is the content type of a JSON merge patch (RFC 7386)
+const mergePatchType = "application/merge-patch+json"
+
+// ObjectMeta is the subset of object metadata used by credmanager.  Secrets are
+// only changed with patches, so fields missing here are never dropped.
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// Secret is a v1 Secret.  Data values are base64 encoded when marshaled, as
+// the API expects.
+type Secret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string][]byte `json:"data,omitempty"`
+}
+
+// NewSecret returns an empty secret of the given type
+func NewSecret(namespace, name, secretType string) *Secret {
+	return &Secret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   ObjectMeta{Name: name, Namespace: namespace},
+		Type:       secretType,
+		Data:       map[string][]byte{},
+	}
+}
+
+// GetSecret returns the named secret, the client's namespace is used if
+// namespace is empty
+func (c *Client) GetSecret(namespace, name string) (*Secret, error) {
+	secret := &Secret{}
+	if err := c.do("GET", secretPath(c.namespace(namespace), name), nil, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// CreateSecret creates a new secret, returning the stored secret
+func (c *Client) CreateSecret(secret *Secret) (*Secret, error) {
+	secret.Metadata.Namespace = c.namespace(secret.Metadata.Namespace)
+	created := &Secret{}
+	if err := c.do("POST", secretPath(secret.Metadata.Namespace, ""), secret, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// SecretPatch sets data keys, labels and annotations of a secret, leaving
+// everything else unchanged
+type SecretPatch struct {
+	Data        map[string][]byte
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// mergePatch returns the JSON merge patch document for the patch
+func (p *SecretPatch) mergePatch() map[string]interface{} {
+	metadata := map[string]interface{}{}
+	if len(p.Labels) > 0 {
+		metadata["labels"] = p.Labels
+	}
+	if len(p.Annotations) > 0 {
+		metadata["annotations"] = p.Annotations
+	}
+	patch := map[string]interface{}{}
+	if len(metadata) > 0 {
+		patch["metadata"] = metadata
+	}
+	if len(p.Data) > 0 {
+		patch["data"] = p.Data
+	}
+	return patch
+}
+
+// PatchSecret applies patch to an existing secret with a JSON merge patch.
+// Keys, labels and annotations not in the patch are preserved, as are other
+// fields such as owner references and finalizers.
+func (c *Client) PatchSecret(namespace, name string, patch *SecretPatch) (*Secret, error) {
+	patched := &Secret{}
+	if err := c.doContent("PATCH", secretPath(c.namespace(namespace), name), mergePatchType, patch.mergePatch(), patched); err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
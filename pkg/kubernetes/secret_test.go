@@ -0,0 +1,86 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretRequests(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "kubernetestest")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	tokenFile := filepath.Join(tempDir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("test-token\n"), 0600); err != nil {
+		t.Fatalf("Unable to write token file: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			t.Errorf("Wrong authorization header: %s", r.Header.Get("Authorization"))
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/v1/namespaces/default/secrets/missing":
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"code": 404, "reason": "NotFound", "message": "secrets \"missing\" not found"})
+		case r.Method == "POST" && r.URL.Path == "/api/v1/namespaces/default/secrets":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			data, _ := body["data"].(map[string]interface{})
+			if data["tls.crt"] != "Q0VSVA==" {
+				t.Errorf("Data not base64 encoded: %v", body["data"])
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(body)
+		case r.Method == "PATCH" && r.URL.Path == "/api/v1/namespaces/web/secrets/web-tls":
+			if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+				t.Errorf("Wrong patch content type: %s", r.Header.Get("Content-Type"))
+			}
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			metadata, _ := body["metadata"].(map[string]interface{})
+			if len(body) != 2 || len(metadata) != 1 || metadata["labels"] == nil {
+				t.Errorf("Patch should only contain data and labels: %v", body)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"metadata": map[string]interface{}{"name": "web-tls", "namespace": "web"}, "data": body["data"]})
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{Host: server.URL, TokenFile: tokenFile, Namespace: "default"}
+
+	_, err = client.GetSecret("", "missing")
+	if !IsNotFound(err) {
+		t.Errorf("Expected not found error: %v", err)
+	}
+
+	secret := NewSecret("", "web-tls", SecretTypeTLS)
+	secret.Data["tls.crt"] = []byte("CERT")
+	created, err := client.CreateSecret(secret)
+	if err != nil {
+		t.Fatalf("Unable to create secret: %v", err)
+	}
+	if created.Metadata.Namespace != "default" || string(created.Data["tls.crt"]) != "CERT" {
+		t.Errorf("Wrong secret returned: %v", created)
+	}
+
+	patched, err := client.PatchSecret("web", "web-tls", &SecretPatch{
+		Data:   map[string][]byte{"tls.crt": []byte("CERT")},
+		Labels: map[string]string{"app": "web"},
+	})
+	if err != nil {
+		t.Fatalf("Unable to patch secret: %v", err)
+	}
+	if string(patched.Data["tls.crt"]) != "CERT" {
+		t.Errorf("Wrong secret returned: %v", patched)
+	}
+}
@@ -0,0 +1,244 @@
+// Package logging provides a small leveled, structured logger that writes
+// events as human readable text, logfmt or json.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// ParseLevel parses a level name
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level: '%s'", name)
+	}
+}
+
+// Supported output formats
+const (
+	FormatText   = "text"
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// Fields are additional key/value pairs attached to a log entry
+type Fields map[string]interface{}
+
+// Logger writes structured log entries at or above its level
+type Logger struct {
+	out    io.Writer
+	lock   *sync.Mutex
+	level  Level
+	format string
+	fields Fields
+}
+
+// New creates a logger writing entries in format to out
+func New(out io.Writer, level Level, format string) (*Logger, error) {
+	switch format {
+	case "":
+		format = FormatText
+	case FormatText, FormatLogfmt, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown log format: '%s'", format)
+	}
+	return &Logger{out: out, lock: &sync.Mutex{}, level: level, format: format, fields: Fields{}}, nil
+}
+
+// Default returns a logger writing text entries at info level to stderr
+func Default() *Logger {
+	l, _ := New(os.Stderr, LevelInfo, FormatText)
+	return l
+}
+
+// With returns a logger that adds fields to every entry
+func (l *Logger) With(fields Fields) *Logger {
+	child := *l
+	child.fields = make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		child.fields[k] = v
+	}
+	for k, v := range fields {
+		child.fields[k] = v
+	}
+	return &child
+}
+
+func (l *Logger) Debug(event, msg string, fields ...Fields) {
+	l.Log(LevelDebug, event, msg, fields...)
+}
+
+func (l *Logger) Info(event, msg string, fields ...Fields) {
+	l.Log(LevelInfo, event, msg, fields...)
+}
+
+func (l *Logger) Warn(event, msg string, fields ...Fields) {
+	l.Log(LevelWarn, event, msg, fields...)
+}
+
+func (l *Logger) Error(event, msg string, fields ...Fields) {
+	l.Log(LevelError, event, msg, fields...)
+}
+
+// Fatal logs an error entry and exits
+func (l *Logger) Fatal(event, msg string, fields ...Fields) {
+	l.Log(LevelError, event, msg, fields...)
+	os.Exit(1)
+}
+
+// Log writes an entry for event if level is at or above the logger's level
+func (l *Logger) Log(level Level, event, msg string, fields ...Fields) {
+	if level < l.level {
+		return
+	}
+
+	entry := make(Fields, len(l.fields))
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	for _, f := range fields {
+		for k, v := range f {
+			entry[k] = v
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	now := time.Now()
+	switch l.format {
+	case FormatJSON:
+		writeJSON(buf, now, level, event, msg, entry)
+	case FormatLogfmt:
+		writeLogfmt(buf, now, level, event, msg, entry)
+	default:
+		writeText(buf, now, level, event, msg, entry)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+// Writer returns a writer that logs each line written to it as an info entry,
+// for use with libraries that log through the standard library logger.
+func (l *Logger) Writer(event string) io.Writer {
+	return &lineWriter{logger: l, event: event}
+}
+
+type lineWriter struct {
+	logger *Logger
+	event  string
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.Info(w.event, line)
+	}
+	return len(p), nil
+}
+
+// value converts field values to a form suitable for output
+func value(v interface{}) interface{} {
+	switch val := v.(type) {
+	case error:
+		return val.Error()
+	case time.Time:
+		return val.Format(time.RFC3339)
+	case fmt.Stringer:
+		return val.String()
+	default:
+		return v
+	}
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeJSON(buf *bytes.Buffer, now time.Time, level Level, event, msg string, fields Fields) {
+	entry := make(map[string]interface{}, len(fields)+4)
+	for k, v := range fields {
+		entry[k] = value(v)
+	}
+	entry["time"] = now.Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["event"] = event
+	entry["msg"] = msg
+
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		encoded, _ = json.Marshal(map[string]string{"time": now.Format(time.RFC3339Nano), "level": level.String(), "event": event, "msg": msg, "error": err.Error()})
+	}
+	buf.Write(encoded)
+	buf.WriteByte('\n')
+}
+
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(value(v))
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func writeLogfmt(buf *bytes.Buffer, now time.Time, level Level, event, msg string, fields Fields) {
+	fmt.Fprintf(buf, "time=%s level=%s event=%s msg=%s", now.Format(time.RFC3339Nano), level, logfmtValue(event), logfmtValue(msg))
+	for _, k := range sortedKeys(fields) {
+		fmt.Fprintf(buf, " %s=%s", k, logfmtValue(fields[k]))
+	}
+	buf.WriteByte('\n')
+}
+
+func writeText(buf *bytes.Buffer, now time.Time, level Level, event, msg string, fields Fields) {
+	fmt.Fprintf(buf, "%s %-5s %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), msg)
+	for _, k := range sortedKeys(fields) {
+		fmt.Fprintf(buf, " %s=%s", k, logfmtValue(fields[k]))
+	}
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLoggerJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := New(buf, LevelInfo, FormatJSON)
+	if err != nil {
+		t.Fatalf("Unable to create logger: %v", err)
+	}
+
+	logger = logger.With(Fields{"credential": "host-tls", "type": "pki"})
+	logger.Debug("renewer_created", "Created renewer")
+	logger.Error("renewal_failed", "Unable to renew credential", Fields{"error": fmt.Errorf("permission denied")})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected exactly one entry above the log level, got %d: %s", len(lines), buf.String())
+	}
+
+	entry := make(map[string]string)
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Unable to parse json entry: %v", err)
+	}
+
+	expected := map[string]string{
+		"level":      "error",
+		"event":      "renewal_failed",
+		"msg":        "Unable to renew credential",
+		"credential": "host-tls",
+		"type":       "pki",
+		"error":      "permission denied",
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("Wrong value for %s: expected '%s', got '%s'", k, v, entry[k])
+		}
+	}
+}
+
+func TestLoggerLogfmt(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := New(buf, LevelDebug, FormatLogfmt)
+	if err != nil {
+		t.Fatalf("Unable to create logger: %v", err)
+	}
+
+	logger.Info("credential_renewed", "Renewed credential", Fields{"credential": "host-tls"})
+	line := buf.String()
+	for _, expected := range []string{" level=info ", " event=credential_renewed ", ` msg="Renewed credential" `, " credential=host-tls\n"} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("Expected '%s' in logfmt entry: %s", expected, line)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if level, err := ParseLevel("WARN"); err != nil || level != LevelWarn {
+		t.Errorf("Unable to parse warn level: %v %v", level, err)
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Errorf("Expected error parsing unknown level")
+	}
+}
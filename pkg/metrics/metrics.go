@@ -0,0 +1,144 @@
+// Package metrics exports credmanager's renewal metrics in the prometheus text
+// exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/control"
+)
+
+// StatusSource provides the current status of managed credentials
+type StatusSource interface {
+	Status() []control.CredentialStatus
+}
+
+// Registry collects renewal events and serves them along with the current
+// credential status as prometheus metrics.
+type Registry struct {
+	source         StatusSource
+	lock           sync.Mutex
+	renewals       map[string]uint64
+	failures       map[string]uint64
+	actionFailures map[string]uint64
+	tokenTTL       time.Duration
+	tokenRenewed   time.Time
+}
+
+// NewRegistry returns a registry that reports per credential gauges from source
+func NewRegistry(source StatusSource) *Registry {
+	return &Registry{
+		source:         source,
+		renewals:       make(map[string]uint64),
+		failures:       make(map[string]uint64),
+		actionFailures: make(map[string]uint64),
+	}
+}
+
+// RecordRenewal counts a successful renewal of the named credential
+func (r *Registry) RecordRenewal(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.renewals[name]++
+}
+
+// RecordFailure counts a failed renewal of the named credential
+func (r *Registry) RecordFailure(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures[name]++
+}
+
+// RecordActionFailure counts a failed post renew action of the named credential
+func (r *Registry) RecordActionFailure(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.actionFailures[name]++
+}
+
+// SetTokenTTL records the ttl of the daemon's own vault token
+func (r *Registry) SetTokenTTL(ttl time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.tokenTTL = ttl
+	r.tokenRenewed = time.Now()
+}
+
+// escapeLabel escapes a label value as required by the text format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func timestamp(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func writeHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeCounter(w io.Writer, name, help string, values map[string]uint64) {
+	writeHeader(w, name, "counter", help)
+	names := make([]string, 0, len(values))
+	for credential := range values {
+		names = append(names, credential)
+	}
+	sort.Strings(names)
+	for _, credential := range names {
+		fmt.Fprintf(w, "%s{credential=\"%s\"} %d\n", name, escapeLabel(credential), values[credential])
+	}
+}
+
+func writeCredentialGauge(w io.Writer, name, help string, statuses []control.CredentialStatus, value func(control.CredentialStatus) float64) {
+	writeHeader(w, name, "gauge", help)
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%s{credential=\"%s\"} %g\n", name, escapeLabel(s.Name), value(s))
+	}
+}
+
+// Write writes all metrics to w in the prometheus text format
+func (r *Registry) Write(w io.Writer) {
+	var statuses []control.CredentialStatus
+	if r.source != nil {
+		statuses = r.source.Status()
+	}
+
+	writeCredentialGauge(w, "credmanager_credential_expiry_timestamp_seconds", "Expiration time of the current credential.", statuses,
+		func(s control.CredentialStatus) float64 { return timestamp(s.Expiration) })
+	writeCredentialGauge(w, "credmanager_credential_last_success_timestamp_seconds", "Time of the last successful renewal.", statuses,
+		func(s control.CredentialStatus) float64 { return timestamp(s.LastRenewal) })
+	writeCredentialGauge(w, "credmanager_credential_next_renewal_timestamp_seconds", "Time of the next scheduled renewal.", statuses,
+		func(s control.CredentialStatus) float64 { return timestamp(s.NextRenewal) })
+	writeCredentialGauge(w, "credmanager_credential_consecutive_failures", "Number of renewal failures since the last successful renewal.", statuses,
+		func(s control.CredentialStatus) float64 { return float64(s.FailureCount) })
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	writeCounter(w, "credmanager_credential_renewals_total", "Number of successful credential renewals.", r.renewals)
+	writeCounter(w, "credmanager_credential_renewal_failures_total", "Number of failed credential renewals.", r.failures)
+	writeCounter(w, "credmanager_credential_action_failures_total", "Number of failed post renew actions.", r.actionFailures)
+
+	var tokenExpiry time.Time
+	if !r.tokenRenewed.IsZero() {
+		tokenExpiry = r.tokenRenewed.Add(r.tokenTTL)
+	}
+	writeHeader(w, "credmanager_token_ttl_seconds", "gauge", "TTL of the daemon's vault token at its last renewal.")
+	fmt.Fprintf(w, "credmanager_token_ttl_seconds %g\n", r.tokenTTL.Seconds())
+	writeHeader(w, "credmanager_token_expiry_timestamp_seconds", "gauge", "Expiration time of the daemon's vault token.")
+	fmt.Fprintf(w, "credmanager_token_expiry_timestamp_seconds %g\n", timestamp(tokenExpiry))
+}
+
+// ServeHTTP serves the metrics in the prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PolarGeospatialCenter/credmanager/pkg/control"
+	"github.com/PolarGeospatialCenter/credmanager/pkg/credentials"
+)
+
+type testSource []control.CredentialStatus
+
+func (s testSource) Status() []control.CredentialStatus {
+	return s
+}
+
+func TestRegistryWrite(t *testing.T) {
+	source := testSource{{
+		Name: `host "tls"`,
+		RenewerStatus: credentials.RenewerStatus{
+			Expiration:   time.Unix(1500000000, 0),
+			FailureCount: 3,
+		},
+	}}
+	r := NewRegistry(source)
+	r.RecordRenewal("host-ssh")
+	r.RecordRenewal("host-ssh")
+	r.RecordFailure(`host "tls"`)
+	r.RecordActionFailure("host-ssh")
+	r.SetTokenTTL(time.Hour)
+
+	buf := &bytes.Buffer{}
+	r.Write(buf)
+	output := buf.String()
+
+	expected := []string{
+		"# TYPE credmanager_credential_expiry_timestamp_seconds gauge\n",
+		`credmanager_credential_expiry_timestamp_seconds{credential="host \"tls\""} 1.5e+09` + "\n",
+		`credmanager_credential_consecutive_failures{credential="host \"tls\""} 3` + "\n",
+		`credmanager_credential_last_success_timestamp_seconds{credential="host \"tls\""} 0` + "\n",
+		"# TYPE credmanager_credential_renewals_total counter\n",
+		`credmanager_credential_renewals_total{credential="host-ssh"} 2` + "\n",
+		`credmanager_credential_renewal_failures_total{credential="host \"tls\""} 1` + "\n",
+		`credmanager_credential_action_failures_total{credential="host-ssh"} 1` + "\n",
+		"credmanager_token_ttl_seconds 3600\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("Expected line missing from metrics output: %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Logf("Got:\n%s", output)
+	}
+}